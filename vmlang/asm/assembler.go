@@ -3,9 +3,10 @@ package asm
 import (
 	"errors"
 	"fmt"
-	"os"
+	"sort"
 
 	"github.com/johnny-morrice/learn/vmlang/asm/ast"
+	"github.com/johnny-morrice/learn/vmlang/verify"
 	"github.com/johnny-morrice/learn/vmlang/vm"
 )
 
@@ -15,6 +16,8 @@ type intrParam struct {
 	value     *uint64
 	varName   string
 	labelName string
+	// expr is evaluated once every address is known.
+	expr *ast.Expr
 }
 
 func (param intrParam) getParamName() string {
@@ -40,6 +43,9 @@ func (param intrParam) valueString() string {
 }
 
 func (param intrParam) String() string {
+	if param.expr != nil {
+		return fmt.Sprintf("[expr: %v]", param.expr)
+	}
 	if param.varName != "" {
 		return fmt.Sprintf("[varName: %v, value: %v]", param.varName, param.valueString())
 	}
@@ -54,6 +60,8 @@ type intrOp struct {
 	size       int
 	parameters []intrParam
 	label      string
+	pos        ast.Pos
+	expansion  *ast.Expansion
 }
 
 func (op intrOp) String() string {
@@ -63,16 +71,48 @@ func (op intrOp) String() string {
 	return fmt.Sprintf("[op: %v, size: %v, params: %v]", op.op, op.size, op.parameters)
 }
 
+// wrapError adds the position of the op, and any macro calls that produced
+// it, to err.
+func (op intrOp) wrapError(err error) error {
+	if op.pos.Line == 0 {
+		return err
+	}
+	if op.expansion != nil {
+		return fmt.Errorf("%s: %w\n%s", op.pos, err, op.expansion)
+	}
+	return fmt.Errorf("%s: %w", op.pos, err)
+}
+
 type assembler struct {
 	varTable   map[string]int
 	nameTable  map[string]*uint64
 	labelTable map[string]struct{}
-	stmts      []intrOp
+	// dataTable holds the offset of each data block within dataArea.
+	dataTable map[string]int
+	dataArea  []uint64
+	// importTable holds names defined by other objects, and exportTable
+	// the names this object makes visible to them.
+	importTable map[string]struct{}
+	exportTable map[string]ast.Pos
+	varInits    map[string]ast.Expr
+	// tableInits holds the entries of each table, which are evaluated
+	// once every address is known.
+	tableInits map[string][]ast.Expr
+	constTable map[string]ast.Expr
+	// constValues caches evaluated constants and evaluating detects cycles.
+	constValues map[string]value
+	evaluating  map[string]bool
+	// laidOut is set once the address of every name is known.
+	laidOut bool
+	stmts   []intrOp
 }
 
+// maxDataSize caps the number of words reserved by data, array and table
+// statements.
+const maxDataSize = 1 << 30
+
 func (asm *assembler) defineVar(varName string) error {
-	_, exists := asm.nameTable[varName]
-	if exists {
+	if asm.isDefined(varName) {
 		return fmt.Errorf("duplicate variable definition: %s; %w", varName, ErrAssembler)
 	}
 	asm.varTable[varName] = len(asm.varTable)
@@ -83,8 +123,7 @@ func (asm *assembler) defineVar(varName string) error {
 }
 
 func (asm *assembler) defineLabel(labelName string) error {
-	_, exists := asm.nameTable[labelName]
-	if exists {
+	if asm.isDefined(labelName) {
 		return fmt.Errorf("duplicate variable definition: %s; %w", labelName, ErrAssembler)
 	}
 	asm.labelTable[labelName] = struct{}{}
@@ -94,16 +133,124 @@ func (asm *assembler) defineLabel(labelName string) error {
 	return nil
 }
 
-func (asm *assembler) addOpStmt(stmt ast.OpStmt) {
-	iOp := intrOp{}
+func (asm *assembler) defineData(stmt ast.DataStmt) error {
+	if asm.isDefined(stmt.Name) {
+		return fmt.Errorf("duplicate variable definition: %s; %w", stmt.Name, ErrAssembler)
+	}
+	asm.dataTable[stmt.Name] = len(asm.dataArea)
+	asm.dataArea = append(asm.dataArea, uint64(len(stmt.Text)))
+	for _, b := range []byte(stmt.Text) {
+		asm.dataArea = append(asm.dataArea, uint64(b))
+	}
+	val := uint64(0)
+	asm.nameTable[stmt.Name] = &val
+
+	return nil
+}
+
+func (asm *assembler) defineArray(stmt ast.ArrayStmt) error {
+	if asm.isDefined(stmt.Name) {
+		return fmt.Errorf("duplicate variable definition: %s; %w", stmt.Name, ErrAssembler)
+	}
+	size, err := asm.evalConst(stmt.Size)
+	if err != nil {
+		return err
+	}
+	if size > maxDataSize-uint64(len(asm.dataArea)) {
+		return fmt.Errorf("array too large: %s; %w", stmt.Name, ErrAssembler)
+	}
+	asm.dataTable[stmt.Name] = len(asm.dataArea)
+	asm.dataArea = append(asm.dataArea, make([]uint64, size)...)
+	val := uint64(0)
+	asm.nameTable[stmt.Name] = &val
+
+	return nil
+}
+
+func (asm *assembler) defineTable(stmt ast.TableStmt) error {
+	if asm.isDefined(stmt.Name) {
+		return fmt.Errorf("duplicate variable definition: %s; %w", stmt.Name, ErrAssembler)
+	}
+	if uint64(len(stmt.Entries)) > maxDataSize-uint64(len(asm.dataArea)) {
+		return fmt.Errorf("table too large: %s; %w", stmt.Name, ErrAssembler)
+	}
+	asm.dataTable[stmt.Name] = len(asm.dataArea)
+	asm.dataArea = append(asm.dataArea, make([]uint64, len(stmt.Entries))...)
+	asm.tableInits[stmt.Name] = stmt.Entries
+	val := uint64(0)
+	asm.nameTable[stmt.Name] = &val
+
+	return nil
+}
+
+// defineLocals numbers the names of a local statement after those already
+// in locals.
+func (asm *assembler) defineLocals(stmt ast.LocalStmt, locals map[string]uint64) error {
+	for _, name := range stmt.Names {
+		if _, exists := locals[name]; exists || asm.isDefined(name) {
+			return fmt.Errorf("duplicate variable definition: %s; %w", name, ErrAssembler)
+		}
+		locals[name] = uint64(len(locals))
+	}
+	return nil
+}
+
+// subroutineLabels finds the labels that start a subroutine, which end the
+// scope of any locals before them. A subroutine may return from more than
+// one place, so its locals stay in scope after a rtn, up to the next
+// subroutine's label.
+func subroutineLabels(tree ast.AST) map[string]bool {
+	names := map[string]bool{}
+	for _, stmt := range tree.Stmts {
+		switch {
+		case stmt.Op != nil && (stmt.Op.Op == vm.Call || stmt.Op.Op == vm.CallIndirect):
+			for _, param := range stmt.Op.Params {
+				exprNames(ast.ParamExpr(param), names)
+			}
+		case stmt.Table != nil:
+			for _, entry := range stmt.Table.Entries {
+				exprNames(entry, names)
+			}
+		case stmt.Export != nil:
+			for _, name := range stmt.Export.Names {
+				names[name] = true
+			}
+		}
+	}
+	return names
+}
+
+func (asm *assembler) addOpStmt(stmt ast.OpStmt, pos ast.Pos, expansion *ast.Expansion) error {
+	iOp := intrOp{pos: pos, expansion: expansion}
 	iOp.size = 1 + len(stmt.Params)
 	iOp.op = stmt.Op
 
+	info, ok := stmt.Op.Info()
+	if !ok {
+		return iOp.wrapError(fmt.Errorf("unknown bytecode: %d; %w", stmt.Op, ErrAssembler))
+	}
+	if len(stmt.Params) != len(info.Operands) {
+		return iOp.wrapError(fmt.Errorf("%s expects %d operands but was given %d; %w",
+			info.Mnemonic, len(info.Operands), len(stmt.Params), ErrAssembler))
+	}
+
 	// fmt.Printf("add op stmt: %v\n", stmt)
 
 	for _, param := range stmt.Params {
 		iParam := intrParam{}
 
+		if param.Expr != nil {
+			iParam.expr = param.Expr
+			iOp.parameters = append(iOp.parameters, iParam)
+			continue
+		}
+
+		if _, isConst := asm.constTable[param.Variable]; isConst {
+			iParam.expr = &ast.Expr{Name: param.Variable}
+			iOp.parameters = append(iOp.parameters, iParam)
+			continue
+		}
+
 		if param.Variable == "" {
 			iParam.value = &param.Literal
 			iOp.parameters = append(iOp.parameters, iParam)
@@ -111,11 +258,12 @@ func (asm *assembler) addOpStmt(stmt ast.OpStmt) {
 		}
 
 		_, varExists := asm.varTable[param.Variable]
+		_, dataExists := asm.dataTable[param.Variable]
 		_, labelExists := asm.labelTable[param.Variable]
 
 		addr := asm.nameTable[param.Variable]
 
-		if varExists {
+		if varExists || dataExists || !labelExists {
 			iParam.varName = param.Variable
 		}
 		if labelExists {
@@ -126,6 +274,7 @@ func (asm *assembler) addOpStmt(stmt ast.OpStmt) {
 	}
 
 	asm.stmts = append(asm.stmts, iOp)
+	return nil
 }
 
 func (asm *assembler) addLabelStmt(stmt ast.LabelStmt) {
@@ -141,36 +290,219 @@ func (asm *assembler) setNameAddress(name string, addr uint64) {
 	*ptr = addr
 }
 
-const stackSize = 2_000_000
-const gapSize = 100
+func (asm *assembler) defineImport(name string) error {
+	if asm.isDefined(name) {
+		return fmt.Errorf("duplicate variable definition: %s; %w", name, ErrAssembler)
+	}
+	asm.importTable[name] = struct{}{}
+	val := uint64(0)
+	asm.nameTable[name] = &val
+
+	return nil
+}
+
+// nameBase is the section that the address of a name is relative to.
+func (asm *assembler) nameBase(name string) RelocBase {
+	if _, isImport := asm.importTable[name]; isImport {
+		return SymbolBase
+	}
+	if _, isLabel := asm.labelTable[name]; isLabel {
+		return CodeBase
+	}
+	return HeapBase
+}
+
+func (asm *assembler) symbols() ([]ObjectSymbol, error) {
+	syms := []ObjectSymbol{}
+	for name, addr := range asm.nameTable {
+		if _, isImport := asm.importTable[name]; isImport {
+			continue
+		}
+		kind := vm.LabelSymbol
+		if _, isVar := asm.varTable[name]; isVar {
+			kind = vm.VarSymbol
+		}
+		if _, isData := asm.dataTable[name]; isData {
+			kind = vm.DataSymbol
+		}
+		_, exported := asm.exportTable[name]
+		syms = append(syms, ObjectSymbol{
+			Name:     name,
+			Kind:     kind,
+			Address:  *addr,
+			Exported: exported,
+		})
+	}
+	for name, pos := range asm.exportTable {
+		_, isName := asm.nameTable[name]
+		_, isImport := asm.importTable[name]
+		if !isName || isImport {
+			return nil, fmt.Errorf("%s: cannot export %s, it is not defined here; %w", pos, name, ErrAssembler)
+		}
+	}
+	sort.Slice(syms, func(i, j int) bool {
+		if symbolSection(syms[i].Kind) != symbolSection(syms[j].Kind) {
+			return symbolSection(syms[i].Kind) < symbolSection(syms[j].Kind)
+		}
+		if syms[i].Address == syms[j].Address {
+			return syms[i].Name < syms[j].Name
+		}
+		return syms[i].Address < syms[j].Address
+	})
+	return syms, nil
+}
 
+// Assemble assembles a complete program into a machine ready to run.
 func Assemble(tree ast.AST) (*vm.VirtualMachine, error) {
+	return AssembleWith(tree, Options{})
+}
+
+// Options turns on the optional passes of AssembleWith and
+// AssembleObjectWith.
+type Options struct {
+	// Optimise rewrites the ops with peephole rules before they are laid out.
+	Optimise bool
+	// Verify checks the assembled program with verify.Verify.
+	Verify bool
+}
+
+// AssembleWith assembles a complete program like Assemble, running the
+// passes chosen in opts.
+func AssembleWith(tree ast.AST, opts Options) (*vm.VirtualMachine, error) {
+	obj, err := AssembleObjectWith(tree, opts)
+	if err != nil {
+		return nil, err
+	}
+	machine, err := Link(obj)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Verify {
+		err = verify.Verify(machine)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return machine, nil
+}
+
+// AssembleObject assembles a unit of a program. Addresses in the object are
+// relative to the start of their section until it is linked.
+func AssembleObject(tree ast.AST) (*Object, error) {
+	return AssembleObjectWith(tree, Options{})
+}
+
+// AssembleObjectWith assembles a unit of a program like AssembleObject,
+// optimising it if opts asks. Verify is ignored, since a unit can only be
+// checked once it is linked.
+func AssembleObjectWith(tree ast.AST, opts Options) (*Object, error) {
 	asm := assembler{
-		varTable:   map[string]int{},
-		nameTable:  map[string]*uint64{},
-		labelTable: map[string]struct{}{},
+		varTable:    map[string]int{},
+		nameTable:   map[string]*uint64{},
+		labelTable:  map[string]struct{}{},
+		dataTable:   map[string]int{},
+		importTable: map[string]struct{}{},
+		exportTable: map[string]ast.Pos{},
+		varInits:    map[string]ast.Expr{},
+		tableInits:  map[string][]ast.Expr{},
+		constTable:  map[string]ast.Expr{},
+		constValues: map[string]value{},
+		evaluating:  map[string]bool{},
 	}
 
-	machine := &vm.VirtualMachine{}
+	// Constants are defined first so that array sizes may use them before
+	// their definition.
+	for _, stmt := range tree.Stmts {
+		if stmt.Const != nil {
+			err := asm.defineConst(*stmt.Const)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
 
 	for _, stmt := range tree.Stmts {
+		var err error
+		if stmt.Macro != nil || stmt.MacroCall != nil {
+			return nil, fmt.Errorf("%s: macros must be expanded before assembly; %w", stmt.Pos, ErrAssembler)
+		}
+		if stmt.Include != nil {
+			return nil, fmt.Errorf("%s: includes must be resolved before assembly; %w", stmt.Pos, ErrAssembler)
+		}
 		if stmt.Var != nil {
 			for _, varName := range stmt.Var.VarNames {
-				asm.defineVar(varName)
+				err = asm.defineVar(varName)
+				if err != nil {
+					return nil, err
+				}
+			}
+			if stmt.Var.Init != nil {
+				for _, varName := range stmt.Var.VarNames {
+					asm.varInits[varName] = *stmt.Var.Init
+				}
 			}
 		}
 		if stmt.Label != nil {
-			asm.defineLabel(stmt.Label.Label)
+			err = asm.defineLabel(stmt.Label.Label)
+		}
+		if stmt.Data != nil {
+			err = asm.defineData(*stmt.Data)
+		}
+		if stmt.Array != nil {
+			err = asm.defineArray(*stmt.Array)
+		}
+		if stmt.Table != nil {
+			err = asm.defineTable(*stmt.Table)
+		}
+		if stmt.Import != nil {
+			for _, name := range stmt.Import.Names {
+				err = asm.defineImport(name)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		if stmt.Export != nil {
+			for _, name := range stmt.Export.Names {
+				asm.exportTable[name] = stmt.Pos
+			}
+		}
+		if err != nil {
+			return nil, err
 		}
 	}
 
+	subroutines := subroutineLabels(tree)
+	locals := map[string]uint64{}
 	for _, stmt := range tree.Stmts {
 		if stmt.Op != nil {
-			asm.addOpStmt(*stmt.Op)
+			op := *stmt.Op
+			if op.Op == vm.LoadLocal || op.Op == vm.StoreLocal {
+				op.Params = localParams(op.Params, locals)
+			} else if name, isLocal := localName(op.Params, locals); isLocal {
+				iOp := intrOp{pos: stmt.Pos, expansion: stmt.Expansion}
+				return nil, iOp.wrapError(fmt.Errorf("%s is a local, which only lload and lstore can use; %w", name, ErrAssembler))
+			}
+			err := asm.addOpStmt(op, stmt.Pos, stmt.Expansion)
+			if err != nil {
+				return nil, err
+			}
 		}
 		if stmt.Label != nil {
+			if subroutines[stmt.Label.Label] {
+				locals = map[string]uint64{}
+			}
 			asm.addLabelStmt(*stmt.Label)
 		}
+		if stmt.Local != nil {
+			err := asm.defineLocals(*stmt.Local, locals)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", stmt.Pos, err)
+			}
+		}
+	}
+	if opts.Optimise {
+		asm.optimise()
 	}
 
 	bytecodeSize := uint64(0)
@@ -185,35 +517,80 @@ func Assemble(tree ast.AST) (*vm.VirtualMachine, error) {
 
 	bytecodeSize++
 
-	stackStart := bytecodeSize + gapSize
-	stackEnd := stackStart + stackSize
-	heapStart := stackStart + stackSize + gapSize
-
 	for varName, offset := range asm.varTable {
-		asm.setNameAddress(varName, heapStart+uint64(offset))
+		asm.setNameAddress(varName, uint64(offset))
+	}
+	dataStart := uint64(len(asm.varTable))
+	for dataName, offset := range asm.dataTable {
+		asm.setNameAddress(dataName, dataStart+uint64(offset))
+	}
+	asm.laidOut = true
+
+	obj := &Object{
+		Code: make([]uint64, bytecodeSize),
+		Heap: make([]uint64, dataStart+uint64(len(asm.dataArea))),
 	}
+	copy(obj.Heap[dataStart:], asm.dataArea)
 
-	machine.Memory = make([]uint64, heapStart)
-	index := 0
+	for varName, init := range asm.varInits {
+		val, err := asm.eval(init)
+		if err != nil {
+			return nil, err
+		}
+		obj.setWord(HeapSection, uint64(asm.varTable[varName]), val)
+	}
+	for tableName, entries := range asm.tableInits {
+		start := dataStart + uint64(asm.dataTable[tableName])
+		for i, entry := range entries {
+			val, err := asm.eval(entry)
+			if err != nil {
+				return nil, err
+			}
+			obj.setWord(HeapSection, start+uint64(i), val)
+		}
+	}
+	index := uint64(0)
 	for _, iStmt := range asm.stmts {
 		if iStmt.label != "" {
 			continue
 		}
-		machine.Memory[index] = uint64(iStmt.op)
+		if iStmt.pos.Line > 0 {
+			obj.SourceMap = append(obj.SourceMap, vm.SourceMapEntry{
+				Address:  index,
+				Location: vm.SourceLocation(iStmt.pos),
+			})
+		}
+		obj.Code[index] = uint64(iStmt.op)
 		index++
 		for _, iParam := range iStmt.parameters {
+			if iParam.expr != nil {
+				val, err := asm.eval(*iParam.expr)
+				if err != nil {
+					return nil, iStmt.wrapError(err)
+				}
+				obj.setWord(CodeSection, index, val)
+				index++
+				continue
+			}
 			if iParam.value == nil {
-				return nil, iParam.missingValueError()
+				return nil, iStmt.wrapError(iParam.missingValueError())
+			}
+			val := value{n: *iParam.value}
+			if name := iParam.getParamName(); name != "" {
+				val.base = asm.nameBase(name)
+				val.symbol = name
 			}
-			machine.Memory[index] = *iParam.value
+			obj.setWord(CodeSection, index, val)
 			index++
 		}
 	}
-	machine.Memory[index] = uint64(vm.Exit)
-	machine.StackEnd = stackEnd
-	machine.SP = stackStart
-	machine.HeapStart = heapStart
-	machine.Output = os.Stdout
+	obj.Code[index] = uint64(vm.Exit)
 
-	return machine, nil
+	var err error
+	obj.Symbols, err = asm.symbols()
+	if err != nil {
+		return nil, err
+	}
+
+	return obj, nil
 }
@@ -7,6 +7,7 @@ import (
 	"testing"
 
 	"github.com/johnny-morrice/learn/vmlang/asm/ast"
+	"github.com/johnny-morrice/learn/vmlang/asm/parser"
 	"github.com/johnny-morrice/learn/vmlang/example"
 	"github.com/johnny-morrice/learn/vmlang/vm"
 )
@@ -68,7 +69,80 @@ func TestAssembleAndRunProgram(t *testing.T) {
 		},
 		"factorial": {
 			ast:            example.FactorialAst(),
-			expectedOutput: []byte{24},
+			expectedOutput: []byte("24"),
+		},
+		"call subroutine": {
+			ast: ast.AST{
+				Stmts: []ast.Stmt{
+					{
+						Op: &ast.OpStmt{
+							Op:     vm.Push,
+							Params: []ast.Param{{Literal: 2}},
+						},
+					},
+					{
+						Op: &ast.OpStmt{
+							Op:     vm.Call,
+							Params: []ast.Param{{Variable: "double"}},
+						},
+					},
+					{
+						Op: &ast.OpStmt{
+							Op: vm.OutputByte,
+						},
+					},
+					{
+						Op: &ast.OpStmt{
+							Op: vm.Exit,
+						},
+					},
+					{
+						Label: &ast.LabelStmt{
+							Label: "double",
+						},
+					},
+					{
+						Op: &ast.OpStmt{
+							Op: vm.Duplicate,
+						},
+					},
+					{
+						Op: &ast.OpStmt{
+							Op: vm.Multiply,
+						},
+					},
+					{
+						Op: &ast.OpStmt{
+							Op: vm.Return,
+						},
+					},
+				},
+			},
+			expectedOutput: []byte{4},
+		},
+		"output string data": {
+			ast: ast.AST{
+				Stmts: []ast.Stmt{
+					{
+						Data: &ast.DataStmt{
+							Name: "greeting",
+							Text: "hello\n",
+						},
+					},
+					{
+						Op: &ast.OpStmt{
+							Op:     vm.Push,
+							Params: []ast.Param{{Variable: "greeting"}},
+						},
+					},
+					{
+						Op: &ast.OpStmt{
+							Op: vm.OutputString,
+						},
+					},
+				},
+			},
+			expectedOutput: []byte("hello\n"),
 		},
 	}
 
@@ -89,6 +163,7 @@ func TestAssembleAndRunProgram(t *testing.T) {
 				t.Fatalf("expected output: %v but received: %v", tc.expectedOutput, actual)
 				return
 			}
+			assertOptimisedEquivalent(t, tc.ast)
 		})
 	}
 }
@@ -119,7 +194,7 @@ func TestAssembleAsmScript(t *testing.T) {
 			},
 			expectedBytecode: []uint64{uint64(vm.Push), 4, uint64(vm.Exit), 0},
 		},
-		"write to heap var": {
+		"push heap var": {
 			ast: ast.AST{
 				Stmts: []ast.Stmt{
 					{
@@ -129,7 +204,7 @@ func TestAssembleAsmScript(t *testing.T) {
 					},
 					{
 						Op: &ast.OpStmt{
-							Op: vm.WriteMemory,
+							Op: vm.Push,
 							Params: []ast.Param{
 								{
 									Variable: "TestVar",
@@ -139,14 +214,14 @@ func TestAssembleAsmScript(t *testing.T) {
 					},
 				},
 			},
-			expectedBytecode: []uint64{uint64(vm.WriteMemory), 3 + gapSize + stackSize + gapSize, uint64(vm.Exit), 0},
+			expectedBytecode: []uint64{uint64(vm.Push), 3 + gapSize + stackSize + gapSize, uint64(vm.Exit), 0},
 		},
 		"var can be defined anywhere": {
 			ast: ast.AST{
 				Stmts: []ast.Stmt{
 					{
 						Op: &ast.OpStmt{
-							Op: vm.WriteMemory,
+							Op: vm.Push,
 							Params: []ast.Param{
 								{
 									Variable: "TestVar",
@@ -161,7 +236,200 @@ func TestAssembleAsmScript(t *testing.T) {
 					},
 				},
 			},
-			expectedBytecode: []uint64{uint64(vm.WriteMemory), 3 + gapSize + stackSize + gapSize, uint64(vm.Exit), 0},
+			expectedBytecode: []uint64{uint64(vm.Push), 3 + gapSize + stackSize + gapSize, uint64(vm.Exit), 0},
+		},
+		"data after vars": {
+			ast: ast.AST{
+				Stmts: []ast.Stmt{
+					{
+						Data: &ast.DataStmt{
+							Name: "msg",
+							Text: "ok",
+						},
+					},
+					{
+						Var: &ast.VarStmt{
+							VarNames: []string{"TestVar"},
+						},
+					},
+					{
+						Op: &ast.OpStmt{
+							Op: vm.Push,
+							Params: []ast.Param{
+								{
+									Variable: "msg",
+								},
+							},
+						},
+					},
+				},
+			},
+			expectedBytecode: []uint64{uint64(vm.Push), 3 + gapSize + stackSize + gapSize + 1, uint64(vm.Exit), 0},
+			expectedHeap:     []uint64{0, 2, 'o', 'k'},
+		},
+		"duplicate data name": {
+			ast: ast.AST{
+				Stmts: []ast.Stmt{
+					{
+						Var: &ast.VarStmt{
+							VarNames: []string{"msg"},
+						},
+					},
+					{
+						Data: &ast.DataStmt{
+							Name: "msg",
+							Text: "ok",
+						},
+					},
+				},
+			},
+			expectedError: ErrAssembler,
+		},
+		"constant expression params": {
+			ast: ast.AST{
+				Stmts: []ast.Stmt{
+					{
+						Const: &ast.ConstStmt{
+							Name:  "SIZE",
+							Value: ast.BinaryExpr("<<", ast.Expr{Literal: 1}, ast.Expr{Literal: 3}),
+						},
+					},
+					{
+						Op: &ast.OpStmt{
+							Op:     vm.Push,
+							Params: []ast.Param{{Variable: "SIZE"}},
+						},
+					},
+					{
+						Op: &ast.OpStmt{
+							Op: vm.Push,
+							Params: []ast.Param{
+								ast.ParamFromExpr(ast.BinaryExpr("+", ast.Expr{Name: "buf"}, ast.Expr{Literal: 4})),
+							},
+						},
+					},
+					{
+						Array: &ast.ArrayStmt{
+							Name: "buf",
+							Size: ast.BinaryExpr("*", ast.Expr{Name: "SIZE"}, ast.Expr{Literal: 2}),
+						},
+					},
+					{
+						Var: &ast.VarStmt{
+							VarNames: []string{"x"},
+							Init:     &ast.Expr{Name: "SIZE"},
+						},
+					},
+					{
+						Data: &ast.DataStmt{
+							Name: "msg",
+							Text: "hi",
+						},
+					},
+				},
+			},
+			expectedBytecode: []uint64{uint64(vm.Push), 8, uint64(vm.Push), 5 + gapSize + stackSize + gapSize + 1 + 4, uint64(vm.Exit), 0},
+			expectedHeap:     []uint64{8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2, 'h', 'i'},
+		},
+		"var initialised with label": {
+			ast: ast.AST{
+				Stmts: []ast.Stmt{
+					{
+						Var: &ast.VarStmt{
+							VarNames: []string{"handler"},
+							Init:     &ast.Expr{Name: "end"},
+						},
+					},
+					{
+						Op: &ast.OpStmt{
+							Op: vm.Pop,
+						},
+					},
+					{
+						Label: &ast.LabelStmt{
+							Label: "end",
+						},
+					},
+				},
+			},
+			expectedBytecode: []uint64{uint64(vm.Pop), uint64(vm.Exit), 0},
+			expectedHeap:     []uint64{1},
+		},
+		"constant defined in terms of itself": {
+			ast: ast.AST{
+				Stmts: []ast.Stmt{
+					{
+						Const: &ast.ConstStmt{
+							Name:  "A",
+							Value: ast.BinaryExpr("+", ast.Expr{Name: "B"}, ast.Expr{Literal: 1}),
+						},
+					},
+					{
+						Const: &ast.ConstStmt{
+							Name:  "B",
+							Value: ast.Expr{Name: "A"},
+						},
+					},
+					{
+						Op: &ast.OpStmt{
+							Op:     vm.Push,
+							Params: []ast.Param{{Variable: "A"}},
+						},
+					},
+				},
+			},
+			expectedError: ErrAssembler,
+		},
+		"array size from address": {
+			ast: ast.AST{
+				Stmts: []ast.Stmt{
+					{
+						Label: &ast.LabelStmt{
+							Label: "start",
+						},
+					},
+					{
+						Array: &ast.ArrayStmt{
+							Name: "buf",
+							Size: ast.Expr{Name: "start"},
+						},
+					},
+				},
+			},
+			expectedError: ErrAssembler,
+		},
+		"division by zero in expression": {
+			ast: ast.AST{
+				Stmts: []ast.Stmt{
+					{
+						Op: &ast.OpStmt{
+							Op: vm.Push,
+							Params: []ast.Param{
+								ast.ParamFromExpr(ast.BinaryExpr("/", ast.Expr{Literal: 1}, ast.Expr{Literal: 0})),
+							},
+						},
+					},
+				},
+			},
+			expectedError: ErrAssembler,
+		},
+		"duplicate constant": {
+			ast: ast.AST{
+				Stmts: []ast.Stmt{
+					{
+						Const: &ast.ConstStmt{
+							Name:  "x",
+							Value: ast.Expr{Literal: 1},
+						},
+					},
+					{
+						Var: &ast.VarStmt{
+							VarNames: []string{"x"},
+						},
+					},
+				},
+			},
+			expectedError: ErrAssembler,
 		},
 		"go to missing label": {
 			ast: ast.AST{
@@ -175,6 +443,31 @@ func TestAssembleAsmScript(t *testing.T) {
 			},
 			expectedError: ErrAssembler,
 		},
+		"push without operand": {
+			ast: ast.AST{
+				Stmts: []ast.Stmt{
+					{
+						Op: &ast.OpStmt{
+							Op: vm.Push,
+						},
+					},
+				},
+			},
+			expectedError: ErrAssembler,
+		},
+		"pop with operand": {
+			ast: ast.AST{
+				Stmts: []ast.Stmt{
+					{
+						Op: &ast.OpStmt{
+							Op:     vm.Pop,
+							Params: []ast.Param{{Literal: 5}},
+						},
+					},
+				},
+			},
+			expectedError: ErrAssembler,
+		},
 		"go to label": {
 			ast: ast.AST{
 				Stmts: []ast.Stmt{
@@ -246,7 +539,7 @@ func TestAssembleAsmScript(t *testing.T) {
 			}
 
 			if len(tc.expectedHeap) > 0 {
-				actualHeap := vm.Memory[vm.HeapStart:len(tc.expectedHeap)]
+				actualHeap := vm.Memory[vm.HeapStart : vm.HeapStart+uint64(len(tc.expectedHeap))]
 				if !reflect.DeepEqual(tc.expectedHeap, actualHeap) {
 					t.Errorf("expected heap: %v\nactual: %v", tc.expectedHeap, actualHeap)
 					for i, exp := range tc.expectedHeap {
@@ -259,6 +552,222 @@ func TestAssembleAsmScript(t *testing.T) {
 				}
 			}
 
+			assertOptimisedEquivalent(t, tc.ast)
+		})
+	}
+}
+
+func TestAssembleSourceMap(t *testing.T) {
+	machine, err := Assemble(example.FactorialAst())
+	if err != nil {
+		t.Fatalf("unexpected assemble err: %s", err)
+	}
+
+	testCases := map[uint64]string{
+		0:  "fac.vmsm:2:1",
+		2:  "fac.vmsm:3:1",
+		5:  "fac.vmsm:6:1",
+		10: "fac.vmsm:10:1",
+		24: "fac.vmsm:21:1",
+	}
+	for addr, expected := range testCases {
+		loc, ok := machine.SourceLocation(addr)
+		if !ok {
+			t.Errorf("expected location for address %v", addr)
+			continue
+		}
+		if loc.String() != expected {
+			t.Errorf("expected location %v for address %v but was: %v", expected, addr, loc)
+		}
+	}
+}
+
+func TestAssembleWithVerify(t *testing.T) {
+	_, err := AssembleWith(example.FactorialAst(), Options{Verify: true})
+	if err != nil {
+		t.Fatalf("unexpected err verifying factorial: %s", err)
+	}
+
+	underflow := ast.AST{
+		Stmts: []ast.Stmt{
+			{
+				Op: &ast.OpStmt{
+					Op: vm.Pop,
+				},
+			},
+		},
+	}
+	_, err = Assemble(underflow)
+	if err != nil {
+		t.Fatalf("unexpected err assembling without verify: %s", err)
+	}
+	_, err = AssembleWith(underflow, Options{Verify: true})
+	if !errors.Is(err, vm.ErrStackUnderflow) {
+		t.Errorf("expected stack underflow but was: %v", err)
+	}
+}
+
+func TestAssembleLinkedList(t *testing.T) {
+	tree, err := parser.Parse(parser.ParseContext{RemainingInput: example.LinkedListSourceCode})
+	if err != nil {
+		t.Fatalf("unexpected parse err: %s", err)
+	}
+	machine, err := AssembleWith(tree, Options{Verify: true})
+	if err != nil {
+		t.Fatalf("unexpected assemble err: %s", err)
+	}
+	output := &bytes.Buffer{}
+	machine.Output = output
+	machine.HeapDebug = true
+	err = machine.Execute()
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	if output.String() != "6" {
+		t.Errorf("expected output: %q\nactual: %q", "6", output.String())
+	}
+}
+
+func TestAssembleLocals(t *testing.T) {
+	type testCase struct {
+		src              string
+		expectedBytecode []uint64
+		expectedOutput   string
+		expectedError    error
+	}
+
+	testCases := map[string]testCase{
+		"recursive factorial": {
+			src:            example.FactorialRecursiveSourceCode,
+			expectedOutput: "24",
+		},
+		"numbered in order": {
+			src: `local a b
+local c
+lload c
+lstore a+1
+`,
+			expectedBytecode: []uint64{uint64(vm.LoadLocal), 2, uint64(vm.StoreLocal), 1, uint64(vm.Exit)},
+		},
+		"scope ends at next subroutine": {
+			src: `call f
+call g
+exit
+f:
+	local x y
+	rtn
+g:
+	local y
+	lload y
+	rtn
+`,
+			expectedBytecode: []uint64{
+				uint64(vm.Call), 5, uint64(vm.Call), 6, uint64(vm.Exit),
+				uint64(vm.Return),
+				uint64(vm.LoadLocal), 0, uint64(vm.Return),
+			},
+		},
+		"scope spans inner labels": {
+			src: `call f
+exit
+f:
+	local x y
+loop:
+	lload y
+	jnz loop
+	rtn
+`,
+			expectedBytecode: []uint64{
+				uint64(vm.Call), 3, uint64(vm.Exit),
+				uint64(vm.LoadLocal), 1, uint64(vm.JumpNotZero), 3, uint64(vm.Return),
+			},
+		},
+		"in scope after an early rtn": {
+			src: `call f
+exit
+f:
+	local x y
+	lload x
+	jnz more
+	rtn
+more:
+	lload y
+	rtn
+`,
+			expectedBytecode: []uint64{
+				uint64(vm.Call), 3, uint64(vm.Exit),
+				uint64(vm.LoadLocal), 0, uint64(vm.JumpNotZero), 8, uint64(vm.Return),
+				uint64(vm.LoadLocal), 1, uint64(vm.Return),
+			},
+		},
+		"used by another op": {
+			src: `local n
+enter 1
+push n
+`,
+			expectedError: ErrAssembler,
+		},
+		"used in an expression by another op": {
+			src: `const k = 2
+local n
+pick k+n
+`,
+			expectedError: ErrAssembler,
+		},
+		"used outside scope": {
+			src: `call f
+lload x
+exit
+f:
+	local x
+	rtn
+`,
+			expectedError: ErrAssembler,
+		},
+		"hides a variable": {
+			src:           "var x\nlocal x\n",
+			expectedError: ErrAssembler,
+		},
+		"duplicate": {
+			src:           "local x\nlocal x\n",
+			expectedError: ErrAssembler,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			tree, err := parser.Parse(parser.ParseContext{RemainingInput: tc.src})
+			if err != nil {
+				t.Fatalf("unexpected parse err: %s", err)
+			}
+			machine, err := Assemble(tree)
+			if !errors.Is(err, tc.expectedError) {
+				t.Fatalf("expected err: %v\nactual: %v", tc.expectedError, err)
+			}
+			if err != nil {
+				return
+			}
+			if len(tc.expectedBytecode) > 0 {
+				actual := machine.Memory[:len(tc.expectedBytecode)]
+				if !reflect.DeepEqual(tc.expectedBytecode, actual) {
+					t.Errorf("expected bytecode: %v\nactual: %v", tc.expectedBytecode, actual)
+				}
+			}
+			if tc.expectedOutput != "" {
+				_, err = AssembleWith(tree, Options{Verify: true})
+				if err != nil {
+					t.Fatalf("unexpected verify err: %s", err)
+				}
+				output := &bytes.Buffer{}
+				machine.Output = output
+				err = machine.Execute()
+				if err != nil {
+					t.Fatalf("unexpected err: %s", err)
+				}
+				if output.String() != tc.expectedOutput {
+					t.Errorf("expected output: %q\nactual: %q", tc.expectedOutput, output.String())
+				}
+			}
 		})
 	}
 }
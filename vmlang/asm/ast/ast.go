@@ -11,14 +11,53 @@ type Stmt struct {
 	Var   *VarStmt
 	Op    *OpStmt
 	Label *LabelStmt
+	Data  *DataStmt
+	Const *ConstStmt
+	Array *ArrayStmt
+	Table *TableStmt
+	Local *LocalStmt
+	Macro *MacroStmt
+	// Include is replaced by the statements of the included file.
+	Include *IncludeStmt
+	Export  *ExportStmt
+	Import  *ImportStmt
+	// MacroCall is replaced by the body of the macro before assembly.
+	MacroCall *MacroCallStmt
+	Pos       Pos
+	// Expansion is the macro call that produced the statement, if any.
+	Expansion *Expansion
+}
+
+// Pos is the source position where a statement starts. Line and Column count from 1.
+type Pos struct {
+	File   string
+	Line   int
+	Column int
+}
+
+func (pos Pos) String() string {
+	if pos.File == "" {
+		return fmt.Sprintf("%d:%d", pos.Line, pos.Column)
+	}
+	return fmt.Sprintf("%s:%d:%d", pos.File, pos.Line, pos.Column)
 }
 
 func (stmt Stmt) String() string {
 	isVar := stmt.Var != nil
 	isOp := stmt.Op != nil
 	isLabel := stmt.Label != nil
+	isData := stmt.Data != nil
+	isConst := stmt.Const != nil
+	isArray := stmt.Array != nil
+	isTable := stmt.Table != nil
+	isLocal := stmt.Local != nil
+	isMacro := stmt.Macro != nil
+	isMacroCall := stmt.MacroCall != nil
+	isInclude := stmt.Include != nil
+	isExport := stmt.Export != nil
+	isImport := stmt.Import != nil
 
-	if countTrue(isVar, isOp, isLabel) > 1 {
+	if countTrue(isVar, isOp, isLabel, isData, isConst, isArray, isTable, isLocal, isMacro, isMacroCall, isInclude, isExport, isImport) > 1 {
 		return "[invalid AsmStmt]"
 	}
 
@@ -31,6 +70,36 @@ func (stmt Stmt) String() string {
 	if isLabel {
 		return stmt.Label.String()
 	}
+	if isData {
+		return stmt.Data.String()
+	}
+	if isConst {
+		return stmt.Const.String()
+	}
+	if isArray {
+		return stmt.Array.String()
+	}
+	if isTable {
+		return stmt.Table.String()
+	}
+	if isLocal {
+		return stmt.Local.String()
+	}
+	if isMacro {
+		return stmt.Macro.String()
+	}
+	if isMacroCall {
+		return stmt.MacroCall.String()
+	}
+	if isInclude {
+		return stmt.Include.String()
+	}
+	if isExport {
+		return stmt.Export.String()
+	}
+	if isImport {
+		return stmt.Import.String()
+	}
 	return "[empty AsmStmt]"
 }
 
@@ -44,14 +113,167 @@ func countTrue(bools ...bool) int {
 	return x
 }
 
+// VarStmt reserves a heap word for each name. A statement declaring a single
+// variable may give it an initial value.
 type VarStmt struct {
 	VarNames []string
+	Init     *Expr
 }
 
 func (stmt VarStmt) String() string {
+	if stmt.Init != nil {
+		return fmt.Sprintf("var %s = %s", strings.Join(stmt.VarNames, " "), stmt.Init)
+	}
 	return "var " + strings.Join(stmt.VarNames, " ")
 }
 
+// ConstStmt names a value that is evaluated at assembly time.
+type ConstStmt struct {
+	Name  string
+	Value Expr
+}
+
+func (stmt ConstStmt) String() string {
+	return fmt.Sprintf("const %s = %s", stmt.Name, stmt.Value)
+}
+
+// ArrayStmt reserves Size zeroed words in the heap.
+type ArrayStmt struct {
+	Name string
+	Size Expr
+}
+
+func (stmt ArrayStmt) String() string {
+	return fmt.Sprintf("array %s %s", stmt.Name, stmt.Size)
+}
+
+// TableStmt places one word in the heap for each entry, usually the
+// addresses of labels for an indirect jump or call to pick from.
+type TableStmt struct {
+	Name    string
+	Entries []Expr
+}
+
+func (stmt TableStmt) String() string {
+	builder := strings.Builder{}
+	builder.WriteString("table ")
+	builder.WriteString(stmt.Name)
+	for _, entry := range stmt.Entries {
+		builder.WriteString(" ")
+		builder.WriteString(entry.String())
+	}
+	return builder.String()
+}
+
+// LocalStmt names the locals of a subroutine's stack frame, numbering them
+// from zero in order after any named earlier in the same subroutine. The
+// names stand for their numbers in the operands of lload and lstore, and
+// cannot be used by other ops. They are in scope until the next label that
+// starts a subroutine, one that is called, exported or placed in a table,
+// rather than the first rtn, since a subroutine may return early.
+type LocalStmt struct {
+	Names []string
+}
+
+func (stmt LocalStmt) String() string {
+	return "local " + strings.Join(stmt.Names, " ")
+}
+
+// DataStmt places a string literal in the heap, stored as a length word
+// followed by one byte per word.
+type DataStmt struct {
+	Name string
+	Text string
+}
+
+func (stmt DataStmt) String() string {
+	return fmt.Sprintf("data %s %q", stmt.Name, stmt.Text)
+}
+
+// IncludeStmt names a file, relative to the including file, whose
+// statements take the place of the include.
+type IncludeStmt struct {
+	Path string
+}
+
+func (stmt IncludeStmt) String() string {
+	return fmt.Sprintf("include %q", stmt.Path)
+}
+
+// ExportStmt makes names visible to other units when linking.
+type ExportStmt struct {
+	Names []string
+}
+
+func (stmt ExportStmt) String() string {
+	return "export " + strings.Join(stmt.Names, " ")
+}
+
+// ImportStmt declares names that another unit exports.
+type ImportStmt struct {
+	Names []string
+}
+
+func (stmt ImportStmt) String() string {
+	return "import " + strings.Join(stmt.Names, " ")
+}
+
+// MacroStmt defines a macro. Its body is expanded in place of each call.
+type MacroStmt struct {
+	Name   string
+	Params []string
+	Body   []Stmt
+}
+
+func (stmt MacroStmt) String() string {
+	builder := strings.Builder{}
+	builder.WriteString("macro ")
+	builder.WriteString(stmt.Name)
+	for _, param := range stmt.Params {
+		builder.WriteString(" ")
+		builder.WriteString(param)
+	}
+	for _, bodyStmt := range stmt.Body {
+		builder.WriteString("\n\t")
+		builder.WriteString(bodyStmt.String())
+	}
+	builder.WriteString("\nendm")
+	return builder.String()
+}
+
+type MacroCallStmt struct {
+	Name string
+	Args []Param
+}
+
+func (stmt MacroCallStmt) String() string {
+	builder := strings.Builder{}
+	builder.WriteString(stmt.Name)
+	for _, arg := range stmt.Args {
+		builder.WriteString(" ")
+		builder.WriteString(arg.String())
+	}
+	return builder.String()
+}
+
+// Expansion records a macro call. Outer is the expansion containing the
+// call when macros are nested.
+type Expansion struct {
+	Macro      string
+	Call       Pos
+	Definition Pos
+	Outer      *Expansion
+}
+
+// String describes the chain of calls, innermost first.
+func (exp *Expansion) String() string {
+	lines := []string{}
+	for ; exp != nil; exp = exp.Outer {
+		lines = append(lines, fmt.Sprintf("in expansion of macro %s at %s (defined at %s)", exp.Macro, exp.Call, exp.Definition))
+	}
+	return strings.Join(lines, "\n")
+}
+
 type OpStmt struct {
 	Op     vm.Bytecode
 	Params []Param
@@ -75,18 +297,78 @@ func (stmt LabelStmt) String() string {
 	return stmt.Label + ":"
 }
 
+// Param is an op parameter. Simple parameters are a Literal or a Variable;
+// anything more complex is held in Expr.
 type Param struct {
 	Literal  uint64
 	Variable string
+	Expr     *Expr
+}
+
+// ParamExpr returns the expression held by a Param.
+func ParamExpr(param Param) Expr {
+	if param.Expr != nil {
+		return *param.Expr
+	}
+	if param.Variable != "" {
+		return Expr{Name: param.Variable}
+	}
+	return Expr{Literal: param.Literal}
+}
+
+// ParamFromExpr makes the simplest Param that holds expr.
+func ParamFromExpr(expr Expr) Param {
+	if expr.Op == "" && expr.Name == "" {
+		return Param{Literal: expr.Literal}
+	}
+	if expr.Op == "" {
+		return Param{Variable: expr.Name}
+	}
+	return Param{Expr: &expr}
 }
 
 func (p Param) String() string {
+	if p.Expr != nil {
+		return p.Expr.String()
+	}
 	if p.Variable != "" {
 		return p.Variable
 	}
 	return fmt.Sprint(p.Literal)
 }
 
+// Expr is an expression evaluated at assembly time. A leaf holds either a
+// Literal or a Name; otherwise Op combines Left and Right.
+type Expr struct {
+	Op      string
+	Left    *Expr
+	Right   *Expr
+	Literal uint64
+	Name    string
+}
+
+// BinaryExpr combines left and right with op.
+func BinaryExpr(op string, left, right Expr) Expr {
+	return Expr{Op: op, Left: &left, Right: &right}
+}
+
+func (expr Expr) String() string {
+	if expr.Op == "" {
+		if expr.Name != "" {
+			return expr.Name
+		}
+		return fmt.Sprint(expr.Literal)
+	}
+	return fmt.Sprintf("%s%s%s", expr.Left.operandString(), expr.Op, expr.Right.operandString())
+}
+
+func (expr Expr) operandString() string {
+	if expr.Op == "" {
+		return expr.String()
+	}
+	return "(" + expr.String() + ")"
+}
+
 type AST struct {
 	Stmts []Stmt
 }
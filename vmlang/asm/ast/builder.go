@@ -2,6 +2,7 @@ package ast
 
 import (
 	"errors"
+	"fmt"
 
 	"github.com/johnny-morrice/learn/vmlang/collections"
 	"github.com/johnny-morrice/learn/vmlang/vm"
@@ -12,6 +13,20 @@ type Builder struct {
 	CurrentStmt Stmt
 	Vars        collections.List[string]
 	Params      collections.List[Param]
+	// Exprs is a stack of expressions that are still being parsed.
+	Exprs []Expr
+	// Macro is the macro being defined. Statements are added to MacroBody
+	// until it is closed.
+	Macro     *MacroStmt
+	MacroPos  Pos
+	MacroBody collections.List[Stmt]
+	// StmtPos is attached to the next completed statement.
+	StmtPos Pos
+}
+
+func (bldr Builder) SetStmtPos(pos Pos) Builder {
+	bldr.StmtPos = pos
+	return bldr
 }
 
 func (bldr Builder) AddVarStmt() Builder {
@@ -28,6 +43,211 @@ func (bldr Builder) AddLabelStmt(label string) Builder {
 	return bldr
 }
 
+func (bldr Builder) AddDataStmt(name string) Builder {
+	bldr.CurrentStmt = Stmt{
+		Data: &DataStmt{Name: name},
+	}
+	return bldr
+}
+
+func (bldr Builder) SetDataText(text string) (Builder, error) {
+	var nope Builder
+
+	if bldr.CurrentStmt.Data == nil {
+		return nope, errors.New("expected data statement")
+	}
+
+	data := *bldr.CurrentStmt.Data
+	data.Text = text
+	bldr.CurrentStmt.Data = &data
+	return bldr, nil
+}
+
+func (bldr Builder) AddConstStmt(name string) Builder {
+	bldr.CurrentStmt = Stmt{
+		Const: &ConstStmt{Name: name},
+	}
+	return bldr
+}
+
+func (bldr Builder) AddArrayStmt(name string) Builder {
+	bldr.CurrentStmt = Stmt{
+		Array: &ArrayStmt{Name: name},
+	}
+	return bldr
+}
+
+func (bldr Builder) AddTableStmt(name string) Builder {
+	bldr.CurrentStmt = Stmt{
+		Table: &TableStmt{Name: name},
+	}
+	return bldr
+}
+
+// AddTableEntry pops an expression and adds it to the current table.
+func (bldr Builder) AddTableEntry() (Builder, error) {
+	var nope Builder
+
+	if bldr.CurrentStmt.Table == nil {
+		return nope, errors.New("expected table statement")
+	}
+	bldr, expr, err := bldr.PopExpr()
+	if err != nil {
+		return nope, err
+	}
+
+	table := *bldr.CurrentStmt.Table
+	table.Entries = append(append([]Expr{}, table.Entries...), expr)
+	bldr.CurrentStmt.Table = &table
+	return bldr, nil
+}
+
+// PushExpr pushes an expression onto the expression stack.
+func (bldr Builder) PushExpr(expr Expr) Builder {
+	exprs := make([]Expr, len(bldr.Exprs), len(bldr.Exprs)+1)
+	copy(exprs, bldr.Exprs)
+	bldr.Exprs = append(exprs, expr)
+	return bldr
+}
+
+// PopExpr removes the top of the expression stack.
+func (bldr Builder) PopExpr() (Builder, Expr, error) {
+	var nope Builder
+
+	if len(bldr.Exprs) == 0 {
+		return nope, Expr{}, errors.New("expected expression")
+	}
+
+	expr := bldr.Exprs[len(bldr.Exprs)-1]
+	bldr.Exprs = bldr.Exprs[:len(bldr.Exprs)-1]
+	if len(bldr.Exprs) == 0 {
+		bldr.Exprs = nil
+	}
+	return bldr, expr, nil
+}
+
+// ApplyBinaryOp replaces the top two expressions with op applied to them.
+func (bldr Builder) ApplyBinaryOp(op string) (Builder, error) {
+	var nope Builder
+
+	bldr, right, err := bldr.PopExpr()
+	if err != nil {
+		return nope, err
+	}
+	bldr, left, err := bldr.PopExpr()
+	if err != nil {
+		return nope, err
+	}
+	return bldr.PushExpr(BinaryExpr(op, left, right)), nil
+}
+
+// AddParamExpr pops an expression and adds it as an op parameter.
+func (bldr Builder) AddParamExpr() (Builder, error) {
+	var nope Builder
+
+	bldr, expr, err := bldr.PopExpr()
+	if err != nil {
+		return nope, err
+	}
+	return bldr.AddParam(ParamFromExpr(expr))
+}
+
+// SetStmtExpr pops an expression and uses it as the value of the current
+// const, array or var statement.
+func (bldr Builder) SetStmtExpr() (Builder, error) {
+	var nope Builder
+
+	bldr, expr, err := bldr.PopExpr()
+	if err != nil {
+		return nope, err
+	}
+
+	switch {
+	case bldr.CurrentStmt.Const != nil:
+		stmt := *bldr.CurrentStmt.Const
+		stmt.Value = expr
+		bldr.CurrentStmt.Const = &stmt
+	case bldr.CurrentStmt.Array != nil:
+		stmt := *bldr.CurrentStmt.Array
+		stmt.Size = expr
+		bldr.CurrentStmt.Array = &stmt
+	case bldr.CurrentStmt.Var != nil:
+		stmt := *bldr.CurrentStmt.Var
+		stmt.Init = &expr
+		bldr.CurrentStmt.Var = &stmt
+	default:
+		return nope, errors.New("expected const, array or var statement")
+	}
+	return bldr, nil
+}
+
+func (bldr Builder) AddIncludeStmt(path string) Builder {
+	bldr.CurrentStmt = Stmt{
+		Include: &IncludeStmt{Path: path},
+	}
+	return bldr
+}
+
+func (bldr Builder) AddExportStmt(names []string) Builder {
+	bldr.CurrentStmt = Stmt{
+		Export: &ExportStmt{Names: names},
+	}
+	return bldr
+}
+
+func (bldr Builder) AddImportStmt(names []string) Builder {
+	bldr.CurrentStmt = Stmt{
+		Import: &ImportStmt{Names: names},
+	}
+	return bldr
+}
+
+func (bldr Builder) AddLocalStmt(names []string) Builder {
+	bldr.CurrentStmt = Stmt{
+		Local: &LocalStmt{Names: names},
+	}
+	return bldr
+}
+
+func (bldr Builder) AddMacroCallStmt(name string) Builder {
+	bldr.CurrentStmt = Stmt{
+		MacroCall: &MacroCallStmt{Name: name},
+	}
+	return bldr
+}
+
+// StartMacro begins a macro definition.
+func (bldr Builder) StartMacro(name string, params []string) (Builder, error) {
+	var nope Builder
+
+	if bldr.Macro != nil {
+		return nope, fmt.Errorf("macro %s defined inside macro %s", name, bldr.Macro.Name)
+	}
+
+	bldr.Macro = &MacroStmt{Name: name, Params: params}
+	bldr.MacroPos = bldr.StmtPos
+	bldr.StmtPos = Pos{}
+	return bldr, nil
+}
+
+// EndMacro completes the macro being defined.
+func (bldr Builder) EndMacro() (Builder, error) {
+	var nope Builder
+
+	if bldr.Macro == nil {
+		return nope, errors.New("endm without macro")
+	}
+
+	macro := *bldr.Macro
+	macro.Body = bldr.MacroBody.Slice()
+	bldr.Stmts = bldr.Stmts.Append(Stmt{Macro: &macro, Pos: bldr.MacroPos})
+	bldr.Macro = nil
+	bldr.MacroPos = Pos{}
+	bldr.MacroBody = collections.List[Stmt]{}
+	bldr.StmtPos = Pos{}
+	return bldr, nil
+}
+
 func (bldr Builder) AddOpStmt(op vm.Bytecode) Builder {
 	bldr.CurrentStmt = Stmt{
 		Op: &OpStmt{Op: op},
@@ -49,8 +269,8 @@ func (bldr Builder) AddVar(varName string) (Builder, error) {
 func (bldr Builder) AddParam(param Param) (Builder, error) {
 	var nope Builder
 
-	if bldr.CurrentStmt.Op == nil {
-		return nope, errors.New("expected op statement")
+	if bldr.CurrentStmt.Op == nil && bldr.CurrentStmt.MacroCall == nil {
+		return nope, errors.New("expected op statement or macro call")
 	}
 
 	bldr.Params = bldr.Params.Append(param)
@@ -60,7 +280,9 @@ func (bldr Builder) AddParam(param Param) (Builder, error) {
 
 func (bldr Builder) CompleteStmt() (Builder, error) {
 	var nope Builder
-	if bldr.CurrentStmt.Label == nil && bldr.CurrentStmt.Var == nil && bldr.CurrentStmt.Op == nil {
+	if bldr.CurrentStmt.Label == nil && bldr.CurrentStmt.Var == nil && bldr.CurrentStmt.Op == nil && bldr.CurrentStmt.Data == nil &&
+		bldr.CurrentStmt.Const == nil && bldr.CurrentStmt.Array == nil && bldr.CurrentStmt.Table == nil && bldr.CurrentStmt.Local == nil && bldr.CurrentStmt.MacroCall == nil &&
+		bldr.CurrentStmt.Include == nil && bldr.CurrentStmt.Export == nil && bldr.CurrentStmt.Import == nil {
 		return nope, errors.New("expected initialised statement")
 	}
 	if bldr.CurrentStmt.Var != nil {
@@ -69,10 +291,19 @@ func (bldr Builder) CompleteStmt() (Builder, error) {
 	if bldr.CurrentStmt.Op != nil {
 		bldr.CurrentStmt.Op.Params = bldr.Params.Slice()
 	}
-	bldr.Stmts = bldr.Stmts.Append(bldr.CurrentStmt)
+	if bldr.CurrentStmt.MacroCall != nil {
+		bldr.CurrentStmt.MacroCall.Args = bldr.Params.Slice()
+	}
+	bldr.CurrentStmt.Pos = bldr.StmtPos
+	if bldr.Macro != nil {
+		bldr.MacroBody = bldr.MacroBody.Append(bldr.CurrentStmt)
+	} else {
+		bldr.Stmts = bldr.Stmts.Append(bldr.CurrentStmt)
+	}
 	bldr.CurrentStmt = Stmt{}
 	bldr.Params = collections.List[Param]{}
 	bldr.Vars = collections.List[string]{}
+	bldr.StmtPos = Pos{}
 	return bldr, nil
 }
 
@@ -0,0 +1,80 @@
+package asm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/johnny-morrice/learn/vmlang/vm"
+)
+
+// WriteBytecodeFile writes an assembled machine to a bytecode file that vm.LoadBytecodeFile can run.
+func WriteBytecodeFile(filePath string, machine *vm.VirtualMachine) error {
+	file, err := os.Create(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to create bytecode file: %w", err)
+	}
+	w := bufio.NewWriter(file)
+	err = WriteBytecode(w, machine)
+	if err == nil {
+		err = w.Flush()
+	}
+	closeErr := file.Close()
+	if err != nil {
+		return fmt.Errorf("failed to write bytecode file: %w", err)
+	}
+	return closeErr
+}
+
+func WriteBytecode(w io.Writer, machine *vm.VirtualMachine) error {
+	if machine.CodeEnd == 0 {
+		return errors.New("machine has no code segment")
+	}
+	memSize := uint64(len(machine.Memory))
+	if machine.CodeEnd > memSize || machine.HeapStart > memSize {
+		return errors.New("machine memory is smaller than its layout")
+	}
+
+	heap := machine.Memory[machine.HeapStart:]
+	header := vm.BytecodeHeader{
+		IP:          machine.IP,
+		SP:          machine.SP,
+		StackStart:  machine.StackStart,
+		StackEnd:    machine.StackEnd,
+		HeapStart:   machine.HeapStart,
+		CodeSize:    machine.CodeEnd,
+		HeapSize:    uint64(len(heap)),
+		SymbolCount: uint64(len(machine.Symbols)),
+	}
+
+	_, err := io.WriteString(w, vm.BytecodeMagic)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(w, binary.LittleEndian, vm.BytecodeVersion)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(w, binary.LittleEndian, header)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(w, binary.LittleEndian, machine.Memory[:machine.CodeEnd])
+	if err != nil {
+		return err
+	}
+	err = binary.Write(w, binary.LittleEndian, heap)
+	if err != nil {
+		return err
+	}
+	for _, sym := range machine.Symbols {
+		err = vm.WriteSymbol(w, sym)
+		if err != nil {
+			return err
+		}
+	}
+	return vm.WriteSourceMap(w, machine.SourceMap)
+}
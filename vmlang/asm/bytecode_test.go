@@ -0,0 +1,52 @@
+package asm
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/johnny-morrice/learn/vmlang/example"
+	"github.com/johnny-morrice/learn/vmlang/vm"
+)
+
+func TestBytecodeRoundTrip(t *testing.T) {
+	expected, err := Assemble(example.FactorialAst())
+	if err != nil {
+		t.Fatalf("unexpected assemble err: %s", err)
+	}
+
+	file := &bytes.Buffer{}
+	err = WriteBytecode(file, expected)
+	if err != nil {
+		t.Fatalf("unexpected write err: %s", err)
+	}
+	actual, err := vm.ReadBytecode(file)
+	if err != nil {
+		t.Fatalf("unexpected read err: %s", err)
+	}
+
+	if !reflect.DeepEqual(expected.Memory, actual.Memory) {
+		t.Errorf("memory differs after round trip")
+	}
+	if !reflect.DeepEqual(expected.Symbols, actual.Symbols) {
+		t.Errorf("expected symbols: %v\nactual: %v", expected.Symbols, actual.Symbols)
+	}
+	if !reflect.DeepEqual(expected.SourceMap, actual.SourceMap) {
+		t.Errorf("expected source map: %v\nactual: %v", expected.SourceMap, actual.SourceMap)
+	}
+	expectedRegs := []uint64{expected.IP, expected.SP, expected.StackStart, expected.StackEnd, expected.HeapStart, expected.CodeEnd}
+	actualRegs := []uint64{actual.IP, actual.SP, actual.StackStart, actual.StackEnd, actual.HeapStart, actual.CodeEnd}
+	if !reflect.DeepEqual(expectedRegs, actualRegs) {
+		t.Errorf("expected registers: %v\nactual: %v", expectedRegs, actualRegs)
+	}
+
+	output := &bytes.Buffer{}
+	actual.Output = output
+	err = actual.Execute()
+	if err != nil {
+		t.Fatalf("unexpected vm err: %s", err)
+	}
+	if !reflect.DeepEqual([]byte("24"), output.Bytes()) {
+		t.Errorf("unexpected output: %v", output.Bytes())
+	}
+}
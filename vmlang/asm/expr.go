@@ -0,0 +1,210 @@
+package asm
+
+import (
+	"fmt"
+
+	"github.com/johnny-morrice/learn/vmlang/asm/ast"
+)
+
+func (asm *assembler) defineConst(stmt ast.ConstStmt) error {
+	if asm.isDefined(stmt.Name) {
+		return fmt.Errorf("duplicate variable definition: %s; %w", stmt.Name, ErrAssembler)
+	}
+	asm.constTable[stmt.Name] = stmt.Value
+	return nil
+}
+
+func (asm *assembler) isDefined(name string) bool {
+	_, isName := asm.nameTable[name]
+	_, isConst := asm.constTable[name]
+	return isName || isConst
+}
+
+// value is the result of evaluating an expression. Until an object is
+// linked, addresses are relative to base.
+type value struct {
+	n    uint64
+	base RelocBase
+	// symbol is the imported name that a SymbolBase value is relative to.
+	symbol string
+}
+
+func (val value) isAbsolute() bool {
+	return val.base == AbsoluteBase
+}
+
+func (val value) sameBase(other value) bool {
+	return val.base == other.base && (val.base != SymbolBase || val.symbol == other.symbol)
+}
+
+// evalConst evaluates an expression that must not depend on an address.
+func (asm *assembler) evalConst(expr ast.Expr) (uint64, error) {
+	val, err := asm.eval(expr)
+	if err != nil {
+		return 0, err
+	}
+	if !val.isAbsolute() {
+		return 0, fmt.Errorf("expected a constant but %s depends on an address; %w", expr, ErrAssembler)
+	}
+	return val.n, nil
+}
+
+// eval evaluates an expression. Names of constants are evaluated in turn;
+// other names stand for their address, which is only known once the
+// program has been laid out. An address may be offset by a constant, and
+// the distance between two addresses in the same section is a constant,
+// but any other arithmetic on addresses cannot survive linking.
+func (asm *assembler) eval(expr ast.Expr) (value, error) {
+	if expr.Op == "" {
+		if expr.Name == "" {
+			return value{n: expr.Literal}, nil
+		}
+		return asm.evalName(expr.Name)
+	}
+
+	left, err := asm.eval(*expr.Left)
+	if err != nil {
+		return value{}, err
+	}
+	right, err := asm.eval(*expr.Right)
+	if err != nil {
+		return value{}, err
+	}
+
+	switch {
+	case left.isAbsolute() && right.isAbsolute():
+		n, err := evalOp(expr, left.n, right.n)
+		return value{n: n}, err
+	case expr.Op == "+" && right.isAbsolute():
+		left.n += right.n
+		return left, nil
+	case expr.Op == "+" && left.isAbsolute():
+		right.n += left.n
+		return right, nil
+	case expr.Op == "-" && right.isAbsolute():
+		left.n -= right.n
+		return left, nil
+	case expr.Op == "-" && left.sameBase(right):
+		return value{n: left.n - right.n}, nil
+	default:
+		return value{}, fmt.Errorf("cannot relocate expression: %s; %w", expr, ErrAssembler)
+	}
+}
+
+func evalOp(expr ast.Expr, left, right uint64) (uint64, error) {
+	switch expr.Op {
+	case "|":
+		return left | right, nil
+	case "^":
+		return left ^ right, nil
+	case "&":
+		return left & right, nil
+	case "<<":
+		return left << right, nil
+	case ">>":
+		return left >> right, nil
+	case "+":
+		return left + right, nil
+	case "-":
+		return left - right, nil
+	case "*":
+		return left * right, nil
+	case "/", "%":
+		if right == 0 {
+			return 0, fmt.Errorf("division by zero in expression: %s; %w", expr, ErrAssembler)
+		}
+		if expr.Op == "/" {
+			return left / right, nil
+		}
+		return left % right, nil
+	default:
+		return 0, fmt.Errorf("unknown operator in expression: %s; %w", expr.Op, ErrAssembler)
+	}
+}
+
+func (asm *assembler) evalName(name string) (value, error) {
+	if val, done := asm.constValues[name]; done {
+		return val, nil
+	}
+	if expr, isConst := asm.constTable[name]; isConst {
+		if asm.evaluating[name] {
+			return value{}, fmt.Errorf("constant defined in terms of itself: %s; %w", name, ErrAssembler)
+		}
+		asm.evaluating[name] = true
+		val, err := asm.eval(expr)
+		delete(asm.evaluating, name)
+		if err != nil {
+			return value{}, err
+		}
+		asm.constValues[name] = val
+		return val, nil
+	}
+
+	addr, exists := asm.nameTable[name]
+	if !exists {
+		return value{}, fmt.Errorf("variable not defined: %v; %w", name, ErrAssembler)
+	}
+	if !asm.laidOut {
+		return value{}, fmt.Errorf("address of %s is not known yet, expected a constant; %w", name, ErrAssembler)
+	}
+	return value{n: *addr, base: asm.nameBase(name), symbol: name}, nil
+}
+
+// exprNames adds the names used in expr to names.
+func exprNames(expr ast.Expr, names map[string]bool) {
+	if expr.Op == "" {
+		if expr.Name != "" {
+			names[expr.Name] = true
+		}
+		return
+	}
+	exprNames(*expr.Left, names)
+	exprNames(*expr.Right, names)
+}
+
+// localName returns the first local named in params, if any.
+func localName(params []ast.Param, locals map[string]uint64) (string, bool) {
+	for _, param := range params {
+		name, isLocal := exprLocal(ast.ParamExpr(param), locals)
+		if isLocal {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+func exprLocal(expr ast.Expr, locals map[string]uint64) (string, bool) {
+	if expr.Op == "" {
+		_, isLocal := locals[expr.Name]
+		return expr.Name, isLocal && expr.Name != ""
+	}
+	name, isLocal := exprLocal(*expr.Left, locals)
+	if isLocal {
+		return name, true
+	}
+	return exprLocal(*expr.Right, locals)
+}
+
+// localParams replaces the names of locals in params with their numbers.
+func localParams(params []ast.Param, locals map[string]uint64) []ast.Param {
+	if len(locals) == 0 {
+		return params
+	}
+	replaced := make([]ast.Param, len(params))
+	for i, param := range params {
+		replaced[i] = ast.ParamFromExpr(localExpr(ast.ParamExpr(param), locals))
+	}
+	return replaced
+}
+
+func localExpr(expr ast.Expr, locals map[string]uint64) ast.Expr {
+	if expr.Op == "" {
+		if n, isLocal := locals[expr.Name]; isLocal && expr.Name != "" {
+			return ast.Expr{Literal: n}
+		}
+		return expr
+	}
+	left := localExpr(*expr.Left, locals)
+	right := localExpr(*expr.Right, locals)
+	return ast.BinaryExpr(expr.Op, left, right)
+}
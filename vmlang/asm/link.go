@@ -0,0 +1,166 @@
+package asm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/johnny-morrice/learn/vmlang/vm"
+)
+
+var ErrLink = errors.New("link error")
+
+const stackSize = 2_000_000
+const gapSize = 100
+
+// Link lays out objects one after another and resolves the addresses
+// between them. Execution starts at the beginning of the first object.
+// A name that is not exported but is defined by more than one object, or
+// is exported by another, is qualified with the unit that defines it, as
+// in nl@b.vmsm, so that each symbol of the program has its own name.
+func Link(objs ...*Object) (*vm.VirtualMachine, error) {
+	if len(objs) == 0 {
+		return nil, fmt.Errorf("nothing to link; %w", ErrLink)
+	}
+
+	codeBases := make([]uint64, len(objs))
+	codeSize := uint64(0)
+	for i, obj := range objs {
+		codeBases[i] = codeSize
+		codeSize += uint64(len(obj.Code))
+	}
+
+	stackStart := codeSize + gapSize
+	stackEnd := stackStart + stackSize
+	heapStart := stackStart + stackSize + gapSize
+
+	heapBases := make([]uint64, len(objs))
+	heapSize := uint64(0)
+	for i, obj := range objs {
+		heapBases[i] = heapStart + heapSize
+		heapSize += uint64(len(obj.Heap))
+	}
+
+	machine := &vm.VirtualMachine{
+		Memory: make([]uint64, heapStart+heapSize),
+	}
+
+	shared := sharedNames(objs)
+	exports := map[string]uint64{}
+	for i, obj := range objs {
+		copy(machine.Memory[codeBases[i]:], obj.Code)
+		copy(machine.Memory[heapBases[i]:], obj.Heap)
+
+		for _, sym := range obj.Symbols {
+			addr := sym.Address + codeBases[i]
+			if symbolSection(sym.Kind) == HeapSection {
+				addr = sym.Address + heapBases[i]
+			}
+			name := sym.Name
+			if !sym.Exported && shared[name] {
+				name = fmt.Sprintf("%s@%s", name, unitName(obj, i))
+			}
+			machine.Symbols = append(machine.Symbols, vm.Symbol{
+				Name:    name,
+				Kind:    sym.Kind,
+				Address: addr,
+			})
+			if !sym.Exported {
+				continue
+			}
+			if _, exists := exports[sym.Name]; exists {
+				return nil, fmt.Errorf("%s is exported more than once; %w", sym.Name, ErrLink)
+			}
+			exports[sym.Name] = addr
+		}
+
+		for _, entry := range obj.SourceMap {
+			entry.Address += codeBases[i]
+			machine.SourceMap = append(machine.SourceMap, entry)
+		}
+	}
+
+	for i, obj := range objs {
+		for _, reloc := range obj.Relocs {
+			sectionBase := codeBases[i]
+			sectionSize := uint64(len(obj.Code))
+			if reloc.Section == HeapSection {
+				sectionBase = heapBases[i]
+				sectionSize = uint64(len(obj.Heap))
+			}
+			if reloc.Offset >= sectionSize {
+				return nil, fmt.Errorf("relocation outside %s section; %w", reloc.Section, ErrLink)
+			}
+
+			var base uint64
+			switch reloc.Base {
+			case CodeBase:
+				base = codeBases[i]
+			case HeapBase:
+				base = heapBases[i]
+			case SymbolBase:
+				addr, exists := exports[reloc.Symbol]
+				if !exists {
+					return nil, fmt.Errorf("imported symbol not exported by any object: %s; %w", reloc.Symbol, ErrLink)
+				}
+				base = addr
+			default:
+				return nil, fmt.Errorf("unknown relocation base %d; %w", reloc.Base, ErrLink)
+			}
+			machine.Memory[sectionBase+reloc.Offset] += base
+		}
+	}
+
+	sort.Slice(machine.Symbols, func(i, j int) bool {
+		syms := machine.Symbols
+		if syms[i].Address == syms[j].Address {
+			return syms[i].Name < syms[j].Name
+		}
+		return syms[i].Address < syms[j].Address
+	})
+
+	machine.CodeEnd = codeSize
+	machine.StackEnd = stackEnd
+	machine.SP = stackStart
+	machine.StackStart = stackStart
+	machine.HeapStart = heapStart
+	machine.AllocStart = uint64(len(machine.Memory))
+	machine.Output = os.Stdout
+	machine.Input = os.Stdin
+
+	return machine, nil
+}
+
+// sharedNames finds the names that are not exported by some object but are
+// also defined by another.
+func sharedNames(objs []*Object) map[string]bool {
+	units := map[string]int{}
+	local := map[string]bool{}
+	for _, obj := range objs {
+		for _, sym := range obj.Symbols {
+			units[sym.Name]++
+			if !sym.Exported {
+				local[sym.Name] = true
+			}
+		}
+	}
+	shared := map[string]bool{}
+	for name, count := range units {
+		if count > 1 && local[name] {
+			shared[name] = true
+		}
+	}
+	return shared
+}
+
+// unitName names an object by the file it was assembled from, or by its
+// place in the link when its source is not known.
+func unitName(obj *Object, i int) string {
+	for _, entry := range obj.SourceMap {
+		if entry.Location.File != "" {
+			return entry.Location.File
+		}
+	}
+	return fmt.Sprintf("object%d", i+1)
+}
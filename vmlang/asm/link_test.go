@@ -0,0 +1,285 @@
+package asm
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/johnny-morrice/learn/vmlang/asm/ast"
+	"github.com/johnny-morrice/learn/vmlang/asm/parser"
+	"github.com/johnny-morrice/learn/vmlang/verify"
+)
+
+func assembleSource(t *testing.T, fileName, src string) *Object {
+	t.Helper()
+	tree, err := parser.Parse(parser.ParseContext{FileName: fileName, RemainingInput: src})
+	if err != nil {
+		t.Fatalf("unexpected parse err: %s", err)
+	}
+	obj, err := AssembleObject(tree)
+	if err != nil {
+		t.Fatalf("unexpected assemble err: %s", err)
+	}
+	return obj
+}
+
+const mainSource = `import greet count
+var before = 1
+push count
+rmem
+outd
+call greet
+`
+
+const libSource = `export greet count
+var count = 3
+data msg "hi"
+greet:
+	push msg+1
+	rmem
+	outb
+	push end
+	push msg
+	outs
+	rtn
+end:
+`
+
+func TestLink(t *testing.T) {
+	main := assembleSource(t, "main.vmsm", mainSource)
+	lib := assembleSource(t, "lib.vmsm", libSource)
+
+	machine, err := Link(main, lib)
+	if err != nil {
+		t.Fatalf("unexpected link err: %s", err)
+	}
+	buf := &bytes.Buffer{}
+	machine.Output = buf
+	err = machine.Execute()
+	if err != nil {
+		t.Fatalf("unexpected vm err: %s", err)
+	}
+	if buf.String() != "3hhi" {
+		t.Errorf("expected output %q but received: %q", "3hhi", buf.String())
+	}
+
+	codeSize := uint64(len(main.Code))
+	end, ok := machine.LookupSymbol("end")
+	if !ok || end.Address != codeSize+uint64(len(lib.Code))-1 {
+		t.Errorf("expected end label at the end of the lib code but was: %v", end)
+	}
+	count, ok := machine.LookupSymbol("count")
+	if !ok || count.Address != machine.HeapStart+1 || machine.Memory[count.Address] != 3 {
+		t.Errorf("expected count after main's variable in the heap but was: %v", count)
+	}
+	loc, ok := machine.SourceLocation(codeSize)
+	if !ok || loc.String() != "lib.vmsm:5:2" {
+		t.Errorf("expected lib code to map to lib.vmsm:5:2 but was: %v", loc)
+	}
+}
+
+func TestLinkJumpTable(t *testing.T) {
+	main := assembleSource(t, "main.vmsm", "import ops\npush 3\npush ops+1\nrmem\ncalls\noutd\n")
+	ops := assembleSource(t, "ops.vmsm", "export ops\ntable ops double square\ndouble:\n\tdupl\n\tadd\n\trtn\nsquare:\n\tdupl\n\tmult\n\trtn\n")
+	expectedRelocs := []Reloc{
+		{Section: HeapSection, Offset: 0, Base: CodeBase},
+		{Section: HeapSection, Offset: 1, Base: CodeBase},
+	}
+	if !reflect.DeepEqual(expectedRelocs, sortedRelocs(ops.Relocs)) {
+		t.Errorf("expected relocations: %v\nactual: %v", expectedRelocs, ops.Relocs)
+	}
+
+	machine, err := Link(main, ops)
+	if err != nil {
+		t.Fatalf("unexpected link err: %s", err)
+	}
+	buf := &bytes.Buffer{}
+	machine.Output = buf
+	err = machine.Execute()
+	if err != nil {
+		t.Fatalf("unexpected vm err: %s", err)
+	}
+	if buf.String() != "9" {
+		t.Errorf("expected output %q but received: %q", "9", buf.String())
+	}
+}
+
+func TestLinkVerifies(t *testing.T) {
+	main := assembleSource(t, "main.vmsm", "import f g\ncall f\ncall g\n")
+	a := assembleSource(t, "a.vmsm", "export f\nf:\n\tpush 1\n\toutd\n\tpop\n\trtn\n")
+	b := assembleSource(t, "b.vmsm", "export g\ng:\n\tpush 2\n\toutd\n\tpop\n\trtn\n")
+
+	machine, err := Link(main, a, b)
+	if err != nil {
+		t.Fatalf("unexpected link err: %s", err)
+	}
+	err = verify.Verify(machine)
+	if err != nil {
+		t.Errorf("unexpected verify err: %s", err)
+	}
+	buf := &bytes.Buffer{}
+	machine.Output = buf
+	err = machine.Execute()
+	if err != nil {
+		t.Fatalf("unexpected vm err: %s", err)
+	}
+	if buf.String() != "12" {
+		t.Errorf("expected output %q but received: %q", "12", buf.String())
+	}
+}
+
+func TestLinkLocalNames(t *testing.T) {
+	main := assembleSource(t, "main.vmsm", "import f\ndata nl \"\\n\"\ncall f\n")
+	lib := assembleSource(t, "lib.vmsm", "export f\ndata nl \"\\n\"\nf:\n\trtn\n")
+	other := assembleSource(t, "other.vmsm", "data msg \"hi\"\nf:\n\trtn\n")
+
+	machine, err := Link(main, lib, other)
+	if err != nil {
+		t.Fatalf("unexpected link err: %s", err)
+	}
+	expected := map[string]uint64{
+		"nl@main.vmsm": machine.HeapStart,
+		"nl@lib.vmsm":  machine.HeapStart + 2,
+		"msg":          machine.HeapStart + 4,
+		"f":            uint64(len(main.Code)),
+		"f@other.vmsm": uint64(len(main.Code) + len(lib.Code)),
+	}
+	if len(machine.Symbols) != len(expected) {
+		t.Errorf("expected %d symbols but was: %v", len(expected), machine.Symbols)
+	}
+	for name, addr := range expected {
+		sym, ok := machine.LookupSymbol(name)
+		if !ok || sym.Address != addr {
+			t.Errorf("expected symbol %s at %d but was: %v", name, addr, sym)
+		}
+	}
+	if sym, ok := machine.LookupSymbol("nl"); ok {
+		t.Errorf("expected no symbol named nl but was: %v", sym)
+	}
+}
+
+func sortedRelocs(relocs []Reloc) []Reloc {
+	sorted := append([]Reloc{}, relocs...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Section != sorted[j].Section {
+			return sorted[i].Section < sorted[j].Section
+		}
+		return sorted[i].Offset < sorted[j].Offset
+	})
+	return sorted
+}
+
+func TestAssembleObjectRelocations(t *testing.T) {
+	obj := assembleSource(t, "reloc.vmsm", "import ext\nvar x = top\ntop:\n\tpush x\n\tpush ext+2\n\tpush end-top\nend:\n")
+	expectedCode := []uint64{1, 0, 1, 2, 1, 6, 13}
+	if !reflect.DeepEqual(expectedCode, obj.Code) {
+		t.Errorf("expected code: %v\nactual: %v", expectedCode, obj.Code)
+	}
+	expectedRelocs := []Reloc{
+		{Section: HeapSection, Offset: 0, Base: CodeBase},
+		{Section: CodeSection, Offset: 1, Base: HeapBase},
+		{Section: CodeSection, Offset: 3, Base: SymbolBase, Symbol: "ext"},
+	}
+	if !reflect.DeepEqual(expectedRelocs, obj.Relocs) {
+		t.Errorf("expected relocations: %v\nactual: %v", expectedRelocs, obj.Relocs)
+	}
+}
+
+func TestLinkErrors(t *testing.T) {
+	type testCase struct {
+		sources       []string
+		expectedError error
+	}
+
+	testCases := map[string]testCase{
+		"unresolved import": {
+			sources:       []string{"import missing\ncall missing"},
+			expectedError: ErrLink,
+		},
+		"exported twice": {
+			sources:       []string{"export f\nf:\n", "export f\nf:\n"},
+			expectedError: ErrLink,
+		},
+		"export undefined name": {
+			sources:       []string{"export f\n"},
+			expectedError: ErrAssembler,
+		},
+		"export import": {
+			sources:       []string{"import f\nexport f\n"},
+			expectedError: ErrAssembler,
+		},
+		"address that cannot be relocated": {
+			sources:       []string{"var x\npush x*2\n"},
+			expectedError: ErrAssembler,
+		},
+		"table entry undefined": {
+			sources:       []string{"table jumps missing\n"},
+			expectedError: ErrAssembler,
+		},
+		"duplicate table name": {
+			sources:       []string{"var jumps\ntable jumps start\nstart:\n"},
+			expectedError: ErrAssembler,
+		},
+		"array sized by address": {
+			sources:       []string{"var x\nconst n = x\narray buf n\n"},
+			expectedError: ErrAssembler,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			objs := []*Object{}
+			var err error
+			for _, src := range tc.sources {
+				var tree ast.AST
+				tree, err = parser.Parse(parser.ParseContext{RemainingInput: src})
+				if err != nil {
+					t.Fatalf("unexpected parse err: %s", err)
+				}
+				var obj *Object
+				obj, err = AssembleObject(tree)
+				if err != nil {
+					break
+				}
+				objs = append(objs, obj)
+			}
+			if err == nil {
+				_, err = Link(objs...)
+			}
+			if !errors.Is(err, tc.expectedError) {
+				t.Errorf("expected err: %s\nactual: %v", tc.expectedError, err)
+			}
+		})
+	}
+}
+
+func TestObjectRoundTrip(t *testing.T) {
+	obj := assembleSource(t, "lib.vmsm", libSource)
+	buf := &bytes.Buffer{}
+	err := WriteObject(buf, obj)
+	if err != nil {
+		t.Fatalf("unexpected write err: %s", err)
+	}
+	data := buf.Bytes()
+
+	actual, err := ReadObject(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("unexpected read err: %s", err)
+	}
+	if !reflect.DeepEqual(obj, actual) {
+		t.Errorf("expected:\n%+v\n\nactual:\n%+v", obj, actual)
+	}
+
+	_, err = ReadObject(bytes.NewReader(data[:len(data)-3]))
+	if !errors.Is(err, ErrInvalidObject) {
+		t.Errorf("expected ErrInvalidObject for truncated object but received: %v", err)
+	} else if err.Error() != "truncated source map; invalid object file" {
+		t.Errorf("unexpected message for truncated object: %s", err)
+	}
+	_, err = ReadObject(bytes.NewReader([]byte("VMBC")))
+	if !errors.Is(err, ErrInvalidObject) {
+		t.Errorf("expected ErrInvalidObject for bad magic but received: %v", err)
+	}
+}
@@ -0,0 +1,203 @@
+package macro
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/johnny-morrice/learn/vmlang/asm/ast"
+	"github.com/johnny-morrice/learn/vmlang/vm"
+)
+
+// MaxDepth limits how deeply macro calls may nest, which also stops
+// recursive macros.
+const MaxDepth = 16
+
+var ErrMacro = errors.New("macro error")
+
+type expander struct {
+	macros map[string]ast.Stmt
+	// expansions counts calls so that each expansion gets its own labels.
+	expansions int
+}
+
+// Expand replaces every macro call with the body of its macro and removes
+// the macro definitions, leaving statements that Assemble understands.
+func Expand(tree ast.AST) (ast.AST, error) {
+	exp := expander{
+		macros: map[string]ast.Stmt{},
+	}
+
+	for _, stmt := range tree.Stmts {
+		if stmt.Macro != nil {
+			err := exp.define(stmt)
+			if err != nil {
+				return ast.AST{}, err
+			}
+		}
+	}
+
+	stmts := []ast.Stmt{}
+	for _, stmt := range tree.Stmts {
+		if stmt.Macro != nil {
+			continue
+		}
+		expanded, err := exp.expand(stmt, nil, 0)
+		if err != nil {
+			return ast.AST{}, err
+		}
+		stmts = append(stmts, expanded...)
+	}
+
+	return ast.AST{Stmts: stmts}, nil
+}
+
+func (exp *expander) define(stmt ast.Stmt) error {
+	name := stmt.Macro.Name
+	if other, exists := exp.macros[name]; exists {
+		return fmt.Errorf("%s: duplicate macro %s, first defined at %s; %w", stmt.Pos, name, other.Pos, ErrMacro)
+	}
+	for _, op := range vm.Bytecodes() {
+		if op.String() == name {
+			return fmt.Errorf("%s: macro %s has the name of an op; %w", stmt.Pos, name, ErrMacro)
+		}
+	}
+	params := map[string]struct{}{}
+	for _, param := range stmt.Macro.Params {
+		if _, exists := params[param]; exists {
+			return fmt.Errorf("%s: duplicate parameter %s in macro %s; %w", stmt.Pos, param, name, ErrMacro)
+		}
+		params[param] = struct{}{}
+	}
+	exp.macros[name] = stmt
+	return nil
+}
+
+// expand returns the statements that stmt stands for. outer is the
+// expansion stmt came from.
+func (exp *expander) expand(stmt ast.Stmt, outer *ast.Expansion, depth int) ([]ast.Stmt, error) {
+	if stmt.MacroCall == nil {
+		return []ast.Stmt{stmt}, nil
+	}
+
+	call := *stmt.MacroCall
+	def, exists := exp.macros[call.Name]
+	if !exists {
+		return nil, exp.errorf(stmt, outer, "unknown op or macro: %s", call.Name)
+	}
+	macro := *def.Macro
+	if len(call.Args) != len(macro.Params) {
+		return nil, exp.errorf(stmt, outer, "macro %s defined at %s expects %d arguments but was given %d",
+			call.Name, def.Pos, len(macro.Params), len(call.Args))
+	}
+	if depth >= MaxDepth {
+		return nil, exp.errorf(stmt, outer, "macro %s expanded more than %d levels deep", call.Name, MaxDepth)
+	}
+
+	expansion := &ast.Expansion{
+		Macro:      call.Name,
+		Call:       stmt.Pos,
+		Definition: def.Pos,
+		Outer:      outer,
+	}
+	exp.expansions++
+
+	names := map[string]ast.Expr{}
+	for i, param := range macro.Params {
+		names[param] = ast.ParamExpr(call.Args[i])
+	}
+	// Labels defined in the body are renamed with characters that cannot
+	// appear in a name written by hand, so expansions never collide.
+	for _, bodyStmt := range macro.Body {
+		if bodyStmt.Label != nil {
+			label := bodyStmt.Label.Label
+			names[label] = ast.Expr{Name: fmt.Sprintf("%s@%s.%d", label, call.Name, exp.expansions)}
+		}
+	}
+
+	stmts := []ast.Stmt{}
+	for _, bodyStmt := range macro.Body {
+		bodyStmt = substitute(bodyStmt, names)
+		bodyStmt.Expansion = expansion
+		expanded, err := exp.expand(bodyStmt, expansion, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, expanded...)
+	}
+	return stmts, nil
+}
+
+func (exp *expander) errorf(stmt ast.Stmt, outer *ast.Expansion, format string, args ...any) error {
+	msg := fmt.Sprintf(format, args...)
+	if outer != nil {
+		return fmt.Errorf("%s: %s\n%s; %w", stmt.Pos, msg, outer, ErrMacro)
+	}
+	return fmt.Errorf("%s: %s; %w", stmt.Pos, msg, ErrMacro)
+}
+
+// substitute returns a copy of stmt with names replaced.
+func substitute(stmt ast.Stmt, names map[string]ast.Expr) ast.Stmt {
+	if stmt.Label != nil {
+		label := *stmt.Label
+		if replacement, ok := names[label.Label]; ok && replacement.Op == "" && replacement.Name != "" {
+			label.Label = replacement.Name
+		}
+		stmt.Label = &label
+	}
+	if stmt.Op != nil {
+		op := *stmt.Op
+		op.Params = substituteParams(op.Params, names)
+		stmt.Op = &op
+	}
+	if stmt.MacroCall != nil {
+		call := *stmt.MacroCall
+		call.Args = substituteParams(call.Args, names)
+		stmt.MacroCall = &call
+	}
+	if stmt.Var != nil && stmt.Var.Init != nil {
+		v := *stmt.Var
+		init := substituteExpr(*v.Init, names)
+		v.Init = &init
+		stmt.Var = &v
+	}
+	if stmt.Const != nil {
+		c := *stmt.Const
+		c.Value = substituteExpr(c.Value, names)
+		stmt.Const = &c
+	}
+	if stmt.Array != nil {
+		array := *stmt.Array
+		array.Size = substituteExpr(array.Size, names)
+		stmt.Array = &array
+	}
+	if stmt.Table != nil {
+		table := *stmt.Table
+		table.Entries = make([]ast.Expr, len(stmt.Table.Entries))
+		for i, entry := range stmt.Table.Entries {
+			table.Entries[i] = substituteExpr(entry, names)
+		}
+		stmt.Table = &table
+	}
+	return stmt
+}
+
+func substituteParams(params []ast.Param, names map[string]ast.Expr) []ast.Param {
+	if params == nil {
+		return nil
+	}
+	substituted := make([]ast.Param, len(params))
+	for i, param := range params {
+		substituted[i] = ast.ParamFromExpr(substituteExpr(ast.ParamExpr(param), names))
+	}
+	return substituted
+}
+
+func substituteExpr(expr ast.Expr, names map[string]ast.Expr) ast.Expr {
+	if expr.Op == "" {
+		if replacement, ok := names[expr.Name]; ok && expr.Name != "" {
+			return replacement
+		}
+		return expr
+	}
+	return ast.BinaryExpr(expr.Op, substituteExpr(*expr.Left, names), substituteExpr(*expr.Right, names))
+}
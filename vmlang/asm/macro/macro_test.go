@@ -0,0 +1,235 @@
+package macro
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/johnny-morrice/learn/vmlang/asm"
+	"github.com/johnny-morrice/learn/vmlang/asm/ast"
+	"github.com/johnny-morrice/learn/vmlang/asm/parser"
+	"github.com/johnny-morrice/learn/vmlang/example"
+	"github.com/johnny-morrice/learn/vmlang/vm"
+)
+
+func TestExpandFactorial(t *testing.T) {
+	tree, err := parser.Parse(parser.ParseContext{
+		FileName:       "fac_macro.vmsm",
+		RemainingInput: example.FactorialMacroSourceCode,
+	})
+	if err != nil {
+		t.Fatalf("unexpected parse err: %s", err)
+	}
+	tree, err = Expand(tree)
+	if err != nil {
+		t.Fatalf("unexpected expand err: %s", err)
+	}
+	machine, err := asm.Assemble(tree)
+	if err != nil {
+		t.Fatalf("unexpected assemble err: %s", err)
+	}
+	expected, err := asm.Assemble(example.FactorialAst())
+	if err != nil {
+		t.Fatalf("unexpected assemble err: %s", err)
+	}
+	if !reflect.DeepEqual(expected.Memory[:expected.CodeEnd], machine.Memory[:machine.CodeEnd]) {
+		t.Errorf("expected bytecode: %v\nactual: %v", expected.Memory[:expected.CodeEnd], machine.Memory[:machine.CodeEnd])
+	}
+
+	buf := &bytes.Buffer{}
+	machine.Output = buf
+	err = machine.Execute()
+	if err != nil {
+		t.Fatalf("unexpected vm err: %s", err)
+	}
+	if buf.String() != "24" {
+		t.Errorf("expected output 24 but received: %q", buf.String())
+	}
+}
+
+func TestExpand(t *testing.T) {
+	type testCase struct {
+		source   string
+		expected []ast.Stmt
+	}
+
+	twice := &ast.Expansion{Macro: "twice", Call: ast.Pos{Line: 5, Column: 1}, Definition: ast.Pos{Line: 1, Column: 1}}
+	testCases := map[string]testCase{
+		"substitutes expressions": {
+			source: "macro twice x\n\tpush x*2\nendm\n\ntwice n+1",
+			expected: []ast.Stmt{
+				{
+					Op: &ast.OpStmt{
+						Op: vm.Push,
+						Params: []ast.Param{ast.ParamFromExpr(ast.BinaryExpr("*",
+							ast.BinaryExpr("+", ast.Expr{Name: "n"}, ast.Expr{Literal: 1}),
+							ast.Expr{Literal: 2}))},
+					},
+					Pos:       ast.Pos{Line: 2, Column: 2},
+					Expansion: twice,
+				},
+			},
+		},
+		"renames local labels": {
+			source: "macro spin\nloop:\n\tgoto loop\nendm\nspin\nspin",
+			expected: []ast.Stmt{
+				{
+					Label:     &ast.LabelStmt{Label: "loop@spin.1"},
+					Pos:       ast.Pos{Line: 2, Column: 1},
+					Expansion: &ast.Expansion{Macro: "spin", Call: ast.Pos{Line: 5, Column: 1}, Definition: ast.Pos{Line: 1, Column: 1}},
+				},
+				{
+					Op:        &ast.OpStmt{Op: vm.Goto, Params: []ast.Param{{Variable: "loop@spin.1"}}},
+					Pos:       ast.Pos{Line: 3, Column: 2},
+					Expansion: &ast.Expansion{Macro: "spin", Call: ast.Pos{Line: 5, Column: 1}, Definition: ast.Pos{Line: 1, Column: 1}},
+				},
+				{
+					Label:     &ast.LabelStmt{Label: "loop@spin.2"},
+					Pos:       ast.Pos{Line: 2, Column: 1},
+					Expansion: &ast.Expansion{Macro: "spin", Call: ast.Pos{Line: 6, Column: 1}, Definition: ast.Pos{Line: 1, Column: 1}},
+				},
+				{
+					Op:        &ast.OpStmt{Op: vm.Goto, Params: []ast.Param{{Variable: "loop@spin.2"}}},
+					Pos:       ast.Pos{Line: 3, Column: 2},
+					Expansion: &ast.Expansion{Macro: "spin", Call: ast.Pos{Line: 6, Column: 1}, Definition: ast.Pos{Line: 1, Column: 1}},
+				},
+			},
+		},
+		"renames labels in tables": {
+			source: "macro dispatch\n\ttable jumps a\na:\nendm\ndispatch",
+			expected: []ast.Stmt{
+				{
+					Table:     &ast.TableStmt{Name: "jumps", Entries: []ast.Expr{{Name: "a@dispatch.1"}}},
+					Pos:       ast.Pos{Line: 2, Column: 2},
+					Expansion: &ast.Expansion{Macro: "dispatch", Call: ast.Pos{Line: 5, Column: 1}, Definition: ast.Pos{Line: 1, Column: 1}},
+				},
+				{
+					Label:     &ast.LabelStmt{Label: "a@dispatch.1"},
+					Pos:       ast.Pos{Line: 3, Column: 1},
+					Expansion: &ast.Expansion{Macro: "dispatch", Call: ast.Pos{Line: 5, Column: 1}, Definition: ast.Pos{Line: 1, Column: 1}},
+				},
+			},
+		},
+		"nested calls": {
+			source: "macro inner a\n\tpush a\nendm\nmacro outer b\n\tinner b\nendm\nouter 7",
+			expected: []ast.Stmt{
+				{
+					Op:  &ast.OpStmt{Op: vm.Push, Params: []ast.Param{{Literal: 7}}},
+					Pos: ast.Pos{Line: 2, Column: 2},
+					Expansion: &ast.Expansion{
+						Macro:      "inner",
+						Call:       ast.Pos{Line: 5, Column: 2},
+						Definition: ast.Pos{Line: 1, Column: 1},
+						Outer: &ast.Expansion{
+							Macro:      "outer",
+							Call:       ast.Pos{Line: 7, Column: 1},
+							Definition: ast.Pos{Line: 4, Column: 1},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			tree, err := parser.Parse(parser.ParseContext{RemainingInput: tc.source})
+			if err != nil {
+				t.Fatalf("unexpected parse err: %s", err)
+			}
+			actual, err := Expand(tree)
+			if err != nil {
+				t.Fatalf("unexpected expand err: %s", err)
+			}
+			if !reflect.DeepEqual(tc.expected, actual.Stmts) {
+				t.Errorf("expected:\n%v\n\nactual:\n%v", tc.expected, actual.Stmts)
+				for i := 0; i < len(tc.expected) && i < len(actual.Stmts); i++ {
+					if !reflect.DeepEqual(tc.expected[i], actual.Stmts[i]) {
+						t.Errorf("first difference at %v\nexpected: %#v\nactual: %#v", i, tc.expected[i], actual.Stmts[i])
+						return
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestExpandErrors(t *testing.T) {
+	type testCase struct {
+		source   string
+		expected []string
+	}
+
+	testCases := map[string]testCase{
+		"unknown macro": {
+			source:   "push 1\nfoo 2",
+			expected: []string{"test.vmsm:2:1: unknown op or macro: foo"},
+		},
+		"wrong argument count": {
+			source:   "macro load x\n\tpush x\n\trmem\nendm\nload 1 2",
+			expected: []string{"test.vmsm:5:1: macro load defined at test.vmsm:1:1 expects 1 arguments but was given 2"},
+		},
+		"error inside expansion": {
+			source: "macro outer\n\tfoo\nendm\nouter",
+			expected: []string{
+				"test.vmsm:2:2: unknown op or macro: foo",
+				"in expansion of macro outer at test.vmsm:4:1 (defined at test.vmsm:1:1)",
+			},
+		},
+		"recursive macro": {
+			source:   "macro forever\n\tforever\nendm\nforever",
+			expected: []string{"expanded more than 16 levels deep"},
+		},
+		"duplicate macro": {
+			source:   "macro a\nendm\nmacro a\nendm",
+			expected: []string{"test.vmsm:3:1: duplicate macro a, first defined at test.vmsm:1:1"},
+		},
+		"macro named like an op": {
+			source:   "macro push\nendm",
+			expected: []string{"macro push has the name of an op"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			tree, err := parser.Parse(parser.ParseContext{FileName: "test.vmsm", RemainingInput: tc.source})
+			if err != nil {
+				t.Fatalf("unexpected parse err: %s", err)
+			}
+			_, err = Expand(tree)
+			if !errors.Is(err, ErrMacro) {
+				t.Fatalf("expected ErrMacro but received: %v", err)
+			}
+			for _, expected := range tc.expected {
+				if !strings.Contains(err.Error(), expected) {
+					t.Errorf("expected error to contain %q but was: %s", expected, err)
+				}
+			}
+		})
+	}
+}
+
+func TestAssembleErrorInExpansion(t *testing.T) {
+	tree, err := parser.Parse(parser.ParseContext{
+		FileName:       "test.vmsm",
+		RemainingInput: "macro load x\n\tpush x\n\trmem\nendm\nload missing",
+	})
+	if err != nil {
+		t.Fatalf("unexpected parse err: %s", err)
+	}
+	tree, err = Expand(tree)
+	if err != nil {
+		t.Fatalf("unexpected expand err: %s", err)
+	}
+	_, err = asm.Assemble(tree)
+	if !errors.Is(err, asm.ErrAssembler) {
+		t.Fatalf("expected ErrAssembler but received: %v", err)
+	}
+	expected := "test.vmsm:2:2: variable not defined: missing; assembly error\n" +
+		"in expansion of macro load at test.vmsm:5:1 (defined at test.vmsm:1:1)"
+	if err.Error() != expected {
+		t.Errorf("expected:\n%s\n\nactual:\n%s", expected, err)
+	}
+}
@@ -0,0 +1,96 @@
+package asm
+
+import (
+	"github.com/johnny-morrice/learn/vmlang/vm"
+)
+
+// Section is a part of an object's image.
+type Section uint8
+
+const (
+	CodeSection Section = iota
+	HeapSection
+)
+
+func (section Section) String() string {
+	switch section {
+	case CodeSection:
+		return "code"
+	case HeapSection:
+		return "heap"
+	default:
+		return "unknown"
+	}
+}
+
+// RelocBase is what a relocated word is relative to.
+type RelocBase uint8
+
+const (
+	AbsoluteBase RelocBase = iota
+	CodeBase
+	HeapBase
+	// SymbolBase words are relative to the address of a symbol exported by
+	// another object.
+	SymbolBase
+)
+
+// Reloc is a word in an object that the linker adjusts by adding the
+// start of its base section, or the address of Symbol.
+type Reloc struct {
+	Section Section
+	Offset  uint64
+	Base    RelocBase
+	Symbol  string
+}
+
+// ObjectSymbol is a name defined by an object. Its address is relative to
+// the start of the section holding it.
+type ObjectSymbol struct {
+	Name     string
+	Kind     vm.SymbolKind
+	Address  uint64
+	Exported bool
+}
+
+// Object is a relocatable unit of a program, combined with others by Link.
+// Code ends with an exit, so control never falls from one object into the
+// next.
+type Object struct {
+	Code      []uint64
+	Heap      []uint64
+	Relocs    []Reloc
+	Symbols   []ObjectSymbol
+	SourceMap vm.SourceMap
+}
+
+func (obj *Object) section(section Section) []uint64 {
+	if section == CodeSection {
+		return obj.Code
+	}
+	return obj.Heap
+}
+
+// setWord stores a value, recording a relocation if it is an address.
+func (obj *Object) setWord(section Section, offset uint64, val value) {
+	obj.section(section)[offset] = val.n
+	if val.isAbsolute() {
+		return
+	}
+	reloc := Reloc{
+		Section: section,
+		Offset:  offset,
+		Base:    val.base,
+	}
+	if val.base == SymbolBase {
+		reloc.Symbol = val.symbol
+	}
+	obj.Relocs = append(obj.Relocs, reloc)
+}
+
+func symbolSection(kind vm.SymbolKind) Section {
+	if kind == vm.LabelSymbol {
+		return CodeSection
+	}
+	return HeapSection
+}
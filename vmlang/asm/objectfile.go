@@ -0,0 +1,236 @@
+package asm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/johnny-morrice/learn/vmlang/vm"
+)
+
+// ObjectMagic opens every object file.
+const ObjectMagic = "VMOB"
+
+// ObjectVersion is the version of the object file format.
+const ObjectVersion = uint32(1)
+
+// maxObjectSize caps the number of words an object file may ask for.
+const maxObjectSize = 1 << 30
+
+var ErrInvalidObject = errors.New("invalid object file")
+
+// objectHeader follows the magic and version at the start of an object file.
+// It is followed by the code, the heap, the relocations, the symbols and the
+// source map.
+type objectHeader struct {
+	CodeSize    uint64
+	HeapSize    uint64
+	RelocCount  uint64
+	SymbolCount uint64
+}
+
+type relocEntry struct {
+	Section   Section
+	Base      RelocBase
+	Offset    uint64
+	SymbolLen uint32
+}
+
+// WriteObjectFile writes an object to a file that ReadObjectFile can read.
+func WriteObjectFile(filePath string, obj *Object) error {
+	file, err := os.Create(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to create object file: %w", err)
+	}
+	w := bufio.NewWriter(file)
+	err = WriteObject(w, obj)
+	if err == nil {
+		err = w.Flush()
+	}
+	closeErr := file.Close()
+	if err != nil {
+		return fmt.Errorf("failed to write object file: %w", err)
+	}
+	return closeErr
+}
+
+func WriteObject(w io.Writer, obj *Object) error {
+	header := objectHeader{
+		CodeSize:    uint64(len(obj.Code)),
+		HeapSize:    uint64(len(obj.Heap)),
+		RelocCount:  uint64(len(obj.Relocs)),
+		SymbolCount: uint64(len(obj.Symbols)),
+	}
+
+	_, err := io.WriteString(w, ObjectMagic)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(w, binary.LittleEndian, ObjectVersion)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(w, binary.LittleEndian, header)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(w, binary.LittleEndian, obj.Code)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(w, binary.LittleEndian, obj.Heap)
+	if err != nil {
+		return err
+	}
+	for _, reloc := range obj.Relocs {
+		err = binary.Write(w, binary.LittleEndian, relocEntry{
+			Section:   reloc.Section,
+			Base:      reloc.Base,
+			Offset:    reloc.Offset,
+			SymbolLen: uint32(len(reloc.Symbol)),
+		})
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(w, reloc.Symbol)
+		if err != nil {
+			return err
+		}
+	}
+	for _, sym := range obj.Symbols {
+		exported := uint8(0)
+		if sym.Exported {
+			exported = 1
+		}
+		err = binary.Write(w, binary.LittleEndian, exported)
+		if err != nil {
+			return err
+		}
+		err = vm.WriteSymbol(w, vm.Symbol{Name: sym.Name, Kind: sym.Kind, Address: sym.Address})
+		if err != nil {
+			return err
+		}
+	}
+	return vm.WriteSourceMap(w, obj.SourceMap)
+}
+
+func ReadObjectFile(filePath string) (*Object, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open object file: %w", err)
+	}
+	defer file.Close()
+	return ReadObject(bufio.NewReader(file))
+}
+
+func ReadObject(r io.Reader) (*Object, error) {
+	magic := make([]byte, len(ObjectMagic))
+	_, err := io.ReadFull(r, magic)
+	if err != nil {
+		return nil, objectReadError("magic", err)
+	}
+	if string(magic) != ObjectMagic {
+		return nil, fmt.Errorf("bad magic %q; %w", magic, ErrInvalidObject)
+	}
+
+	var version uint32
+	err = binary.Read(r, binary.LittleEndian, &version)
+	if err != nil {
+		return nil, objectReadError("version", err)
+	}
+	if version != ObjectVersion {
+		return nil, fmt.Errorf("unsupported version %d; %w", version, ErrInvalidObject)
+	}
+
+	header := objectHeader{}
+	err = binary.Read(r, binary.LittleEndian, &header)
+	if err != nil {
+		return nil, objectReadError("header", err)
+	}
+	if header.CodeSize > maxObjectSize || header.HeapSize > maxObjectSize {
+		return nil, fmt.Errorf("object too large; %w", ErrInvalidObject)
+	}
+
+	obj := &Object{
+		Code: make([]uint64, header.CodeSize),
+		Heap: make([]uint64, header.HeapSize),
+	}
+	err = binary.Read(r, binary.LittleEndian, obj.Code)
+	if err != nil {
+		return nil, objectReadError("code", err)
+	}
+	err = binary.Read(r, binary.LittleEndian, obj.Heap)
+	if err != nil {
+		return nil, objectReadError("heap", err)
+	}
+
+	for i := uint64(0); i < header.RelocCount; i++ {
+		entry := relocEntry{}
+		err = binary.Read(r, binary.LittleEndian, &entry)
+		if err != nil {
+			return nil, objectReadError("relocation", err)
+		}
+		if entry.SymbolLen > maxSymbolName {
+			return nil, fmt.Errorf("relocation symbol too long; %w", ErrInvalidObject)
+		}
+		symbol := make([]byte, entry.SymbolLen)
+		_, err = io.ReadFull(r, symbol)
+		if err != nil {
+			return nil, objectReadError("relocation symbol", err)
+		}
+		obj.Relocs = append(obj.Relocs, Reloc{
+			Section: entry.Section,
+			Base:    entry.Base,
+			Offset:  entry.Offset,
+			Symbol:  string(symbol),
+		})
+	}
+
+	for i := uint64(0); i < header.SymbolCount; i++ {
+		var exported uint8
+		err = binary.Read(r, binary.LittleEndian, &exported)
+		if err != nil {
+			return nil, objectReadError("symbol", err)
+		}
+		sym, err := vm.ReadSymbol(r)
+		if err != nil {
+			return nil, sharedSectionError(err)
+		}
+		obj.Symbols = append(obj.Symbols, ObjectSymbol{
+			Name:     sym.Name,
+			Kind:     sym.Kind,
+			Address:  sym.Address,
+			Exported: exported != 0,
+		})
+	}
+
+	obj.SourceMap, err = vm.ReadSourceMap(r)
+	if err != nil {
+		return nil, sharedSectionError(err)
+	}
+	return obj, nil
+}
+
+// maxSymbolName matches the limit on names in bytecode files.
+const maxSymbolName = 1 << 16
+
+// sharedSectionError converts errors from sections shared with the
+// bytecode format.
+func sharedSectionError(err error) error {
+	if errors.Is(err, vm.ErrInvalidBytecode) {
+		msg := strings.TrimSuffix(err.Error(), "; "+vm.ErrInvalidBytecode.Error())
+		return fmt.Errorf("%s; %w", msg, ErrInvalidObject)
+	}
+	return err
+}
+
+func objectReadError(section string, err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("truncated %s; %w", section, ErrInvalidObject)
+	}
+	return fmt.Errorf("failed to read %s: %w", section, err)
+}
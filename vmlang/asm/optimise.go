@@ -0,0 +1,225 @@
+package asm
+
+import (
+	"github.com/johnny-morrice/learn/vmlang/vm"
+)
+
+// optimise applies peephole rules to the ops until none of them changes
+// anything. Labels are kept, and no rule looks across one, since a jump
+// may arrive between the ops on either side.
+func (asm *assembler) optimise() {
+	rules := []func() bool{
+		asm.foldConstants,
+		asm.removePushPop,
+		asm.removeIncrDecr,
+		asm.threadJumps,
+		asm.removeUnreachable,
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, rule := range rules {
+			if rule() {
+				changed = true
+			}
+		}
+	}
+}
+
+// foldConstants replaces "push a; push b; op" with a push of the result
+// when a and b are constants. Division by zero is left for the machine to
+// report.
+func (asm *assembler) foldConstants() bool {
+	changed := false
+	stmts := []intrOp{}
+	for i := 0; i < len(asm.stmts); i++ {
+		if i+2 < len(asm.stmts) {
+			a, aConst := asm.constPush(asm.stmts[i])
+			b, bConst := asm.constPush(asm.stmts[i+1])
+			op := asm.stmts[i+2]
+			if aConst && bConst && op.label == "" {
+				x, err := vm.BinaryResult(op.op, a, b)
+				if err == nil {
+					push := asm.stmts[i]
+					push.parameters = []intrParam{{value: &x}}
+					stmts = append(stmts, push)
+					i += 2
+					changed = true
+					continue
+				}
+			}
+		}
+		stmts = append(stmts, asm.stmts[i])
+	}
+	asm.stmts = stmts
+	return changed
+}
+
+// removePushPop removes a push that is immediately popped.
+func (asm *assembler) removePushPop() bool {
+	return asm.removePairs(func(first, second intrOp) bool {
+		return asm.removablePush(first) && second.label == "" && second.op == vm.Pop
+	})
+}
+
+// removeIncrDecr removes an incr followed by a decr, or a decr followed by
+// an incr.
+func (asm *assembler) removeIncrDecr() bool {
+	return asm.removePairs(func(first, second intrOp) bool {
+		if first.label != "" || second.label != "" {
+			return false
+		}
+		return (first.op == vm.Increment && second.op == vm.Decrement) ||
+			(first.op == vm.Decrement && second.op == vm.Increment)
+	})
+}
+
+func (asm *assembler) removePairs(matches func(first, second intrOp) bool) bool {
+	changed := false
+	stmts := []intrOp{}
+	for i := 0; i < len(asm.stmts); i++ {
+		if i+1 < len(asm.stmts) && matches(asm.stmts[i], asm.stmts[i+1]) {
+			i++
+			changed = true
+			continue
+		}
+		stmts = append(stmts, asm.stmts[i])
+	}
+	asm.stmts = stmts
+	return changed
+}
+
+// threadJumps points a jump to a goto at the goto's own target, and removes
+// a goto to the op that follows it anyway.
+func (asm *assembler) threadJumps() bool {
+	labels := map[string]int{}
+	for i, stmt := range asm.stmts {
+		if stmt.label != "" {
+			labels[stmt.label] = i
+		}
+	}
+	// target returns the first op at or after the label.
+	target := func(label string) (intrOp, bool) {
+		for i := labels[label]; i < len(asm.stmts); i++ {
+			if asm.stmts[i].label == "" {
+				return asm.stmts[i], true
+			}
+		}
+		return intrOp{}, false
+	}
+
+	changed := false
+	stmts := []intrOp{}
+	for i, stmt := range asm.stmts {
+		label, ok := jumpLabel(stmt)
+		if !ok {
+			stmts = append(stmts, stmt)
+			continue
+		}
+		if stmt.op == vm.Goto && asm.labelFollows(i, label) {
+			changed = true
+			continue
+		}
+		seen := map[string]bool{label: true}
+		for {
+			next, ok := target(label)
+			if !ok || next.op != vm.Goto {
+				break
+			}
+			nextLabel, ok := jumpLabel(next)
+			if !ok || seen[nextLabel] {
+				break
+			}
+			label = nextLabel
+			seen[label] = true
+		}
+		if label != stmt.parameters[0].labelName {
+			stmt.parameters = []intrParam{{labelName: label, value: asm.nameTable[label]}}
+			changed = true
+		}
+		stmts = append(stmts, stmt)
+	}
+	asm.stmts = stmts
+	return changed
+}
+
+// labelFollows reports whether label is among the labels directly after
+// the op at i.
+func (asm *assembler) labelFollows(i int, label string) bool {
+	for _, stmt := range asm.stmts[i+1:] {
+		if stmt.label == "" {
+			return false
+		}
+		if stmt.label == label {
+			return true
+		}
+	}
+	return false
+}
+
+// removeUnreachable removes the ops between a goto, gotos, rtn or exit and
+// the next label, since nothing can jump to them.
+func (asm *assembler) removeUnreachable() bool {
+	changed := false
+	stmts := []intrOp{}
+	unreachable := false
+	for _, stmt := range asm.stmts {
+		if stmt.label != "" {
+			unreachable = false
+		} else if unreachable {
+			changed = true
+			continue
+		}
+		stmts = append(stmts, stmt)
+		if stmt.label == "" && (stmt.op == vm.Goto || stmt.op == vm.GotoIndirect || stmt.op == vm.Return || stmt.op == vm.Exit) {
+			unreachable = true
+		}
+	}
+	asm.stmts = stmts
+	return changed
+}
+
+// constPush returns the value pushed by op, if it is a push of a constant.
+func (asm *assembler) constPush(op intrOp) (uint64, bool) {
+	if op.label != "" || op.op != vm.Push {
+		return 0, false
+	}
+	param := op.parameters[0]
+	if param.expr != nil {
+		n, err := asm.evalConst(*param.expr)
+		return n, err == nil
+	}
+	if param.getParamName() != "" || param.value == nil {
+		return 0, false
+	}
+	return *param.value, true
+}
+
+// removablePush reports whether op is a push that can be removed without
+// hiding an error, such as an undefined name.
+func (asm *assembler) removablePush(op intrOp) bool {
+	if _, ok := asm.constPush(op); ok {
+		return true
+	}
+	if op.label != "" || op.op != vm.Push {
+		return false
+	}
+	param := op.parameters[0]
+	return param.expr == nil && param.value != nil
+}
+
+// jumpLabel returns the label an op jumps to, if it is a jump whose target
+// is written as a plain label.
+func jumpLabel(op intrOp) (string, bool) {
+	if op.label != "" {
+		return "", false
+	}
+	info, ok := op.op.Info()
+	if !ok || len(info.Operands) == 0 || info.Operands[0] != vm.CodeOperand {
+		return "", false
+	}
+	param := op.parameters[0]
+	if param.expr != nil || param.varName != "" || param.labelName == "" {
+		return "", false
+	}
+	return param.labelName, true
+}
@@ -0,0 +1,149 @@
+package asm
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/johnny-morrice/learn/vmlang/asm/ast"
+	"github.com/johnny-morrice/learn/vmlang/asm/parser"
+	"github.com/johnny-morrice/learn/vmlang/vm"
+)
+
+func TestOptimise(t *testing.T) {
+	push, exit := uint64(vm.Push), uint64(vm.Exit)
+	testCases := map[string]struct {
+		src      string
+		expected []uint64
+	}{
+		"fold constants": {
+			src:      "push 6\npush 7\nmult\noutd\n",
+			expected: []uint64{push, 42, uint64(vm.OutputDecimal), exit},
+		},
+		"fold constant names": {
+			src:      "const n = 4\npush n\npush 1\nsub\npush 2\nshl\noutd\n",
+			expected: []uint64{push, 12, uint64(vm.OutputDecimal), exit},
+		},
+		"keep division by zero": {
+			src:      "push 1\npush 0\ndiv\n",
+			expected: []uint64{push, 1, push, 0, uint64(vm.Divide), exit},
+		},
+		"no folding across label": {
+			src:      "push 1\nl:\npush 2\nadd\ngoto l\n",
+			expected: []uint64{push, 1, push, 2, uint64(vm.Add), uint64(vm.Goto), 2, exit},
+		},
+		"remove push pop": {
+			src:      "var x\npush 1\npush x\npop\noutd\n",
+			expected: []uint64{push, 1, uint64(vm.OutputDecimal), exit},
+		},
+		"remove folded push pop": {
+			src:      "push 1\npush 2\npush 3\nadd\npop\noutd\n",
+			expected: []uint64{push, 1, uint64(vm.OutputDecimal), exit},
+		},
+		"remove incr decr": {
+			src:      "push 1\nincr\ndecr\ndecr\nincr\noutd\n",
+			expected: []uint64{push, 1, uint64(vm.OutputDecimal), exit},
+		},
+		"thread goto chain": {
+			src: "push 1\njnz a\ncall b\nexit\na:\ngoto b\nb:\ngoto c\nc:\nrtn\n",
+			expected: []uint64{push, 1, uint64(vm.JumpNotZero), 7, uint64(vm.Call), 7, exit,
+				uint64(vm.Return), exit},
+		},
+		"goto loop": {
+			src:      "a:\ngoto b\nb:\ngoto a\n",
+			expected: []uint64{uint64(vm.Goto), 0, exit},
+		},
+		"drop unreachable code": {
+			src:      "goto end\npush 1\npop\noutd\nend:\npush 2\noutd\nexit\npush 3\n",
+			expected: []uint64{push, 2, uint64(vm.OutputDecimal), exit, exit},
+		},
+		"drop code after indirect goto": {
+			src:      "push a\ngotos\npush 1\noutd\na:\nexit\n",
+			expected: []uint64{push, 3, uint64(vm.GotoIndirect), exit, exit},
+		},
+		"keep push of undefined name": {
+			src:      "push missing\npop\n",
+			expected: nil,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			tree, err := parser.Parse(parser.ParseContext{RemainingInput: tc.src})
+			if err != nil {
+				t.Fatalf("unexpected parse err: %s", err)
+			}
+			machine, err := AssembleWith(tree, Options{Optimise: true})
+			if tc.expected == nil {
+				if !errors.Is(err, ErrAssembler) {
+					t.Fatalf("expected assembler err but was: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected assemble err: %s", err)
+			}
+			actual := machine.Memory[:machine.CodeEnd]
+			if !reflect.DeepEqual(tc.expected, actual) {
+				t.Errorf("expected bytecode: %v\nactual: %v", tc.expected, actual)
+			}
+			assertOptimisedEquivalent(t, tree)
+		})
+	}
+}
+
+// assertOptimisedEquivalent assembles a program with and without
+// optimisation, checking that both fail or neither does. It then runs them
+// and checks that both give the same output and error and leave the same
+// number of values on the stack. Addresses move when code is removed, so
+// the values themselves are not compared.
+func assertOptimisedEquivalent(t *testing.T, tree ast.AST) {
+	t.Helper()
+	plain, err := Assemble(tree)
+	optimised, optimisedErr := AssembleWith(tree, Options{Optimise: true})
+	if (err == nil) != (optimisedErr == nil) {
+		t.Fatalf("expected optimised assemble err: %v\nactual: %v", err, optimisedErr)
+	}
+	if err != nil {
+		return
+	}
+	plainRun := runForEquivalence(plain)
+	optimisedRun := runForEquivalence(optimised)
+	if !plainRun.halted && !optimisedRun.halted {
+		return
+	}
+	if !reflect.DeepEqual(plainRun, optimisedRun) {
+		t.Errorf("optimised program behaves differently\nexpected: %+v\nactual: %+v", plainRun, optimisedRun)
+	}
+}
+
+type equivalenceRun struct {
+	halted bool
+	output string
+	err    error
+	depth  uint64
+}
+
+const equivalenceSteps = 100000
+
+func runForEquivalence(machine *vm.VirtualMachine) equivalenceRun {
+	out := &bytes.Buffer{}
+	machine.Output = out
+	run := equivalenceRun{}
+	for i := 0; i < equivalenceSteps && !machine.Halted; i++ {
+		err := machine.Step()
+		if err != nil {
+			var runtimeErr *vm.RuntimeError
+			if errors.As(err, &runtimeErr) {
+				err = runtimeErr.Kind
+			}
+			run.err = err
+			break
+		}
+	}
+	run.halted = machine.Halted || run.err != nil
+	run.output = out.String()
+	run.depth = machine.SP - machine.StackStart
+	return run
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"strconv"
+	"strings"
 	"unicode"
 	"unicode/utf8"
 
@@ -52,9 +53,19 @@ func Alt(name string, combs ...ParseCombinator) ParseCombinator {
 	}
 }
 
+// Nothing matches without consuming input.
+func Nothing() ParseCombinator {
+	return func(pc ParseContext) ParseContext {
+		return pc
+	}
+}
+
 func EOF() ParseCombinator {
 	return func(pc ParseContext) ParseContext {
 		pc.Failed = len(pc.RemainingInput) != 0
+		if pc.Failed {
+			pc.recordExpected("end of input")
+		}
 		return pc
 	}
 }
@@ -63,6 +74,7 @@ func TextEq(name, text string) ParseCombinator {
 	return func(pc ParseContext) ParseContext {
 		if len(pc.RemainingInput) < len(text) {
 			pc.Failed = true
+			pc.recordExpected(strconv.Quote(text))
 			pc.ErrorMessage = fmt.Sprintf("not enough input to match expected for rule %s %q but was: %q", name, text, pc.RemainingInput)
 			if logBacktrack {
 				log.Printf("TextEq backtrack: %s", pc.ErrorMessage)
@@ -72,6 +84,7 @@ func TextEq(name, text string) ParseCombinator {
 		input := pc.RemainingInput[:len(text)]
 		pc.Failed = text != input
 		if pc.Failed {
+			pc.recordExpected(strconv.Quote(text))
 			pc.ErrorMessage = fmt.Sprintf("expected for rule %s %q but was: %q", name, text, input)
 			if logBacktrack {
 				log.Printf("TextEq backtrack: %s", pc.ErrorMessage)
@@ -103,11 +116,28 @@ func Repeat(name string, comb ParseCombinator) ParseCombinator {
 				}
 				return loopCtx
 			}
+			// Stop once comb matches without consuming input, or it would match forever.
+			if len(nextCtx.RemainingInput) == len(loopCtx.RemainingInput) {
+				return nextCtx
+			}
 			loopCtx = nextCtx
 		}
 	}
 }
 
+func Optional(name string, comb ParseCombinator) ParseCombinator {
+	return func(pc ParseContext) ParseContext {
+		nextCtx := comb(pc)
+		if nextCtx.Failed {
+			if logBacktrack {
+				log.Printf("Optional backtrack %s: %s", name, nextCtx.ErrorMessage)
+			}
+			return pc
+		}
+		return nextCtx
+	}
+}
+
 func OpName() ParseCombinator {
 	opCombs := []ParseCombinator{}
 	for _, iterOp := range vm.Bytecodes() {
@@ -115,6 +145,7 @@ func OpName() ParseCombinator {
 		opCombs = append(opCombs,
 			Seq("Op"+op.String(),
 				TextEq("OpName", op.String()),
+				WordEnd(),
 				WithBuilder(func(bldr ast.Builder) (ast.Builder, error) {
 					return bldr.AddOpStmt(op), nil
 				}),
@@ -124,6 +155,19 @@ func OpName() ParseCombinator {
 	return Alt("OpName", opCombs...)
 }
 
+// WordEnd fails if the input continues with a letter or digit, so that a
+// keyword does not match the start of a longer name.
+func WordEnd() ParseCombinator {
+	return func(pc ParseContext) ParseContext {
+		r, size := utf8.DecodeRuneInString(pc.RemainingInput)
+		if size > 0 && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			pc.Failed = true
+			pc.ErrorMessage = fmt.Sprintf("unexpected rune at end of word: %q", string(r))
+		}
+		return pc
+	}
+}
+
 func Letter() ParseCombinator {
 	return MatchRune("IsLetter", unicode.IsLetter)
 }
@@ -145,6 +189,7 @@ func MatchRune(name string, matcher func(r rune) bool) ParseCombinator {
 		r, size := utf8.DecodeRuneInString(pc.RemainingInput)
 		pc.Failed = utf8.RuneError == r || size == 0 || !matcher(r)
 		if pc.Failed {
+			pc.recordExpected(describeRule(name))
 			pc.ErrorMessage = fmt.Sprintf("unexpected rune for rule %s: %q", name, string(r))
 			if logBacktrack {
 				log.Printf("MatchRune backtrack: %s", pc.ErrorMessage)
@@ -171,8 +216,44 @@ func Newline() ParseCombinator {
 	return Alt("Newline", TextEq("Newline", "\n"), TextEq("WindowsNewline", "\r\n"))
 }
 
+// Comment matches a comment starting with ; or # and running to the end of the line.
+func Comment() ParseCombinator {
+	return Seq(
+		"Comment",
+		Alt("CommentStart", TextEq("Semicolon", ";"), TextEq("Hash", "#")),
+		Repeat("CommentText", MatchRune("CommentChar", func(r rune) bool {
+			return r != '\n'
+		})),
+	)
+}
+
 func StmtEnd() ParseCombinator {
-	return Seq("StmtEnd", OptionalWhitespace(), Alt("Newline", Newline(), EOF()))
+	return Seq("StmtEnd", OptionalWhitespace(), Optional("StmtComment", Comment()), Alt("Newline", Newline(), EOF()))
+}
+
+// BlankLine matches a line holding only whitespace or a comment.
+func BlankLine() ParseCombinator {
+	return StmtEnd()
+}
+
+// RecoverLine skips the rest of a line that could not be parsed, recording
+// its syntax error so that parsing can report every bad line at once.
+func RecoverLine() ParseCombinator {
+	return func(pc ParseContext) ParseContext {
+		if pc.RemainingInput == "" || !pc.reportSyntaxError() {
+			pc.Failed = true
+			pc.ErrorMessage = "cannot recover from syntax error"
+			return pc
+		}
+		end := strings.IndexByte(pc.RemainingInput, '\n')
+		if end < 0 {
+			pc.RemainingInput = ""
+		} else {
+			pc.RemainingInput = pc.RemainingInput[end+1:]
+		}
+		pc.Bldr = pc.Bldr.SetStmtPos(ast.Pos{})
+		return pc
+	}
 }
 
 func VarStmt() ParseCombinator {
@@ -184,7 +265,93 @@ func VarStmt() ParseCombinator {
 		}),
 		Whitespace(),
 		VarDecl(),
-		Repeat("VarDecls", Seq("VarDecl", Whitespace(), VarDecl())),
+		Alt(
+			"VarRest",
+			Seq(
+				"VarInit",
+				OptionalWhitespace(),
+				TextEq("Equals", "="),
+				OptionalWhitespace(),
+				Expr(true),
+				WithBuilder(func(bldr ast.Builder) (ast.Builder, error) {
+					return bldr.SetStmtExpr()
+				}),
+			),
+			Repeat("VarDecls", Seq("VarDecl", Whitespace(), VarDecl())),
+		),
+		CompleteStmt(),
+	)
+}
+
+func ConstStmt() ParseCombinator {
+	return Seq(
+		"ConstStmt",
+		TextEq("Const", "const"),
+		Whitespace(),
+		StartCapture(),
+		VarName(),
+		StopCapture(),
+		func(pc ParseContext) ParseContext {
+			pc.Bldr = pc.Bldr.AddConstStmt(pc.CapturedText)
+			pc.CapturedText = ""
+			return pc
+		},
+		OptionalWhitespace(),
+		TextEq("Equals", "="),
+		OptionalWhitespace(),
+		Expr(true),
+		WithBuilder(func(bldr ast.Builder) (ast.Builder, error) {
+			return bldr.SetStmtExpr()
+		}),
+		CompleteStmt(),
+	)
+}
+
+func ArrayStmt() ParseCombinator {
+	return Seq(
+		"ArrayStmt",
+		TextEq("Array", "array"),
+		Whitespace(),
+		StartCapture(),
+		VarName(),
+		StopCapture(),
+		func(pc ParseContext) ParseContext {
+			pc.Bldr = pc.Bldr.AddArrayStmt(pc.CapturedText)
+			pc.CapturedText = ""
+			return pc
+		},
+		Whitespace(),
+		Expr(true),
+		WithBuilder(func(bldr ast.Builder) (ast.Builder, error) {
+			return bldr.SetStmtExpr()
+		}),
+		CompleteStmt(),
+	)
+}
+
+func TableStmt() ParseCombinator {
+	entry := Seq(
+		"TableEntry",
+		Whitespace(),
+		Expr(false),
+		WithBuilder(func(bldr ast.Builder) (ast.Builder, error) {
+			return bldr.AddTableEntry()
+		}),
+	)
+	return Seq(
+		"TableStmt",
+		TextEq("Table", "table"),
+		Whitespace(),
+		StartCapture(),
+		VarName(),
+		StopCapture(),
+		func(pc ParseContext) ParseContext {
+			pc.Bldr = pc.Bldr.AddTableStmt(pc.CapturedText)
+			pc.CapturedText = ""
+			return pc
+		},
+		entry,
+		Repeat("TableEntries", entry),
 		CompleteStmt(),
 	)
 }
@@ -198,8 +365,7 @@ func VarDecl() ParseCombinator {
 		func(pc ParseContext) ParseContext {
 			bldr, err := pc.Bldr.AddVar(pc.CapturedText)
 			if err != nil {
-				pc.Failed = true
-				pc.ErrorMessage = err.Error()
+				pc = failWith(pc, err.Error())
 			} else {
 				pc.CapturedText = ""
 				pc.Bldr = bldr
@@ -209,6 +375,63 @@ func VarDecl() ParseCombinator {
 	)
 }
 
+func DataStmt() ParseCombinator {
+	return Seq(
+		"DataStmt",
+		TextEq("Data", "data"),
+		Whitespace(),
+		StartCapture(),
+		VarName(),
+		StopCapture(),
+		func(pc ParseContext) ParseContext {
+			pc.Bldr = pc.Bldr.AddDataStmt(pc.CapturedText)
+			pc.CapturedText = ""
+			return pc
+		},
+		Whitespace(),
+		StartCapture(),
+		StringLiteral(),
+		StopCapture(),
+		func(pc ParseContext) ParseContext {
+			text, err := strconv.Unquote(pc.CapturedText)
+			if err != nil {
+				pc = failWith(pc, err.Error())
+				return pc
+			}
+			bldr, err := pc.Bldr.SetDataText(text)
+			if err != nil {
+				pc = failWith(pc, err.Error())
+			} else {
+				pc.CapturedText = ""
+				pc.Bldr = bldr
+			}
+			return pc
+		},
+		CompleteStmt(),
+	)
+}
+
+// StringLiteral matches a double quoted string using Go escape sequences.
+func StringLiteral() ParseCombinator {
+	return Seq(
+		"StringLiteral",
+		TextEq("OpenQuote", `"`),
+		Repeat(
+			"StringChars",
+			Alt(
+				"StringChar",
+				Seq("StringEscape", TextEq("Backslash", `\`), MatchRune("EscapedChar", func(r rune) bool {
+					return r != '\n'
+				})),
+				MatchRune("StringChar", func(r rune) bool {
+					return r != '"' && r != '\\' && r != '\n'
+				}),
+			),
+		),
+		TextEq("CloseQuote", `"`),
+	)
+}
+
 func OpStmt() ParseCombinator {
 	return Seq(
 		"OpStmt",
@@ -218,54 +441,141 @@ func OpStmt() ParseCombinator {
 			Seq(
 				"SpacedParam",
 				Whitespace(),
-				Alt(
-					"OpParamAlt",
-					Seq(
-						"OpVarParam",
-						StartCapture(),
-						VarName(),
-						StopCapture(),
-						func(pc ParseContext) ParseContext {
-							bldr, err := pc.Bldr.AddParam(ast.Param{Variable: pc.CapturedText})
-							if err != nil {
-								pc.Failed = true
-								pc.ErrorMessage = err.Error()
-							} else {
-								pc.CapturedText = ""
-								pc.Bldr = bldr
-							}
-							return pc
-						},
-					),
-					Seq(
-						"OpLitParam",
-						StartCapture(),
-						Number(),
-						StopCapture(),
-						func(pc ParseContext) ParseContext {
-							num, err := strconv.ParseUint(pc.CapturedText, 10, 64)
-							if err != nil {
-								pc.Failed = true
-								pc.ErrorMessage = err.Error()
-							}
-							bldr, err := pc.Bldr.AddParam(ast.Param{Literal: num})
-							if err != nil {
-								pc.Failed = true
-								pc.ErrorMessage = err.Error()
-							} else {
-								pc.CapturedText = ""
-								pc.Bldr = bldr
-							}
-							return pc
-						},
-					),
-				),
+				Expr(false),
+				WithBuilder(func(bldr ast.Builder) (ast.Builder, error) {
+					return bldr.AddParamExpr()
+				}),
 			),
 		),
 		CompleteStmt(),
 	)
 }
 
+func IncludeStmt() ParseCombinator {
+	return Seq(
+		"IncludeStmt",
+		TextEq("Include", "include"),
+		Whitespace(),
+		StartCapture(),
+		StringLiteral(),
+		StopCapture(),
+		func(pc ParseContext) ParseContext {
+			path, err := strconv.Unquote(pc.CapturedText)
+			if err != nil {
+				return failWith(pc, err.Error())
+			}
+			pc.Bldr = pc.Bldr.AddIncludeStmt(path)
+			pc.CapturedText = ""
+			return pc
+		},
+		CompleteStmt(),
+	)
+}
+
+func ExportStmt() ParseCombinator {
+	return NameListStmt("ExportStmt", "export", ast.Builder.AddExportStmt)
+}
+
+func ImportStmt() ParseCombinator {
+	return NameListStmt("ImportStmt", "import", ast.Builder.AddImportStmt)
+}
+
+func LocalStmt() ParseCombinator {
+	return NameListStmt("LocalStmt", "local", ast.Builder.AddLocalStmt)
+}
+
+// NameListStmt matches a keyword followed by one or more names.
+func NameListStmt(name, keyword string, add func(bldr ast.Builder, names []string) ast.Builder) ParseCombinator {
+	return Seq(
+		name,
+		TextEq(name+"Keyword", keyword),
+		Whitespace(),
+		StartCapture(),
+		VarName(),
+		Repeat(name+"Names", Seq(name+"Name", Whitespace(), VarName())),
+		StopCapture(),
+		func(pc ParseContext) ParseContext {
+			pc.Bldr = add(pc.Bldr, strings.Fields(pc.CapturedText))
+			pc.CapturedText = ""
+			return pc
+		},
+		CompleteStmt(),
+	)
+}
+
+// MacroStmt starts a macro definition. The statements that follow, up to
+// endm, form its body.
+func MacroStmt() ParseCombinator {
+	return Seq(
+		"MacroStmt",
+		TextEq("Macro", "macro"),
+		Whitespace(),
+		StartCapture(),
+		VarName(),
+		Repeat("MacroParams", Seq("MacroParam", Whitespace(), VarName())),
+		StopCapture(),
+		func(pc ParseContext) ParseContext {
+			fields := strings.Fields(pc.CapturedText)
+			bldr, err := pc.Bldr.StartMacro(fields[0], fields[1:])
+			if err != nil {
+				return failWith(pc, err.Error())
+			}
+			pc.CapturedText = ""
+			pc.Bldr = bldr
+			return pc
+		},
+	)
+}
+
+func EndMacroStmt() ParseCombinator {
+	return Seq(
+		"EndMacroStmt",
+		TextEq("EndMacro", "endm"),
+		WordEnd(),
+		WithBuilder(func(bldr ast.Builder) (ast.Builder, error) {
+			return bldr.EndMacro()
+		}),
+	)
+}
+
+// MacroCallStmt matches a call to a macro, which looks like an op with a
+// name that is not a mnemonic.
+func MacroCallStmt() ParseCombinator {
+	return Seq(
+		"MacroCallStmt",
+		StartCapture(),
+		VarName(),
+		StopCapture(),
+		func(pc ParseContext) ParseContext {
+			pc.Bldr = pc.Bldr.AddMacroCallStmt(pc.CapturedText)
+			pc.CapturedText = ""
+			return pc
+		},
+		Repeat(
+			"MacroArgs",
+			Seq(
+				"SpacedArg",
+				Whitespace(),
+				Expr(false),
+				WithBuilder(func(bldr ast.Builder) (ast.Builder, error) {
+					return bldr.AddParamExpr()
+				}),
+			),
+		),
+		CompleteStmt(),
+	)
+}
+
+// MacrosClosed fails if a macro definition is missing its endm.
+func MacrosClosed() ParseCombinator {
+	return func(pc ParseContext) ParseContext {
+		if pc.Bldr.Macro != nil {
+			return failWith(pc, fmt.Sprintf("macro %s defined at %s has no endm", pc.Bldr.Macro.Name, pc.Bldr.MacroPos))
+		}
+		return pc
+	}
+}
+
 func LabelStmt() ParseCombinator {
 	return Seq(
 		"LabelStmt",
@@ -286,16 +596,24 @@ func Stmt() ParseCombinator {
 	return Seq(
 		"Stmt",
 		OptionalWhitespace(),
+		func(pc ParseContext) ParseContext {
+			if pc.Source != "" {
+				pc.Bldr = pc.Bldr.SetStmtPos(pc.Pos())
+			}
+			return pc
+		},
 		Alt(
 			"StmtAlt",
-			LabelStmt(), VarStmt(), OpStmt()),
+			LabelStmt(), VarStmt(), DataStmt(), ConstStmt(), ArrayStmt(), TableStmt(),
+			IncludeStmt(), ExportStmt(), ImportStmt(), LocalStmt(),
+			MacroStmt(), EndMacroStmt(), OpStmt(), MacroCallStmt()),
 		StmtEnd(),
 	)
 }
 
 func AST() ParseCombinator {
 	return func(pc ParseContext) ParseContext {
-		f := Seq("AST", Repeat("Statements", Stmt()), EOF())
+		f := Seq("AST", Repeat("Lines", Alt("Line", Stmt(), BlankLine(), RecoverLine())), EOF(), MacrosClosed())
 		return f(pc)
 	}
 }
@@ -320,14 +638,40 @@ func WithBuilder(f BuilderFunc) ParseCombinator {
 	return func(pc ParseContext) ParseContext {
 		bldr, err := f(pc.Bldr)
 		if err != nil {
-			pc.Failed = true
-			pc.ErrorMessage = err.Error()
+			pc = failWith(pc, err.Error())
 		}
 		pc.Bldr = bldr
 		return pc
 	}
 }
 
+// failWith fails the parse with a message that is reported in preference
+// to the expected set if no alternative gets further.
+func failWith(pc ParseContext, msg string) ParseContext {
+	pc.Failed = true
+	pc.ErrorMessage = msg
+	pc.recordMessage(msg)
+	return pc
+}
+
+var ruleDescriptions = map[string]string{
+	"IsLetter":        "letter",
+	"IsDigit":         "digit",
+	"StringChar":      "string character",
+	"EscapedChar":     "escaped character",
+	"IsHexDigit":      "hex digit",
+	"IsBinaryDigit":   "binary digit",
+	"CharLiteralChar": "character",
+}
+
+func describeRule(name string) string {
+	desc, ok := ruleDescriptions[name]
+	if ok {
+		return desc
+	}
+	return name
+}
+
 func CompleteStmt() ParseCombinator {
 	return WithBuilder(func(bldr ast.Builder) (ast.Builder, error) {
 		return bldr.CompleteStmt()
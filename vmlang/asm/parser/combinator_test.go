@@ -119,6 +119,37 @@ func TestParserCombinators(t *testing.T) {
 			},
 		},
 
+		"Comment WhenMatch": {
+			input: ParseContext{
+				RemainingInput: "; push 1\npop",
+			},
+			comb: Comment(),
+			expected: ParseContext{
+				Failed:         false,
+				RemainingInput: "\npop",
+			},
+		},
+		"StmtEnd WithComment": {
+			input: ParseContext{
+				RemainingInput: "  # note\npop",
+			},
+			comb: StmtEnd(),
+			expected: ParseContext{
+				Failed:         false,
+				RemainingInput: "pop",
+			},
+		},
+		"Repeat WhenNoProgress": {
+			input: ParseContext{
+				RemainingInput: "foo",
+			},
+			comb: Repeat("Optionals", Optional("OptionalDigit", Digit())),
+			expected: ParseContext{
+				Failed:         false,
+				RemainingInput: "foo",
+			},
+		},
+
 		"OpStmt WhenMatch": {
 			input: ParseContext{
 				RemainingInput: "push foo 123",
@@ -149,7 +180,7 @@ func TestParserCombinators(t *testing.T) {
 			expected: ParseContext{
 				Failed:         true,
 				RemainingInput: "var foo 123",
-				ErrorMessage:   "expected for rule OpName \"mult\" but was: \"var \"",
+				ErrorMessage:   "expected for rule OpName \"free\" but was: \"var \"",
 			},
 		},
 
@@ -179,6 +210,32 @@ func TestParserCombinators(t *testing.T) {
 			},
 		},
 
+		"DataStmt WhenMatch": {
+			input: ParseContext{
+				RemainingInput: `data msg "say \"hi\"\n"`,
+			},
+			comb: DataStmt(),
+			expected: ParseContext{
+				Failed: false,
+				Bldr: ast.Builder{
+					Stmts: collections.List[ast.Stmt]{}.
+						Append(ast.Stmt{Data: &ast.DataStmt{Name: "msg", Text: "say \"hi\"\n"}}),
+				},
+				RemainingInput: "",
+			},
+		},
+		"DataStmt WhenUnterminated": {
+			input: ParseContext{
+				RemainingInput: `data msg "oops`,
+			},
+			comb: DataStmt(),
+			expected: ParseContext{
+				Failed:         true,
+				ErrorMessage:   "not enough input to match expected for rule CloseQuote \"\\\"\" but was: \"\"",
+				RemainingInput: `data msg "oops`,
+			},
+		},
+
 		"LabelStmt WhenMatch": {
 			input: ParseContext{
 				RemainingInput: "foo:",
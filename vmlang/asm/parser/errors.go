@@ -0,0 +1,189 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// SyntaxError reports the furthest point the parser reached in the input
+// along with everything that would have allowed it to continue.
+type SyntaxError struct {
+	File   string
+	Line   int
+	Column int
+	// Snippet is the offending source line followed by a line with a caret under Column.
+	Snippet  string
+	Found    string
+	Expected []string
+	// Message describes a failure that is not explained by the expected set, such as a number out of range.
+	Message string
+}
+
+func (err *SyntaxError) Error() string {
+	builder := strings.Builder{}
+	if err.File != "" {
+		fmt.Fprintf(&builder, "%s:", err.File)
+	}
+	fmt.Fprintf(&builder, "%d:%d: syntax error: ", err.Line, err.Column)
+	if err.Message != "" {
+		builder.WriteString(err.Message)
+	} else {
+		fmt.Fprintf(&builder, "found %s, expected ", err.Found)
+		if len(err.Expected) > 1 {
+			builder.WriteString("one of: ")
+		}
+		builder.WriteString(strings.Join(err.Expected, ", "))
+	}
+	if err.Snippet != "" {
+		builder.WriteString("\n")
+		builder.WriteString(err.Snippet)
+	}
+	return builder.String()
+}
+
+// SyntaxErrors holds every syntax error in a file, in source order.
+type SyntaxErrors []*SyntaxError
+
+func (errs SyntaxErrors) Error() string {
+	msgs := []string{}
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Is matches target against each error in turn, as errors.Is only looks
+// inside a list of errors from Go 1.20.
+func (errs SyntaxErrors) Is(target error) bool {
+	for _, err := range errs {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first error that matches target.
+func (errs SyntaxErrors) As(target any) bool {
+	for _, err := range errs {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+type furthestFailure struct {
+	// remaining is the length of the unparsed input at the failure, or -1 before any failure.
+	remaining int
+	expected  map[string]struct{}
+	message   string
+}
+
+func (pc ParseContext) recordExpected(expected string) {
+	failure := pc.furthestAtCurrentPos()
+	if failure == nil {
+		return
+	}
+	failure.expected[expected] = struct{}{}
+}
+
+func (pc ParseContext) recordMessage(msg string) {
+	failure := pc.furthestAtCurrentPos()
+	if failure == nil {
+		return
+	}
+	if failure.message == "" {
+		failure.message = msg
+	}
+}
+
+// furthestAtCurrentPos returns the failure tracker if the current position
+// is at least as far as any earlier failure, resetting it if this is further.
+func (pc ParseContext) furthestAtCurrentPos() *furthestFailure {
+	failure := pc.furthest
+	if failure == nil {
+		return nil
+	}
+	remaining := len(pc.RemainingInput)
+	if failure.remaining >= 0 && remaining > failure.remaining {
+		return nil
+	}
+	if failure.remaining < 0 || remaining < failure.remaining {
+		failure.remaining = remaining
+		failure.expected = map[string]struct{}{}
+		failure.message = ""
+	}
+	return failure
+}
+
+// reportSyntaxError records the furthest failure so far and starts tracking afresh.
+func (pc ParseContext) reportSyntaxError() bool {
+	if pc.reported == nil || pc.furthest == nil {
+		return false
+	}
+	*pc.reported = append(*pc.reported, pc.syntaxError())
+	*pc.furthest = furthestFailure{remaining: -1}
+	return true
+}
+
+func (pc ParseContext) syntaxError() *SyntaxError {
+	failure := pc.furthest
+	offset := 0
+	if failure != nil && failure.remaining >= 0 {
+		offset = len(pc.Source) - failure.remaining
+	}
+	pos := pc.posAt(offset)
+	err := &SyntaxError{
+		File:    pos.File,
+		Line:    pos.Line,
+		Column:  pos.Column,
+		Snippet: snippet(pc.Source, offset),
+		Found:   describeFound(pc.Source[offset:]),
+	}
+	if failure == nil || failure.remaining < 0 {
+		err.Message = pc.ErrorMessage
+		return err
+	}
+	err.Message = failure.message
+	for expected := range failure.expected {
+		err.Expected = append(err.Expected, expected)
+	}
+	sort.Strings(err.Expected)
+	return err
+}
+
+func snippet(source string, offset int) string {
+	lineStart := strings.LastIndexByte(source[:offset], '\n') + 1
+	lineEnd := strings.IndexByte(source[offset:], '\n')
+	if lineEnd < 0 {
+		lineEnd = len(source)
+	} else {
+		lineEnd += offset
+	}
+	line := strings.TrimSuffix(source[lineStart:lineEnd], "\r")
+
+	// Keep tabs so the caret lines up with the source.
+	caret := strings.Builder{}
+	for _, r := range source[lineStart:offset] {
+		if r == '\t' {
+			caret.WriteRune('\t')
+		} else {
+			caret.WriteRune(' ')
+		}
+	}
+	caret.WriteRune('^')
+	return line + "\n" + caret.String()
+}
+
+func describeFound(remaining string) string {
+	if remaining == "" {
+		return "end of input"
+	}
+	r, _ := utf8.DecodeRuneInString(remaining)
+	return strconv.Quote(string(r))
+}
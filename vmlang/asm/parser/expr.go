@@ -0,0 +1,152 @@
+package parser
+
+import (
+	"strconv"
+	"unicode"
+
+	"github.com/johnny-morrice/learn/vmlang/asm/ast"
+)
+
+// binaryOperators lists the expression operators from lowest to highest precedence.
+var binaryOperators = [][]string{
+	{"|"},
+	{"^"},
+	{"&"},
+	{"<<", ">>"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+// Expr matches an expression and pushes it onto the builder's expression
+// stack. Op parameters are separated by whitespace, so unless spaced is set
+// whitespace is only allowed inside parentheses.
+func Expr(spaced bool) ParseCombinator {
+	ws := Nothing()
+	if spaced {
+		ws = OptionalWhitespace()
+	}
+	comb := PrimaryExpr()
+	for i := len(binaryOperators) - 1; i >= 0; i-- {
+		comb = binaryExprLevel(binaryOperators[i], comb, ws)
+	}
+	return comb
+}
+
+func binaryExprLevel(operators []string, operand ParseCombinator, ws ParseCombinator) ParseCombinator {
+	opCombs := []ParseCombinator{}
+	for _, iterOperator := range operators {
+		operator := iterOperator
+		opCombs = append(opCombs, Seq(
+			"BinaryOperand",
+			ws,
+			TextEq("Operator", operator),
+			ws,
+			operand,
+			WithBuilder(func(bldr ast.Builder) (ast.Builder, error) {
+				return bldr.ApplyBinaryOp(operator)
+			}),
+		))
+	}
+	return Seq("BinaryExpr", operand, Repeat("BinaryOperands", Alt("BinaryOperator", opCombs...)))
+}
+
+func PrimaryExpr() ParseCombinator {
+	return Alt(
+		"PrimaryExpr",
+		ParenExpr(),
+		CharLiteral(),
+		IntLiteral("HexLiteral", "0x", 16, MatchRune("IsHexDigit", isHexDigit)),
+		IntLiteral("BinaryLiteral", "0b", 2, MatchRune("IsBinaryDigit", isBinaryDigit)),
+		IntLiteral("DecimalLiteral", "", 10, Digit()),
+		Seq(
+			"NameExpr",
+			StartCapture(),
+			VarName(),
+			StopCapture(),
+			func(pc ParseContext) ParseContext {
+				pc.Bldr = pc.Bldr.PushExpr(ast.Expr{Name: pc.CapturedText})
+				pc.CapturedText = ""
+				return pc
+			},
+		),
+	)
+}
+
+func ParenExpr() ParseCombinator {
+	return Seq(
+		"ParenExpr",
+		TextEq("OpenParen", "("),
+		OptionalWhitespace(),
+		// Built lazily, as the expression grammar contains itself.
+		func(pc ParseContext) ParseContext {
+			return Expr(true)(pc)
+		},
+		OptionalWhitespace(),
+		TextEq("CloseParen", ")"),
+	)
+}
+
+// IntLiteral matches an integer written with prefix in the given base.
+func IntLiteral(name, prefix string, base int, digit ParseCombinator) ParseCombinator {
+	return Seq(
+		name,
+		TextEq(name+"Prefix", prefix),
+		StartCapture(),
+		digit,
+		Repeat(name+"Digits", digit),
+		StopCapture(),
+		func(pc ParseContext) ParseContext {
+			num, err := strconv.ParseUint(pc.CapturedText, base, 64)
+			if err != nil {
+				return failWith(pc, err.Error())
+			}
+			pc.Bldr = pc.Bldr.PushExpr(ast.Expr{Literal: num})
+			pc.CapturedText = ""
+			return pc
+		},
+	)
+}
+
+// CharLiteral matches a single quoted character using Go escape sequences.
+func CharLiteral() ParseCombinator {
+	return Seq(
+		"CharLiteral",
+		StartCapture(),
+		TextEq("OpenCharQuote", "'"),
+		Alt(
+			"Char",
+			Seq(
+				"CharEscape",
+				TextEq("Backslash", `\`),
+				MatchRune("EscapedChar", func(r rune) bool {
+					return r != '\n'
+				}),
+				Repeat("EscapedChars", MatchRune("EscapedChar", func(r rune) bool {
+					return r != '\'' && r != '\n'
+				})),
+			),
+			MatchRune("CharLiteralChar", func(r rune) bool {
+				return r != '\'' && r != '\\' && r != '\n'
+			}),
+		),
+		TextEq("CloseCharQuote", "'"),
+		StopCapture(),
+		func(pc ParseContext) ParseContext {
+			text, err := strconv.Unquote(pc.CapturedText)
+			if err != nil {
+				return failWith(pc, err.Error())
+			}
+			pc.Bldr = pc.Bldr.PushExpr(ast.Expr{Literal: uint64([]rune(text)[0])})
+			pc.CapturedText = ""
+			return pc
+		},
+	)
+}
+
+func isHexDigit(r rune) bool {
+	return unicode.IsDigit(r) || ('a' <= r && r <= 'f') || ('A' <= r && r <= 'F')
+}
+
+func isBinaryDigit(r rune) bool {
+	return r == '0' || r == '1'
+}
@@ -0,0 +1,95 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/johnny-morrice/learn/vmlang/asm/ast"
+)
+
+var ErrIncludeCycle = errors.New("include cycle")
+
+// SourceLoader reads the source of an asm file.
+type SourceLoader func(fileName string) (string, error)
+
+// ParseFile parses an asm file along with every file it includes.
+func ParseFile(fileName string) (ast.AST, error) {
+	return ParseFileWith(fileName, readSourceFile)
+}
+
+func readSourceFile(fileName string) (string, error) {
+	bs, err := os.ReadFile(fileName)
+	if err != nil {
+		return "", err
+	}
+	return string(bs), nil
+}
+
+// ParseFileWith parses fileName, reading it and its includes with load.
+// Include paths are relative to the including file. A file that has
+// already been included is skipped, so libraries may include each other's
+// dependencies freely, but a file that includes itself is an error.
+func ParseFileWith(fileName string, load SourceLoader) (ast.AST, error) {
+	inc := includer{
+		load:     load,
+		included: map[string]struct{}{},
+	}
+	stmts, err := inc.parse(filepath.Clean(fileName), nil)
+	if err != nil {
+		return ast.AST{}, err
+	}
+	return ast.AST{Stmts: stmts}, nil
+}
+
+type includer struct {
+	load     SourceLoader
+	included map[string]struct{}
+}
+
+// parse returns the statements of fileName with its includes resolved.
+// open holds the files that are part way through being included.
+func (inc *includer) parse(fileName string, open []string) ([]ast.Stmt, error) {
+	src, err := inc.load(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read asm file: %w", err)
+	}
+	inc.included[fileName] = struct{}{}
+	tree, err := Parse(ParseContext{
+		FileName:       fileName,
+		RemainingInput: src,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	open = append(open, fileName)
+	stmts := []ast.Stmt{}
+	for _, stmt := range tree.Stmts {
+		if stmt.Include == nil {
+			stmts = append(stmts, stmt)
+			continue
+		}
+		path := stmt.Include.Path
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(fileName), path)
+		}
+		for i, openFile := range open {
+			if openFile == path {
+				chain := strings.Join(append(open[i:], path), " -> ")
+				return nil, fmt.Errorf("%s: %s; %w", stmt.Pos, chain, ErrIncludeCycle)
+			}
+		}
+		if _, done := inc.included[path]; done {
+			continue
+		}
+		included, err := inc.parse(path, open)
+		if err != nil {
+			return nil, fmt.Errorf("%s: in file included here: %w", stmt.Pos, err)
+		}
+		stmts = append(stmts, included...)
+	}
+	return stmts, nil
+}
@@ -1,51 +1,60 @@
 package parser
 
 import (
-	"errors"
-	"fmt"
-	"io"
-	"os"
+	"strings"
+	"unicode/utf8"
 
 	"github.com/johnny-morrice/learn/vmlang/asm/ast"
 )
 
-func ParseFile(fileName string) (ast.AST, error) {
-	file, err := os.Open(fileName)
-	if err != nil {
-		return ast.AST{}, fmt.Errorf("failed to open asm file: %s", err)
-	}
-	defer file.Close()
-	bs, err := io.ReadAll(file)
-	if err != nil {
-		return ast.AST{}, fmt.Errorf("failed to read asm file: %s", err)
-	}
-	pc := ParseContext{
-		FileName:       fileName,
-		RemainingInput: string(bs),
-	}
-	return Parse(pc)
-}
-
 type ParseContext struct {
-	FileName       string
-	Line           string
-	Char           string
+	FileName string
+	// Source is the complete input, used to find the line and column of RemainingInput.
+	Source         string
 	RemainingInput string
 	Failed         bool
 	IsCapturing    bool
 	CapturedText   string
 	ErrorMessage   string
 	Bldr           ast.Builder
+	// furthest collects the failures that got furthest through the input.
+	// It is shared between contexts so that backtracking does not lose it.
+	furthest *furthestFailure
+	// reported collects the errors of lines skipped by RecoverLine.
+	reported *SyntaxErrors
 }
 
 func Parse(pc ParseContext) (ast.AST, error) {
+	if pc.Source == "" {
+		pc.Source = pc.RemainingInput
+	}
+	pc.furthest = &furthestFailure{remaining: -1}
+	pc.reported = &SyntaxErrors{}
 	pc = AST()(pc)
 	if pc.Failed {
-		err := errors.New("parse error")
-		if pc.ErrorMessage != "" {
-			err = errors.New(pc.ErrorMessage)
-		}
-		return ast.AST{}, err
+		return ast.AST{}, SyntaxErrors{pc.syntaxError()}
+	}
+	if len(*pc.reported) > 0 {
+		return ast.AST{}, *pc.reported
 	}
 	return pc.Bldr.Build(), nil
 }
+
+// Pos finds the line and column of the start of RemainingInput.
+func (pc ParseContext) Pos() ast.Pos {
+	offset := len(pc.Source) - len(pc.RemainingInput)
+	if offset < 0 || pc.Source[offset:] != pc.RemainingInput {
+		return ast.Pos{File: pc.FileName}
+	}
+	return pc.posAt(offset)
+}
+
+func (pc ParseContext) posAt(offset int) ast.Pos {
+	consumed := pc.Source[:offset]
+	lineStart := strings.LastIndexByte(consumed, '\n') + 1
+	return ast.Pos{
+		File:   pc.FileName,
+		Line:   strings.Count(consumed, "\n") + 1,
+		Column: utf8.RuneCountInString(consumed[lineStart:]) + 1,
+	}
+}
@@ -2,13 +2,16 @@ package parser
 
 import (
 	"errors"
+	"fmt"
 	"reflect"
+	"strings"
 	"testing"
 
 	_ "embed"
 
 	"github.com/johnny-morrice/learn/vmlang/asm/ast"
 	"github.com/johnny-morrice/learn/vmlang/example"
+	"github.com/johnny-morrice/learn/vmlang/vm"
 )
 
 func TestParserCreatesAST(t *testing.T) {
@@ -26,6 +29,217 @@ func TestParserCreatesAST(t *testing.T) {
 			},
 			expectedAst: example.FactorialAst(),
 		},
+		"comments and blank lines": {
+			pCtx: ParseContext{
+				FileName:       "comments.vmsm",
+				RemainingInput: "; header\n\n# another\nstart: ; the start\n\n\tpush 1 # one\r\n  \n\toutd;\n  ; trailing",
+			},
+			expectedAst: ast.AST{
+				Stmts: []ast.Stmt{
+					{
+						Label: &ast.LabelStmt{Label: "start"},
+						Pos:   ast.Pos{File: "comments.vmsm", Line: 4, Column: 1},
+					},
+					{
+						Op:  &ast.OpStmt{Op: vm.Push, Params: []ast.Param{{Literal: 1}}},
+						Pos: ast.Pos{File: "comments.vmsm", Line: 6, Column: 2},
+					},
+					{
+						Op:  &ast.OpStmt{Op: vm.OutputDecimal},
+						Pos: ast.Pos{File: "comments.vmsm", Line: 8, Column: 2},
+					},
+				},
+			},
+		},
+		"string data containing comment characters": {
+			pCtx: ParseContext{
+				RemainingInput: `data msg "a;b#c" ; comment`,
+			},
+			expectedAst: ast.AST{
+				Stmts: []ast.Stmt{
+					{
+						Data: &ast.DataStmt{Name: "msg", Text: "a;b#c"},
+						Pos:  ast.Pos{Line: 1, Column: 1},
+					},
+				},
+			},
+		},
+		"constants, expressions and data directives": {
+			pCtx: ParseContext{
+				RemainingInput: "const SIZE = 2 * (4 + 0x0F) | 0b1\narray buf SIZE\nvar x = 'a'\nvar y z\npush buf+SIZE*2 '\\n' ( 1 << 2 )",
+			},
+			expectedAst: ast.AST{
+				Stmts: []ast.Stmt{
+					{
+						Const: &ast.ConstStmt{
+							Name: "SIZE",
+							Value: ast.BinaryExpr("|",
+								ast.BinaryExpr("*",
+									ast.Expr{Literal: 2},
+									ast.BinaryExpr("+", ast.Expr{Literal: 4}, ast.Expr{Literal: 15})),
+								ast.Expr{Literal: 1}),
+						},
+						Pos: ast.Pos{Line: 1, Column: 1},
+					},
+					{
+						Array: &ast.ArrayStmt{Name: "buf", Size: ast.Expr{Name: "SIZE"}},
+						Pos:   ast.Pos{Line: 2, Column: 1},
+					},
+					{
+						Var: &ast.VarStmt{VarNames: []string{"x"}, Init: &ast.Expr{Literal: 'a'}},
+						Pos: ast.Pos{Line: 3, Column: 1},
+					},
+					{
+						Var: &ast.VarStmt{VarNames: []string{"y", "z"}},
+						Pos: ast.Pos{Line: 4, Column: 1},
+					},
+					{
+						Op: &ast.OpStmt{
+							Op: vm.Push,
+							Params: []ast.Param{
+								ast.ParamFromExpr(ast.BinaryExpr("+",
+									ast.Expr{Name: "buf"},
+									ast.BinaryExpr("*", ast.Expr{Name: "SIZE"}, ast.Expr{Literal: 2}))),
+								{Literal: '\n'},
+								ast.ParamFromExpr(ast.BinaryExpr("<<", ast.Expr{Literal: 1}, ast.Expr{Literal: 2})),
+							},
+						},
+						Pos: ast.Pos{Line: 5, Column: 1},
+					},
+				},
+			},
+		},
+		"macro definition and call": {
+			pCtx: ParseContext{
+				RemainingInput: "macro load x\n\tpush x ; address\n\trmem\nendm\npushx 1\nload acc",
+			},
+			expectedAst: ast.AST{
+				Stmts: []ast.Stmt{
+					{
+						Macro: &ast.MacroStmt{
+							Name:   "load",
+							Params: []string{"x"},
+							Body: []ast.Stmt{
+								{
+									Op:  &ast.OpStmt{Op: vm.Push, Params: []ast.Param{{Variable: "x"}}},
+									Pos: ast.Pos{Line: 2, Column: 2},
+								},
+								{
+									Op:  &ast.OpStmt{Op: vm.ReadMemory},
+									Pos: ast.Pos{Line: 3, Column: 2},
+								},
+							},
+						},
+						Pos: ast.Pos{Line: 1, Column: 1},
+					},
+					{
+						MacroCall: &ast.MacroCallStmt{Name: "pushx", Args: []ast.Param{{Literal: 1}}},
+						Pos:       ast.Pos{Line: 5, Column: 1},
+					},
+					{
+						MacroCall: &ast.MacroCallStmt{Name: "load", Args: []ast.Param{{Variable: "acc"}}},
+						Pos:       ast.Pos{Line: 6, Column: 1},
+					},
+				},
+			},
+		},
+		"jump table": {
+			pCtx: ParseContext{
+				RemainingInput: "table ops add sub+2 ; comment\npush ops\ncalls\ngotos",
+			},
+			expectedAst: ast.AST{
+				Stmts: []ast.Stmt{
+					{
+						Table: &ast.TableStmt{
+							Name: "ops",
+							Entries: []ast.Expr{
+								{Name: "add"},
+								ast.BinaryExpr("+", ast.Expr{Name: "sub"}, ast.Expr{Literal: 2}),
+							},
+						},
+						Pos: ast.Pos{Line: 1, Column: 1},
+					},
+					{
+						Op:  &ast.OpStmt{Op: vm.Push, Params: []ast.Param{{Variable: "ops"}}},
+						Pos: ast.Pos{Line: 2, Column: 1},
+					},
+					{
+						Op:  &ast.OpStmt{Op: vm.CallIndirect},
+						Pos: ast.Pos{Line: 3, Column: 1},
+					},
+					{
+						Op:  &ast.OpStmt{Op: vm.GotoIndirect},
+						Pos: ast.Pos{Line: 4, Column: 1},
+					},
+				},
+			},
+		},
+		"stack ops": {
+			pCtx: ParseContext{
+				RemainingInput: "rot\nroll 2\npick n+1\ndropn 3",
+			},
+			expectedAst: ast.AST{
+				Stmts: []ast.Stmt{
+					{
+						Op:  &ast.OpStmt{Op: vm.Rotate},
+						Pos: ast.Pos{Line: 1, Column: 1},
+					},
+					{
+						Op:  &ast.OpStmt{Op: vm.Roll, Params: []ast.Param{{Literal: 2}}},
+						Pos: ast.Pos{Line: 2, Column: 1},
+					},
+					{
+						Op: &ast.OpStmt{Op: vm.Pick, Params: []ast.Param{
+							ast.ParamFromExpr(ast.BinaryExpr("+", ast.Expr{Name: "n"}, ast.Expr{Literal: 1})),
+						}},
+						Pos: ast.Pos{Line: 3, Column: 1},
+					},
+					{
+						Op:  &ast.OpStmt{Op: vm.DropN, Params: []ast.Param{{Literal: 3}}},
+						Pos: ast.Pos{Line: 4, Column: 1},
+					},
+				},
+			},
+		},
+		"locals": {
+			pCtx: ParseContext{
+				RemainingInput: "local n acc\nlload acc",
+			},
+			expectedAst: ast.AST{
+				Stmts: []ast.Stmt{
+					{
+						Local: &ast.LocalStmt{Names: []string{"n", "acc"}},
+						Pos:   ast.Pos{Line: 1, Column: 1},
+					},
+					{
+						Op:  &ast.OpStmt{Op: vm.LoadLocal, Params: []ast.Param{{Variable: "acc"}}},
+						Pos: ast.Pos{Line: 2, Column: 1},
+					},
+				},
+			},
+		},
+		"positions": {
+			pCtx: ParseContext{
+				FileName:       "pos.vmsm",
+				RemainingInput: "loop:\n\tpush 1\n  goto loop",
+			},
+			expectedAst: ast.AST{
+				Stmts: []ast.Stmt{
+					{
+						Label: &ast.LabelStmt{Label: "loop"},
+						Pos:   ast.Pos{File: "pos.vmsm", Line: 1, Column: 1},
+					},
+					{
+						Op:  &ast.OpStmt{Op: vm.Push, Params: []ast.Param{{Literal: 1}}},
+						Pos: ast.Pos{File: "pos.vmsm", Line: 2, Column: 2},
+					},
+					{
+						Op:  &ast.OpStmt{Op: vm.Goto, Params: []ast.Param{{Variable: "loop"}}},
+						Pos: ast.Pos{File: "pos.vmsm", Line: 3, Column: 3},
+					},
+				},
+			},
+		},
 	}
 
 	for name, tc := range testCases {
@@ -63,3 +277,218 @@ func min(x, y int) int {
 	}
 	return y
 }
+
+func TestParserRecognisesEveryOpName(t *testing.T) {
+	for _, op := range vm.Bytecodes() {
+		t.Run(op.String(), func(t *testing.T) {
+			actualAst, err := Parse(ParseContext{RemainingInput: op.String()})
+			if err != nil {
+				t.Fatalf("unexpected err: %s", err)
+			}
+			expectedAst := ast.AST{
+				Stmts: []ast.Stmt{{Op: &ast.OpStmt{Op: op}, Pos: ast.Pos{Line: 1, Column: 1}}},
+			}
+			if !reflect.DeepEqual(expectedAst, actualAst) {
+				t.Errorf("expected:\n%v\n\nactual:\n%v", expectedAst, actualAst)
+			}
+		})
+	}
+}
+
+func TestParserReportsSyntaxErrors(t *testing.T) {
+	type testCase struct {
+		input    string
+		expected SyntaxError
+	}
+
+	testCases := map[string]testCase{
+		"bad param": {
+			input: "push 4\npush @",
+			expected: SyntaxError{
+				File:     "test.vmsm",
+				Line:     2,
+				Column:   6,
+				Snippet:  "push @\n     ^",
+				Found:    `"@"`,
+				Expected: []string{`" "`, `"#"`, `"'"`, `"("`, `"0b"`, `"0x"`, `";"`, `"\n"`, `"\r\n"`, `"\t"`, "digit", "end of input", "letter"},
+			},
+		},
+		"bad character after name": {
+			input: "push 4\n\tfoo, acc",
+			expected: SyntaxError{
+				File:     "test.vmsm",
+				Line:     2,
+				Column:   5,
+				Snippet:  "\tfoo, acc\n\t   ^",
+				Found:    `","`,
+				Expected: []string{`" "`, `"#"`, `":"`, `";"`, `"\n"`, `"\r\n"`, `"\t"`, "digit", "end of input", "letter"},
+			},
+		},
+		"unterminated string": {
+			input: "data msg \"abc\npush 1",
+			expected: SyntaxError{
+				File:     "test.vmsm",
+				Line:     1,
+				Column:   14,
+				Snippet:  "data msg \"abc\n             ^",
+				Found:    `"\n"`,
+				Expected: []string{`"\""`, `"\\"`, "string character"},
+			},
+		},
+		"number out of range": {
+			input: "push 99999999999999999999",
+			expected: SyntaxError{
+				File:     "test.vmsm",
+				Line:     1,
+				Column:   26,
+				Snippet:  "push 99999999999999999999\n                         ^",
+				Found:    "end of input",
+				Expected: []string{"digit"},
+				Message:  `strconv.ParseUint: parsing "99999999999999999999": value out of range`,
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			_, err := Parse(ParseContext{FileName: "test.vmsm", RemainingInput: tc.input})
+			syntaxErr := &SyntaxError{}
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("expected SyntaxError but received: %v", err)
+			}
+			if !reflect.DeepEqual(&tc.expected, syntaxErr) {
+				t.Errorf("expected:\n%#v\n\nactual:\n%#v", &tc.expected, syntaxErr)
+			}
+		})
+	}
+}
+
+func TestParserReportsUnclosedMacro(t *testing.T) {
+	_, err := Parse(ParseContext{FileName: "test.vmsm", RemainingInput: "macro load x\n\tpush x\n"})
+	syntaxErr := &SyntaxError{}
+	if !errors.As(err, &syntaxErr) {
+		t.Fatalf("expected SyntaxError but received: %v", err)
+	}
+	expected := "macro load defined at test.vmsm:1:1 has no endm"
+	if syntaxErr.Line != 3 || syntaxErr.Message != expected {
+		t.Errorf("expected %q on line 3 but received %q on line %d", expected, syntaxErr.Message, syntaxErr.Line)
+	}
+}
+
+func TestSyntaxErrorMessage(t *testing.T) {
+	err := &SyntaxError{
+		File:     "test.vmsm",
+		Line:     2,
+		Column:   6,
+		Snippet:  "push @\n     ^",
+		Found:    `"@"`,
+		Expected: []string{"digit", "letter"},
+	}
+	expected := "test.vmsm:2:6: syntax error: found \"@\", expected one of: digit, letter\npush @\n     ^"
+	if err.Error() != expected {
+		t.Errorf("expected:\n%s\n\nactual:\n%s", expected, err.Error())
+	}
+}
+
+func TestParserReportsEverySyntaxError(t *testing.T) {
+	input := "push 1\npush @\npop\n\nfoo, bar\noutd ; fine\ndata x \"unterminated\n"
+	_, err := Parse(ParseContext{FileName: "many.vmsm", RemainingInput: input})
+
+	syntaxErrs := SyntaxErrors{}
+	if !errors.As(err, &syntaxErrs) {
+		t.Fatalf("expected SyntaxErrors but received: %v", err)
+	}
+	expectedPositions := [][2]int{{2, 6}, {5, 4}, {7, 21}}
+	if len(syntaxErrs) != len(expectedPositions) {
+		t.Fatalf("expected %d errors but received %d: %v", len(expectedPositions), len(syntaxErrs), err)
+	}
+	for i, pos := range expectedPositions {
+		actual := [2]int{syntaxErrs[i].Line, syntaxErrs[i].Column}
+		if pos != actual {
+			t.Errorf("expected error %d at %v but was at %v", i, pos, actual)
+		}
+	}
+
+	wrapped := fmt.Errorf("failed to parse: %w", err)
+	syntaxErr := &SyntaxError{}
+	if !errors.As(wrapped, &syntaxErr) || syntaxErr != syntaxErrs[0] {
+		t.Errorf("expected the first SyntaxError but received: %v", syntaxErr)
+	}
+	if !errors.Is(wrapped, syntaxErrs[1]) {
+		t.Errorf("expected err to match the second SyntaxError")
+	}
+}
+
+func TestParseFileWithIncludes(t *testing.T) {
+	files := map[string]string{
+		"main.vmsm":        "include \"lib/print.vmsm\"\ninclude \"common.vmsm\"\npush 1\n",
+		"common.vmsm":      "var shared\n",
+		"lib/print.vmsm":   "include \"../common.vmsm\"\nprint:\n\toutd\n",
+		"cycle/a.vmsm":     "include \"b.vmsm\"\n",
+		"cycle/b.vmsm":     "pop\ninclude \"a.vmsm\"\n",
+		"broken.vmsm":      "include \"bad.vmsm\"\n",
+		"bad.vmsm":         "push @\n",
+		"missing.vmsm":     "include \"nowhere.vmsm\"\n",
+		"selfinclude.vmsm": "include \"selfinclude.vmsm\"\n",
+	}
+	load := func(fileName string) (string, error) {
+		src, ok := files[fileName]
+		if !ok {
+			return "", fmt.Errorf("no such file: %s", fileName)
+		}
+		return src, nil
+	}
+
+	actualAst, err := ParseFileWith("main.vmsm", load)
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	expectedAst := ast.AST{
+		Stmts: []ast.Stmt{
+			{
+				Var: &ast.VarStmt{VarNames: []string{"shared"}},
+				Pos: ast.Pos{File: "common.vmsm", Line: 1, Column: 1},
+			},
+			{
+				Label: &ast.LabelStmt{Label: "print"},
+				Pos:   ast.Pos{File: "lib/print.vmsm", Line: 2, Column: 1},
+			},
+			{
+				Op:  &ast.OpStmt{Op: vm.OutputDecimal},
+				Pos: ast.Pos{File: "lib/print.vmsm", Line: 3, Column: 2},
+			},
+			{
+				Op:  &ast.OpStmt{Op: vm.Push, Params: []ast.Param{{Literal: 1}}},
+				Pos: ast.Pos{File: "main.vmsm", Line: 3, Column: 1},
+			},
+		},
+	}
+	if !reflect.DeepEqual(expectedAst, actualAst) {
+		t.Errorf("expected:\n%v\n\nactual:\n%v", expectedAst, actualAst)
+	}
+
+	_, err = ParseFileWith("cycle/a.vmsm", load)
+	if !errors.Is(err, ErrIncludeCycle) {
+		t.Errorf("expected ErrIncludeCycle but received: %v", err)
+	} else if !strings.Contains(err.Error(), "cycle/a.vmsm -> cycle/b.vmsm -> cycle/a.vmsm") {
+		t.Errorf("expected error to show the cycle but was: %s", err)
+	}
+
+	_, err = ParseFileWith("selfinclude.vmsm", load)
+	if !errors.Is(err, ErrIncludeCycle) {
+		t.Errorf("expected ErrIncludeCycle but received: %v", err)
+	}
+
+	_, err = ParseFileWith("broken.vmsm", load)
+	syntaxErr := &SyntaxError{}
+	if !errors.As(err, &syntaxErr) {
+		t.Errorf("expected SyntaxError but received: %v", err)
+	} else if syntaxErr.File != "bad.vmsm" || !strings.HasPrefix(err.Error(), "broken.vmsm:1:1: ") {
+		t.Errorf("expected error in bad.vmsm included from broken.vmsm but was: %s", err)
+	}
+
+	_, err = ParseFileWith("missing.vmsm", load)
+	if err == nil || !strings.Contains(err.Error(), "no such file: nowhere.vmsm") {
+		t.Errorf("expected missing file error but received: %v", err)
+	}
+}
@@ -0,0 +1,293 @@
+package debugger
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/johnny-morrice/learn/vmlang/disasm"
+	"github.com/johnny-morrice/learn/vmlang/vm"
+)
+
+const prompt = "(vmdb) "
+const defaultStackDepth = 10
+
+// Debugger reads commands from In and controls a VirtualMachine one instruction at a time.
+type Debugger struct {
+	VM          *vm.VirtualMachine
+	In          io.Reader
+	Out         io.Writer
+	breakpoints map[uint64]struct{}
+}
+
+func New(machine *vm.VirtualMachine, in io.Reader, out io.Writer) *Debugger {
+	return &Debugger{
+		VM:          machine,
+		In:          in,
+		Out:         out,
+		breakpoints: map[uint64]struct{}{},
+	}
+}
+
+// Run reads and executes commands until quit or the end of input.
+func (dbg *Debugger) Run() error {
+	scanner := bufio.NewScanner(dbg.In)
+	dbg.printf("%s\n", dbg.location())
+	for {
+		dbg.printf(prompt)
+		if !scanner.Scan() {
+			dbg.printf("\n")
+			return scanner.Err()
+		}
+		quit := dbg.Exec(scanner.Text())
+		if quit {
+			return nil
+		}
+	}
+}
+
+// Exec runs a single debugger command, returning true if the debugger should exit.
+func (dbg *Debugger) Exec(line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return false
+	}
+	cmd, args := fields[0], fields[1:]
+	var err error
+	switch cmd {
+	case "step", "s":
+		err = dbg.step(args)
+	case "continue", "c":
+		err = dbg.cont()
+	case "break", "b":
+		err = dbg.setBreakpoint(args)
+	case "delete", "d":
+		err = dbg.deleteBreakpoint(args)
+	case "breakpoints":
+		dbg.listBreakpoints()
+	case "stack":
+		err = dbg.stack(args)
+	case "mem", "m":
+		err = dbg.mem(args)
+	case "where", "ip":
+		dbg.printf("%s\n", dbg.location())
+	case "symbols":
+		dbg.symbols()
+	case "help", "h":
+		dbg.help()
+	case "quit", "q":
+		return true
+	default:
+		err = fmt.Errorf("unknown command: %s", cmd)
+	}
+	if err != nil {
+		dbg.printf("error: %s\n", err)
+	}
+	return false
+}
+
+func (dbg *Debugger) step(args []string) error {
+	count := uint64(1)
+	if len(args) > 0 {
+		n, err := strconv.ParseUint(args[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid step count: %s", args[0])
+		}
+		count = n
+	}
+	for i := uint64(0); i < count && !dbg.VM.Halted; i++ {
+		err := dbg.VM.Step()
+		if err != nil {
+			return err
+		}
+	}
+	dbg.printf("%s\n", dbg.location())
+	return nil
+}
+
+func (dbg *Debugger) cont() error {
+	for {
+		err := dbg.VM.Step()
+		if err != nil {
+			return err
+		}
+		if dbg.VM.Halted {
+			dbg.printf("%s\n", dbg.location())
+			return nil
+		}
+		if _, isBreak := dbg.breakpoints[dbg.VM.IP]; isBreak {
+			dbg.printf("breakpoint: %s\n", dbg.location())
+			return nil
+		}
+	}
+}
+
+func (dbg *Debugger) setBreakpoint(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: break <label|address>")
+	}
+	addr, err := dbg.resolve(args[0])
+	if err != nil {
+		return err
+	}
+	dbg.breakpoints[addr] = struct{}{}
+	dbg.printf("breakpoint at %s\n", dbg.describeAddress(addr))
+	return nil
+}
+
+func (dbg *Debugger) deleteBreakpoint(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: delete <label|address>")
+	}
+	addr, err := dbg.resolve(args[0])
+	if err != nil {
+		return err
+	}
+	if _, exists := dbg.breakpoints[addr]; !exists {
+		return fmt.Errorf("no breakpoint at %s", dbg.describeAddress(addr))
+	}
+	delete(dbg.breakpoints, addr)
+	return nil
+}
+
+func (dbg *Debugger) listBreakpoints() {
+	addrs := []uint64{}
+	for addr := range dbg.breakpoints {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+	for _, addr := range addrs {
+		dbg.printf("%s\n", dbg.describeAddress(addr))
+	}
+}
+
+// stack prints values from the top of the stack down.
+func (dbg *Debugger) stack(args []string) error {
+	depth := uint64(defaultStackDepth)
+	if len(args) > 0 {
+		n, err := strconv.ParseUint(args[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid stack depth: %s", args[0])
+		}
+		depth = n
+	}
+	machine := dbg.VM
+	if machine.SP <= machine.StackStart {
+		dbg.printf("stack is empty\n")
+		return nil
+	}
+	size := machine.SP - machine.StackStart
+	for i := uint64(0); i < size && i < depth; i++ {
+		addr := machine.SP - i
+		dbg.printf("%4d: %d\n", i, dbg.word(addr))
+	}
+	if size > depth {
+		dbg.printf("... %d more\n", size-depth)
+	}
+	return nil
+}
+
+func (dbg *Debugger) mem(args []string) error {
+	if len(args) == 0 || len(args) > 2 {
+		return errors.New("usage: mem <var|address> [count]")
+	}
+	addr, err := dbg.resolve(args[0])
+	if err != nil {
+		return err
+	}
+	count := uint64(1)
+	if len(args) == 2 {
+		count, err = strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid count: %s", args[1])
+		}
+	}
+	for i := uint64(0); i < count; i++ {
+		dbg.printf("%s: %d\n", dbg.describeAddress(addr+i), dbg.word(addr+i))
+	}
+	return nil
+}
+
+func (dbg *Debugger) symbols() {
+	for _, sym := range dbg.VM.Symbols {
+		dbg.printf("%-5s %6d %s\n", sym.Kind, sym.Address, sym.Name)
+	}
+}
+
+func (dbg *Debugger) help() {
+	dbg.printf(`commands:
+  step [n]                 execute n instructions (default 1)
+  continue                 run until a breakpoint or exit
+  break <label|address>    set a breakpoint
+  delete <label|address>   remove a breakpoint
+  breakpoints              list breakpoints
+  stack [n]                show the top n stack values (default 10)
+  mem <var|address> [n]    show n memory words (default 1)
+  where                    show the current instruction
+  symbols                  list labels and variables
+  quit                     exit the debugger
+`)
+}
+
+// resolve turns a symbol name or decimal address into an address.
+func (dbg *Debugger) resolve(name string) (uint64, error) {
+	if sym, ok := dbg.VM.LookupSymbol(name); ok {
+		return sym.Address, nil
+	}
+	addr, err := strconv.ParseUint(name, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unknown symbol: %s", name)
+	}
+	return addr, nil
+}
+
+func (dbg *Debugger) location() string {
+	machine := dbg.VM
+	if machine.Halted {
+		return fmt.Sprintf("halted at %s", dbg.describeAddress(machine.IP))
+	}
+	text := vm.Bytecode(dbg.word(machine.IP)).String()
+	if instr, err := disasm.Decode(machine.Memory, machine.IP); err == nil {
+		text = disasm.Format(machine, instr)
+	}
+	if loc, ok := machine.SourceLocation(machine.IP); ok {
+		return fmt.Sprintf("%s (%s): %s", dbg.describeAddress(machine.IP), loc, text)
+	}
+	return fmt.Sprintf("%s: %s", dbg.describeAddress(machine.IP), text)
+}
+
+// describeAddress shows an address along with the symbol it falls under.
+func (dbg *Debugger) describeAddress(addr uint64) string {
+	machine := dbg.VM
+	for _, sym := range machine.Symbols {
+		if sym.Kind != vm.LabelSymbol && sym.Address == addr {
+			return fmt.Sprintf("%d <%s>", addr, sym.Name)
+		}
+	}
+	if addr >= machine.CodeEnd && machine.CodeEnd != 0 {
+		return fmt.Sprint(addr)
+	}
+	label, ok := machine.NearestLabel(addr)
+	if !ok {
+		return fmt.Sprint(addr)
+	}
+	if label.Address == addr {
+		return fmt.Sprintf("%d <%s>", addr, label.Name)
+	}
+	return fmt.Sprintf("%d <%s+%d>", addr, label.Name, addr-label.Address)
+}
+
+func (dbg *Debugger) word(addr uint64) uint64 {
+	if addr >= uint64(len(dbg.VM.Memory)) {
+		return 0
+	}
+	return dbg.VM.Memory[addr]
+}
+
+func (dbg *Debugger) printf(format string, args ...any) {
+	fmt.Fprintf(dbg.Out, format, args...)
+}
@@ -0,0 +1,91 @@
+package debugger
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/johnny-morrice/learn/vmlang/asm"
+	"github.com/johnny-morrice/learn/vmlang/example"
+)
+
+func TestDebuggerSession(t *testing.T) {
+	type testCase struct {
+		commands       []string
+		expectedLines  []string
+		expectedOutput string
+	}
+
+	testCases := map[string]testCase{
+		"break on label": {
+			commands: []string{"break body", "continue", "stack", "mem acc"},
+			expectedLines: []string{
+				"breakpoint at 10 <body>",
+				"breakpoint: 10 <body> (fac.vmsm:10:1): dupl",
+				"   0: 3",
+				"2000226 <acc>: 4",
+			},
+		},
+		"step": {
+			commands: []string{"step 2", "where", "stack"},
+			expectedLines: []string{
+				"4 (fac.vmsm:4:1): wmem",
+				"   0: 2000226",
+				"   1: 4",
+			},
+		},
+		"continue to exit": {
+			commands:       []string{"continue", "stack"},
+			expectedLines:  []string{"halted at 25 <output+4>", "   0: 24"},
+			expectedOutput: "24",
+		},
+		"delete breakpoint": {
+			commands:       []string{"b fac", "d fac", "breakpoints", "c"},
+			expectedLines:  []string{"halted at 25 <output+4>"},
+			expectedOutput: "24",
+		},
+		"unknown symbol": {
+			commands:      []string{"break nowhere"},
+			expectedLines: []string{"error: unknown symbol: nowhere"},
+		},
+		"quit": {
+			commands:      []string{"quit", "continue"},
+			expectedLines: []string{"0 (fac.vmsm:2:1): push 4\n"},
+		},
+		"names operands": {
+			commands: []string{"step", "step 3"},
+			expectedLines: []string{
+				"2 (fac.vmsm:3:1): push acc\n",
+				"6 <fac+1> (fac.vmsm:7:1): jnz body\n",
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			machine, err := asm.Assemble(example.FactorialAst())
+			if err != nil {
+				t.Fatalf("unexpected assemble err: %s", err)
+			}
+			programOutput := &bytes.Buffer{}
+			machine.Output = programOutput
+			in := strings.NewReader(strings.Join(tc.commands, "\n"))
+			out := &bytes.Buffer{}
+
+			err = New(machine, in, out).Run()
+			if err != nil {
+				t.Fatalf("unexpected debugger err: %s", err)
+			}
+
+			transcript := out.String()
+			for _, line := range tc.expectedLines {
+				if !strings.Contains(transcript, line) {
+					t.Errorf("expected transcript to contain %q\ntranscript:\n%s", line, transcript)
+				}
+			}
+			if tc.expectedOutput != programOutput.String() {
+				t.Errorf("expected program output: %q but was: %q", tc.expectedOutput, programOutput.String())
+			}
+		})
+	}
+}
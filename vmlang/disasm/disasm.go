@@ -0,0 +1,365 @@
+package disasm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/johnny-morrice/learn/vmlang/vm"
+)
+
+// Instruction is a decoded bytecode and its operands.
+type Instruction struct {
+	Address  uint64
+	Op       vm.Bytecode
+	Operands []uint64
+}
+
+func (instr Instruction) String() string {
+	builder := strings.Builder{}
+	builder.WriteString(instr.Op.String())
+	for _, operand := range instr.Operands {
+		builder.WriteString(" ")
+		builder.WriteString(fmt.Sprint(operand))
+	}
+	return builder.String()
+}
+
+// Size is the number of words the instruction takes in memory.
+func (instr Instruction) Size() uint64 {
+	return 1 + uint64(len(instr.Operands))
+}
+
+// Decode reads the instruction at addr.
+func Decode(memory []uint64, addr uint64) (Instruction, error) {
+	if addr >= uint64(len(memory)) {
+		return Instruction{}, fmt.Errorf("address %d outside memory; %w", addr, vm.ErrMemoryOutOfBounds)
+	}
+	op := vm.Bytecode(memory[addr])
+	if !op.IsValid() {
+		return Instruction{}, fmt.Errorf("bytecode %d at address %d; %w", memory[addr], addr, vm.ErrUnknownBytecode)
+	}
+	count := uint64(op.OperandCount())
+	if addr+count >= uint64(len(memory)) {
+		return Instruction{}, fmt.Errorf("operands of %s at address %d outside memory; %w", op, addr, vm.ErrMemoryOutOfBounds)
+	}
+	return Instruction{
+		Address:  addr,
+		Op:       op,
+		Operands: memory[addr+1 : addr+1+count],
+	}, nil
+}
+
+// Instructions decodes the code segment of a machine.
+func Instructions(machine *vm.VirtualMachine) ([]Instruction, error) {
+	if machine.CodeEnd == 0 {
+		return nil, errors.New("machine has no code segment")
+	}
+	code := machine.Memory
+	if machine.CodeEnd < uint64(len(code)) {
+		code = code[:machine.CodeEnd]
+	}
+	instrs := []Instruction{}
+	for addr := uint64(0); addr < machine.CodeEnd; {
+		instr, err := Decode(code, addr)
+		if err != nil {
+			return nil, err
+		}
+		instrs = append(instrs, instr)
+		addr += instr.Size()
+	}
+	return instrs, nil
+}
+
+// Disassemble writes the machine's program as asm source. Each instruction
+// is followed by a comment giving its address. With a symbol table, labels
+// and names of variables and data replace addresses, and the heap is
+// written as var, data and array statements, so that assembling the output
+// gives back the same image.
+func Disassemble(w io.Writer, machine *vm.VirtualMachine) error {
+	instrs, err := Instructions(machine)
+	if err != nil {
+		return err
+	}
+	d := newDisassembler(machine, w)
+	d.writeHeap()
+	// The assembler ends every program with an exit, which would be doubled
+	// if it were written out.
+	last := len(instrs) - 1
+	finalExit := last >= 0 && instrs[last].Op == vm.Exit
+	if finalExit {
+		instrs = instrs[:last]
+	}
+	for i, instr := range instrs {
+		d.writeLabels(instr.Address)
+		target := i+1 < len(instrs) && isIndirect(instrs[i+1].Op)
+		d.writeInstruction(instr, target)
+	}
+	if finalExit {
+		d.writeLabels(machine.CodeEnd - 1)
+	}
+	return d.err
+}
+
+// Format writes an instruction of the machine's program as Disassemble
+// would, naming its operands through the symbol table.
+func Format(machine *vm.VirtualMachine, instr Instruction) string {
+	d := newDisassembler(machine, io.Discard)
+	next, err := Decode(machine.Memory, instr.Address+instr.Size())
+	target := err == nil && isIndirect(next.Op)
+	return d.format(instr, target)
+}
+
+// sourceNames renames symbols that could not be written in source, such
+// as labels renamed by macro expansion. A name the linker qualified with
+// its unit keeps the name from its source when no other symbol has it,
+// with a number added otherwise.
+func sourceNames(syms []vm.Symbol) []vm.Symbol {
+	used := map[string]bool{}
+	for _, sym := range syms {
+		if isName(sym.Name) {
+			used[sym.Name] = false
+		}
+	}
+	renamed := make([]vm.Symbol, len(syms))
+	for i, sym := range syms {
+		taken, valid := used[sym.Name]
+		if valid && !taken {
+			used[sym.Name] = true
+			renamed[i] = sym
+			continue
+		}
+		if name, ok := unqualifiedName(sym.Name, used); ok {
+			used[name] = true
+			sym.Name = name
+			renamed[i] = sym
+			continue
+		}
+		name := fmt.Sprintf("L%d", sym.Address)
+		for n := 1; ; n++ {
+			if _, exists := used[name]; !exists {
+				break
+			}
+			name = fmt.Sprintf("L%dn%d", sym.Address, n)
+		}
+		used[name] = true
+		sym.Name = name
+		renamed[i] = sym
+	}
+	return renamed
+}
+
+// unqualifiedName drops the unit from a name qualified by the linker,
+// numbering it if another symbol has the name.
+func unqualifiedName(qualified string, used map[string]bool) (string, bool) {
+	at := strings.IndexByte(qualified, '@')
+	if at < 0 || !isName(qualified[:at]) {
+		return "", false
+	}
+	base := qualified[:at]
+	name := base
+	for n := 2; ; n++ {
+		if _, exists := used[name]; !exists {
+			return name, true
+		}
+		name = fmt.Sprintf("%s%d", base, n)
+	}
+}
+
+// isName matches the names accepted by the parser.
+func isName(name string) bool {
+	for i, r := range name {
+		if !unicode.IsLetter(r) && (i == 0 || !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return name != ""
+}
+
+type disassembler struct {
+	machine  *vm.VirtualMachine
+	labels   map[uint64][]string
+	heapSyms []vm.Symbol
+	out      io.Writer
+	err      error
+}
+
+func newDisassembler(machine *vm.VirtualMachine, w io.Writer) *disassembler {
+	d := &disassembler{
+		machine: machine,
+		labels:  map[uint64][]string{},
+		out:     w,
+	}
+	for _, sym := range sourceNames(machine.Symbols) {
+		if sym.Kind == vm.LabelSymbol {
+			d.labels[sym.Address] = append(d.labels[sym.Address], sym.Name)
+		} else {
+			d.heapSyms = append(d.heapSyms, sym)
+		}
+	}
+	sort.SliceStable(d.heapSyms, func(i, j int) bool {
+		return d.heapSyms[i].Address < d.heapSyms[j].Address
+	})
+	return d
+}
+
+func (d *disassembler) printf(format string, args ...any) {
+	if d.err != nil {
+		return
+	}
+	_, d.err = fmt.Fprintf(d.out, format, args...)
+}
+
+// writeHeap declares the variables and data blocks in address order, as
+// that is the order the assembler lays them out in.
+func (d *disassembler) writeHeap() {
+	for i, sym := range d.heapSyms {
+		end := uint64(len(d.machine.Memory))
+		if i+1 < len(d.heapSyms) {
+			end = d.heapSyms[i+1].Address
+		}
+		block := d.words(sym.Address, end)
+		switch {
+		case sym.Kind == vm.VarSymbol && len(block) > 0 && block[0] != 0:
+			d.printf("var %s = %d\n", sym.Name, block[0])
+		case sym.Kind == vm.VarSymbol:
+			d.printf("var %s\n", sym.Name)
+		default:
+			d.writeData(sym.Name, block)
+		}
+	}
+	if len(d.heapSyms) > 0 {
+		d.printf("\n")
+	}
+}
+
+// writeData writes a data block as a string if it holds one, as a table if
+// it holds only the addresses of labels, or as an array.
+func (d *disassembler) writeData(name string, block []uint64) {
+	if text, ok := blockText(block); ok {
+		d.printf("data %s %s\n", name, strconv.Quote(text))
+		return
+	}
+	if labels, ok := d.blockLabels(block); ok {
+		d.printf("table %s %s\n", name, strings.Join(labels, " "))
+		return
+	}
+	d.printf("array %s %d\n", name, len(block))
+	for i, word := range block {
+		if word != 0 {
+			d.printf("; %s+%d = %d is not restored\n", name, i, word)
+		}
+	}
+}
+
+// blockText decodes a length word followed by one byte per word.
+func blockText(block []uint64) (string, bool) {
+	if len(block) == 0 || block[0] != uint64(len(block)-1) {
+		return "", false
+	}
+	bs := make([]byte, 0, len(block)-1)
+	for _, word := range block[1:] {
+		if word > 0xFF {
+			return "", false
+		}
+		bs = append(bs, byte(word))
+	}
+	return string(bs), true
+}
+
+// blockLabels names each word of a block by a label at that address. A
+// block of zeros is left as an array, even when address 0 has a label.
+func (d *disassembler) blockLabels(block []uint64) ([]string, bool) {
+	zeros := true
+	labels := []string{}
+	for _, word := range block {
+		zeros = zeros && word == 0
+		names := d.labels[word]
+		if len(names) == 0 {
+			return nil, false
+		}
+		labels = append(labels, names[0])
+	}
+	return labels, !zeros
+}
+
+func (d *disassembler) words(start, end uint64) []uint64 {
+	memSize := uint64(len(d.machine.Memory))
+	if start > memSize {
+		start = memSize
+	}
+	if end > memSize {
+		end = memSize
+	}
+	return d.machine.Memory[start:end]
+}
+
+func (d *disassembler) writeLabels(addr uint64) {
+	for _, label := range d.labels[addr] {
+		d.printf("%s:\n", label)
+	}
+}
+
+// isIndirect reports whether op jumps to an address popped from the stack.
+func isIndirect(op vm.Bytecode) bool {
+	return op == vm.GotoIndirect || op == vm.CallIndirect
+}
+
+// writeInstruction writes an instruction followed by its address and source.
+func (d *disassembler) writeInstruction(instr Instruction, target bool) {
+	comment := fmt.Sprint(instr.Address)
+	if loc, ok := d.machine.SourceLocation(instr.Address); ok {
+		comment += " " + loc.String()
+	}
+	d.printf("%-24s ; %s\n", "\t"+d.format(instr, target), comment)
+}
+
+// format names the operands of an instruction. When target is set the
+// value it pushes is the target of the indirect jump that follows, so it is
+// named by its label.
+func (d *disassembler) format(instr Instruction, target bool) string {
+	builder := strings.Builder{}
+	builder.WriteString(instr.Op.String())
+	info, _ := instr.Op.Info()
+	for i, operand := range instr.Operands {
+		kind := info.Operands[i]
+		if target && instr.Op == vm.Push {
+			kind = vm.CodeOperand
+		}
+		builder.WriteString(" ")
+		builder.WriteString(d.operand(kind, operand))
+	}
+	return builder.String()
+}
+
+// operand names a jump target by its label and a pushed heap address by
+// the variable or data block holding it.
+func (d *disassembler) operand(kind vm.OperandKind, operand uint64) string {
+	if kind == vm.CodeOperand {
+		if labels := d.labels[operand]; len(labels) > 0 {
+			return labels[0]
+		}
+		return fmt.Sprint(operand)
+	}
+	if operand < d.machine.HeapStart {
+		return fmt.Sprint(operand)
+	}
+	for i := len(d.heapSyms) - 1; i >= 0; i-- {
+		sym := d.heapSyms[i]
+		if sym.Address > operand {
+			continue
+		}
+		if sym.Address == operand {
+			return sym.Name
+		}
+		if sym.Kind == vm.DataSymbol {
+			return fmt.Sprintf("%s+%d", sym.Name, operand-sym.Address)
+		}
+		break
+	}
+	return fmt.Sprint(operand)
+}
@@ -0,0 +1,250 @@
+package disasm
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/johnny-morrice/learn/vmlang/asm"
+	"github.com/johnny-morrice/learn/vmlang/asm/macro"
+	"github.com/johnny-morrice/learn/vmlang/asm/parser"
+	"github.com/johnny-morrice/learn/vmlang/example"
+	"github.com/johnny-morrice/learn/vmlang/vm"
+)
+
+func assemble(t *testing.T, sources ...string) *vm.VirtualMachine {
+	t.Helper()
+	objs := []*asm.Object{}
+	for _, src := range sources {
+		tree, err := parser.Parse(parser.ParseContext{RemainingInput: src})
+		if err != nil {
+			t.Fatalf("unexpected parse err: %s\n%s", err, src)
+		}
+		tree, err = macro.Expand(tree)
+		if err != nil {
+			t.Fatalf("unexpected expand err: %s", err)
+		}
+		obj, err := asm.AssembleObject(tree)
+		if err != nil {
+			t.Fatalf("unexpected assemble err: %s\n%s", err, src)
+		}
+		objs = append(objs, obj)
+	}
+	machine, err := asm.Link(objs...)
+	if err != nil {
+		t.Fatalf("unexpected link err: %s", err)
+	}
+	return machine
+}
+
+func disassemble(t *testing.T, machine *vm.VirtualMachine) string {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	err := Disassemble(buf, machine)
+	if err != nil {
+		t.Fatalf("unexpected disassemble err: %s", err)
+	}
+	return buf.String()
+}
+
+func TestDisassembleRoundTrip(t *testing.T) {
+	type testCase struct {
+		sources []string
+	}
+
+	testCases := map[string]testCase{
+		"factorial": {
+			sources: []string{example.FactorialSourceCode},
+		},
+		"factorial with macros": {
+			sources: []string{example.FactorialMacroSourceCode},
+		},
+		"recursive factorial": {
+			sources: []string{example.FactorialRecursiveSourceCode},
+		},
+		"linked list": {
+			sources: []string{example.LinkedListSourceCode},
+		},
+		"data and arrays": {
+			sources: []string{`var x = 7
+var y
+data msg "hi\n\"there\"\x00"
+array buf 3
+const N = 2
+start:
+	push msg+1
+	push buf+N
+	push x
+	jnz start
+	call sub
+	exit
+sub:
+	rtn
+`},
+		},
+		"jump tables": {
+			sources: []string{`table ops double square
+	push 3
+	push ops+1
+	rmem
+	calls
+	push double
+	calls
+	outd
+	exit
+double:
+	dupl
+	add
+	rtn
+square:
+	dupl
+	mult
+	rtn
+`},
+		},
+		"stack ops": {
+			sources: []string{`const N = 2
+	push 1
+	push 2
+	push 3
+	swap
+	over
+	rot
+	pick N
+	roll N+1
+	dropn 4
+	outd
+	exit
+`},
+		},
+		"macro labels": {
+			sources: []string{"macro spin\nloop:\n\tgoto loop\nendm\nspin\nspin\n"},
+		},
+		"linked objects with the same local names": {
+			sources: []string{
+				"import f\nvar v = 1\nloop:\n\tcall f\n\tgoto loop\n",
+				"export f\nvar v = 2\nf:\nloop:\n\tpush v\n\tjnz loop\n\trtn\n",
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			expected := assemble(t, tc.sources...)
+			src := disassemble(t, expected)
+			actual := assemble(t, src)
+			if !reflect.DeepEqual(expected.Memory, actual.Memory) {
+				t.Errorf("expected memory of reassembled program to match\nsource:\n%s", src)
+			}
+			if len(expected.Symbols) != len(actual.Symbols) {
+				t.Errorf("expected %d symbols but reassembled program has %d", len(expected.Symbols), len(actual.Symbols))
+			}
+		})
+	}
+}
+
+func TestDisassembleNames(t *testing.T) {
+	machine := assemble(t, "var acc\ndata msg \"ok\"\nloop:\n\tpush msg+2\n\tpush acc\n\tjnz loop\n")
+	expected := "var acc\n" +
+		"data msg \"ok\"\n" +
+		"\n" +
+		"loop:\n" +
+		"\tpush msg+2              ; 0 4:2\n" +
+		"\tpush acc                ; 2 5:2\n" +
+		"\tjnz loop                ; 4 6:2\n"
+	actual := disassemble(t, machine)
+	if expected != actual {
+		t.Errorf("expected:\n%s\n\nactual:\n%s", expected, actual)
+	}
+}
+
+func TestDisassembleLinkedNames(t *testing.T) {
+	machine := assemble(t,
+		"import f\nvar v = 1\nloop:\n\tcall f\n\tgoto loop\n",
+		"export f\nvar v = 2\nf:\nloop:\n\tpush v\n\tjnz loop\n\trtn\n")
+	src := disassemble(t, machine)
+	for _, expected := range []string{"var v = 1\n", "var v2 = 2\n", "\tgoto loop ", "loop2:\n", "\tpush v2 "} {
+		if !strings.Contains(src, expected) {
+			t.Errorf("expected disassembly to contain %q but was:\n%s", expected, src)
+		}
+	}
+}
+
+func TestDisassembleJumpTable(t *testing.T) {
+	machine := assemble(t, "table jumps a b\narray zeros 2\nstart:\n\tpush a\n\tgotos\na:\n\tpush 2\nb:\n\tpush 2\n")
+	src := disassemble(t, machine)
+	for _, expected := range []string{"table jumps a b\n", "array zeros 2\n", "\tpush a "} {
+		if !strings.Contains(src, expected) {
+			t.Errorf("expected disassembly to contain %q but was:\n%s", expected, src)
+		}
+	}
+	if strings.Contains(src, "push b") {
+		t.Errorf("expected push not followed by an indirect jump to keep its number but was:\n%s", src)
+	}
+}
+
+func TestDisassembleWithoutSymbols(t *testing.T) {
+	machine := assemble(t, "var acc\nloop:\n\tpush acc\n\tgoto loop\n")
+	machine.Symbols = nil
+	src := disassemble(t, machine)
+	if strings.Contains(src, "acc") || strings.Contains(src, "loop") {
+		t.Errorf("expected numeric operands without a symbol table but was:\n%s", src)
+	}
+	actual := assemble(t, src)
+	if !reflect.DeepEqual(machine.Memory[:machine.CodeEnd], actual.Memory[:actual.CodeEnd]) {
+		t.Errorf("expected reassembled code to match\nsource:\n%s", src)
+	}
+}
+
+func TestFormat(t *testing.T) {
+	machine := assemble(t, "var acc\nstart:\n\tpush acc\n\tpush a\n\tgotos\na:\n\tjnz start\n")
+	instrs, err := Instructions(machine)
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	expected := []string{"push acc", "push a", "gotos", "jnz start", "exit"}
+	if len(instrs) != len(expected) {
+		t.Fatalf("expected %d instructions but was: %v", len(expected), instrs)
+	}
+	for i, instr := range instrs {
+		actual := Format(machine, instr)
+		if expected[i] != actual {
+			t.Errorf("expected instruction %d: %q but was: %q", i, expected[i], actual)
+		}
+	}
+}
+
+func TestInstructions(t *testing.T) {
+	machine := &vm.VirtualMachine{
+		Memory:  []uint64{uint64(vm.Push), 5, uint64(vm.Duplicate), uint64(vm.Goto), 0, uint64(vm.Exit)},
+		CodeEnd: 6,
+	}
+	expected := []Instruction{
+		{Address: 0, Op: vm.Push, Operands: []uint64{5}},
+		{Address: 2, Op: vm.Duplicate, Operands: []uint64{}},
+		{Address: 3, Op: vm.Goto, Operands: []uint64{0}},
+		{Address: 5, Op: vm.Exit, Operands: []uint64{}},
+	}
+	actual, err := Instructions(machine)
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected: %v\nactual: %v", expected, actual)
+	}
+
+	machine.Memory[2] = 999
+	_, err = Instructions(machine)
+	if !errors.Is(err, vm.ErrUnknownBytecode) {
+		t.Errorf("expected ErrUnknownBytecode but received: %v", err)
+	}
+
+	machine.Memory = []uint64{uint64(vm.Push)}
+	machine.CodeEnd = 1
+	_, err = Instructions(machine)
+	if !errors.Is(err, vm.ErrMemoryOutOfBounds) {
+		t.Errorf("expected ErrMemoryOutOfBounds but received: %v", err)
+	}
+}
@@ -10,107 +10,134 @@ import (
 //go:embed asm/fac.vmsm
 var FactorialSourceCode string
 
+//go:embed asm/fac_macro.vmsm
+var FactorialMacroSourceCode string
+
+//go:embed asm/fac_rec.vmsm
+var FactorialRecursiveSourceCode string
+
 func FactorialAst() ast.AST {
 	return ast.AST{
 		Stmts: []ast.Stmt{
 			{
 				Var: &ast.VarStmt{
-					[]string{"acc"},
+					VarNames: []string{"acc"},
 				},
+				Pos: ast.Pos{File: "fac.vmsm", Line: 1, Column: 1},
 			},
 			{
 				Op: &ast.OpStmt{
 					vm.Push, []ast.Param{{Literal: 4}},
 				},
+				Pos: ast.Pos{File: "fac.vmsm", Line: 2, Column: 1},
 			},
 			{
 				Op: &ast.OpStmt{
 					vm.Push, []ast.Param{{Variable: "acc"}},
 				},
+				Pos: ast.Pos{File: "fac.vmsm", Line: 3, Column: 1},
 			},
 			{
 				Op: &ast.OpStmt{
 					Op: vm.WriteMemory,
 				},
+				Pos: ast.Pos{File: "fac.vmsm", Line: 4, Column: 1},
 			},
 			{
 				Label: &ast.LabelStmt{"fac"},
+				Pos:   ast.Pos{File: "fac.vmsm", Line: 5, Column: 1},
 			},
 			{
 				Op: &ast.OpStmt{
 					Op: vm.Decrement,
 				},
+				Pos: ast.Pos{File: "fac.vmsm", Line: 6, Column: 1},
 			},
 			{
 				Op: &ast.OpStmt{
 					vm.JumpNotZero, []ast.Param{{Variable: "body"}},
 				},
+				Pos: ast.Pos{File: "fac.vmsm", Line: 7, Column: 1},
 			},
 			{
 				Op: &ast.OpStmt{
 					vm.Goto, []ast.Param{{Variable: "output"}},
 				},
+				Pos: ast.Pos{File: "fac.vmsm", Line: 8, Column: 1},
 			},
 			{
 				Label: &ast.LabelStmt{"body"},
+				Pos:   ast.Pos{File: "fac.vmsm", Line: 9, Column: 1},
 			},
 			{
 				Op: &ast.OpStmt{
 					Op: vm.Duplicate,
 				},
+				Pos: ast.Pos{File: "fac.vmsm", Line: 10, Column: 1},
 			},
 			{
 				Op: &ast.OpStmt{
 					vm.Push, []ast.Param{{Variable: "acc"}},
 				},
+				Pos: ast.Pos{File: "fac.vmsm", Line: 11, Column: 1},
 			},
 			{
 				Op: &ast.OpStmt{
 					Op: vm.ReadMemory,
 				},
+				Pos: ast.Pos{File: "fac.vmsm", Line: 12, Column: 1},
 			},
 			{
 				Op: &ast.OpStmt{
 					Op: vm.Multiply,
 				},
+				Pos: ast.Pos{File: "fac.vmsm", Line: 13, Column: 1},
 			},
 			{
 				Op: &ast.OpStmt{
 					vm.Push, []ast.Param{{Variable: "acc"}},
 				},
+				Pos: ast.Pos{File: "fac.vmsm", Line: 14, Column: 1},
 			},
 			{
 				Op: &ast.OpStmt{
 					Op: vm.WriteMemory,
 				},
+				Pos: ast.Pos{File: "fac.vmsm", Line: 15, Column: 1},
 			},
 			{
 				Op: &ast.OpStmt{
 					Op: vm.Pop,
 				},
+				Pos: ast.Pos{File: "fac.vmsm", Line: 16, Column: 1},
 			},
 			{
 				Op: &ast.OpStmt{
 					vm.Goto, []ast.Param{{Variable: "fac"}},
 				},
+				Pos: ast.Pos{File: "fac.vmsm", Line: 17, Column: 1},
 			},
 			{
 				Label: &ast.LabelStmt{"output"},
+				Pos:   ast.Pos{File: "fac.vmsm", Line: 18, Column: 1},
 			},
 			{
 				Op: &ast.OpStmt{
 					vm.Push, []ast.Param{{Variable: "acc"}},
 				},
+				Pos: ast.Pos{File: "fac.vmsm", Line: 19, Column: 1},
 			},
 			{
 				Op: &ast.OpStmt{
 					Op: vm.ReadMemory,
 				},
+				Pos: ast.Pos{File: "fac.vmsm", Line: 20, Column: 1},
 			},
 			{
 				Op: &ast.OpStmt{
-					Op: vm.OutputByte,
+					Op: vm.OutputDecimal,
 				},
+				Pos: ast.Pos{File: "fac.vmsm", Line: 21, Column: 1},
 			},
 		},
 	}
@@ -0,0 +1,8 @@
+package example
+
+import (
+	_ "embed"
+)
+
+//go:embed asm/list.vmsm
+var LinkedListSourceCode string
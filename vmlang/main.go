@@ -1,17 +1,47 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/johnny-morrice/learn/vmlang/asm"
+	"github.com/johnny-morrice/learn/vmlang/asm/ast"
+	"github.com/johnny-morrice/learn/vmlang/asm/macro"
 	"github.com/johnny-morrice/learn/vmlang/asm/parser"
+	"github.com/johnny-morrice/learn/vmlang/debugger"
+	"github.com/johnny-morrice/learn/vmlang/disasm"
+	"github.com/johnny-morrice/learn/vmlang/profile"
+	"github.com/johnny-morrice/learn/vmlang/trace"
+	"github.com/johnny-morrice/learn/vmlang/verify"
+	"github.com/johnny-morrice/learn/vmlang/vm"
 )
 
 var asmInput = flag.String("run-asm", "", "run asm file")
-var byteToDec = flag.Bool("byte2dec", false, "make output bytes human readable")
+var compileInput = flag.String("compile", "", "compile asm file to bytecode")
+var objectInput = flag.String("object", "", "assemble asm file to a relocatable object")
+var linkInput = flag.String("link", "", "comma separated object or asm files to link into bytecode, starting with the entry point")
+var compileOutput = flag.String("out", "", "output file for -compile, -object, -link, -disasm or -snapshot-at (default: first input with .vmbc, .vmo or .vmss extension, or stdout for -disasm)")
+var bytecodeInput = flag.String("run-bytecode", "", "run bytecode file")
+var programInput = flag.String("input", "", "file to use as program input (default: stdin, or no input when debugging)")
+var debugInput = flag.String("debug", "", "debug asm file")
+var disasmInput = flag.String("disasm", "", "disassemble bytecode or asm file to asm source")
+var maxSteps = flag.Uint64("max-steps", 0, "stop the program after this many instructions (default: no limit)")
+var maxMemory = flag.Uint64("max-memory", 0, "limit the program's memory to this many words (default: vm.DefaultMaxMemory)")
+var heapDebug = flag.Bool("heap-debug", false, "check alloc and free for double frees and the program's memory accesses for use after free")
+var timeout = flag.Duration("timeout", 0, "stop the program after this long (default: no limit)")
+var profileReport = flag.Bool("profile", false, "print a report of where the program spent its instructions to stderr")
+var pprofOutput = flag.String("pprof", "", "write a profile of the program in pprof format to this file")
+var traceOutput = flag.String("trace", "", "write a JSON record of every instruction executed to this file, one per line")
+var optimise = flag.Bool("optimise", false, "run the peephole optimiser when assembling asm files")
+var verifyInput = flag.String("verify", "", "check bytecode or asm file for bad jumps, stack underflow and unreachable code")
+var snapshotAt = flag.Uint64("snapshot-at", 0, "stop the program after this many instructions and save its state to a snapshot file named by -out")
+var resumeInput = flag.String("resume", "", "resume running a snapshot file, skipping the bytes it had already read from -input")
 
 func main() {
 	flag.Parse()
@@ -21,40 +51,287 @@ func main() {
 			fmt.Printf("error running asm: %s", err)
 			os.Exit(1)
 		}
+	} else if *compileInput != "" {
+		err := compileAsm()
+		if err != nil {
+			fmt.Printf("error compiling asm: %s", err)
+			os.Exit(1)
+		}
+	} else if *objectInput != "" {
+		err := assembleObject()
+		if err != nil {
+			fmt.Printf("error assembling object: %s", err)
+			os.Exit(1)
+		}
+	} else if *linkInput != "" {
+		err := linkObjects()
+		if err != nil {
+			fmt.Printf("error linking: %s", err)
+			os.Exit(1)
+		}
+	} else if *bytecodeInput != "" {
+		err := runBytecode()
+		if err != nil {
+			fmt.Printf("error running bytecode: %s", err)
+			os.Exit(1)
+		}
+	} else if *debugInput != "" {
+		err := debugAsm()
+		if err != nil {
+			fmt.Printf("error debugging asm: %s", err)
+			os.Exit(1)
+		}
+	} else if *disasmInput != "" {
+		err := disassemble()
+		if err != nil {
+			fmt.Printf("error disassembling: %s", err)
+			os.Exit(1)
+		}
+	} else if *resumeInput != "" {
+		err := resumeSnapshot()
+		if err != nil {
+			fmt.Printf("error resuming snapshot: %s", err)
+			os.Exit(1)
+		}
+	} else if *verifyInput != "" {
+		err := verifyProgram()
+		if err != nil {
+			fmt.Printf("error verifying: %s", err)
+			os.Exit(1)
+		}
 	} else {
 		flag.Usage()
 	}
 }
 
 func runAsm() error {
-	ast, err := parser.ParseFile(*asmInput)
+	vm, err := assembleFile(*asmInput)
+	if err != nil {
+		return err
+	}
+	return execute(vm, *asmInput)
+}
+
+func compileAsm() error {
+	vm, err := assembleFile(*compileInput)
+	if err != nil {
+		return err
+	}
+	return asm.WriteBytecodeFile(outputPath(*compileInput, ".vmbc"), vm)
+}
+
+func assembleObject() error {
+	tree, err := parseFile(*objectInput)
+	if err != nil {
+		return err
+	}
+	obj, err := asm.AssembleObjectWith(tree, assembleOptions())
+	if err != nil {
+		return err
+	}
+	return asm.WriteObjectFile(outputPath(*objectInput, ".vmo"), obj)
+}
+
+func linkObjects() error {
+	inputs := strings.Split(*linkInput, ",")
+	objs := []*asm.Object{}
+	for _, input := range inputs {
+		obj, err := loadObject(input)
+		if err != nil {
+			return err
+		}
+		objs = append(objs, obj)
+	}
+	vm, err := asm.Link(objs...)
+	if err != nil {
+		return err
+	}
+	return asm.WriteBytecodeFile(outputPath(inputs[0], ".vmbc"), vm)
+}
+
+// loadObject reads an object file, or assembles an asm file into an object.
+func loadObject(fileName string) (*asm.Object, error) {
+	if filepath.Ext(fileName) == ".vmo" {
+		return asm.ReadObjectFile(fileName)
+	}
+	tree, err := parseFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return asm.AssembleObjectWith(tree, assembleOptions())
+}
+
+func outputPath(inputPath, ext string) string {
+	if *compileOutput != "" {
+		return *compileOutput
+	}
+	return strings.TrimSuffix(inputPath, filepath.Ext(inputPath)) + ext
+}
+
+func runBytecode() error {
+	vm, err := vm.LoadBytecodeFile(*bytecodeInput)
 	if err != nil {
 		return err
 	}
-	vm, err := asm.Assemble(ast)
+	return execute(vm, *bytecodeInput)
+}
+
+func resumeSnapshot() error {
+	machine, err := vm.LoadSnapshotFile(*resumeInput)
+	if err != nil {
+		return err
+	}
+	return execute(machine, *resumeInput)
+}
+
+func debugAsm() error {
+	machine, err := assembleFile(*debugInput)
+	if err != nil {
+		return err
+	}
+	machine.Input = nil
+	if *programInput != "" {
+		file, err := os.Open(*programInput)
+		if err != nil {
+			return fmt.Errorf("failed to open input file: %w", err)
+		}
+		defer file.Close()
+		machine.Input = file
+	}
+	return debugger.New(machine, os.Stdin, os.Stdout).Run()
+}
+
+func disassemble() error {
+	machine, err := loadMachine(*disasmInput)
 	if err != nil {
 		return err
 	}
-	if *byteToDec {
-		vm.Output = byte2dec{out: vm.Output}
+	if *compileOutput == "" {
+		return disasm.Disassemble(os.Stdout, machine)
+	}
+	file, err := os.Create(*compileOutput)
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %w", err)
+	}
+	err = disasm.Disassemble(file, machine)
+	closeErr := file.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+func verifyProgram() error {
+	machine, err := loadMachine(*verifyInput)
+	if err != nil {
+		return err
+	}
+	return verify.Verify(machine)
+}
+
+// loadMachine reads a bytecode file, or assembles an asm file.
+func loadMachine(fileName string) (*vm.VirtualMachine, error) {
+	if filepath.Ext(fileName) == ".vmbc" {
+		return vm.LoadBytecodeFile(fileName)
+	}
+	return assembleFile(fileName)
+}
+
+func assembleFile(fileName string) (*vm.VirtualMachine, error) {
+	tree, err := parseFile(fileName)
+	if err != nil {
+		return nil, err
 	}
-	return vm.Execute()
+	return asm.AssembleWith(tree, assembleOptions())
+}
+
+func assembleOptions() asm.Options {
+	return asm.Options{Optimise: *optimise}
 }
 
-type byte2dec struct {
-	out io.Writer
+// parseFile parses an asm file and its includes and expands its macros.
+func parseFile(fileName string) (ast.AST, error) {
+	tree, err := parser.ParseFile(fileName)
+	if err != nil {
+		return ast.AST{}, err
+	}
+	return macro.Expand(tree)
 }
 
-func (w byte2dec) Write(bs []byte) (int, error) {
-	written := 0
-	for _, b := range bs {
-		_, err := fmt.Fprintf(w.out, "%d", b)
+// execute runs the machine loaded from inputPath, which names the snapshot
+// file written for -snapshot-at.
+func execute(machine *vm.VirtualMachine, inputPath string) error {
+	if *programInput != "" {
+		file, err := os.Open(*programInput)
+		if err != nil {
+			return fmt.Errorf("failed to open input file: %w", err)
+		}
+		defer file.Close()
+		_, err = file.Seek(int64(machine.InputOffset), io.SeekStart)
+		if err != nil {
+			return fmt.Errorf("failed to skip input already read: %w", err)
+		}
+		machine.Input = file
+	}
+	if *maxSteps != 0 {
+		machine.MaxSteps = *maxSteps
+	}
+	if *maxMemory != 0 {
+		machine.MaxMemory = *maxMemory
+	}
+	if *heapDebug {
+		machine.HeapDebug = true
+	}
+	userMaxSteps := machine.MaxSteps
+	snapshotting := *snapshotAt != 0 && (userMaxSteps == 0 || *snapshotAt < userMaxSteps)
+	if snapshotting {
+		machine.MaxSteps = *snapshotAt
+	}
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	if *profileReport || *pprofOutput != "" {
+		machine.Profile = vm.NewProfile()
+	}
+	var tracer *trace.JSONWriter
+	if *traceOutput != "" {
+		file, err := os.Create(*traceOutput)
+		if err != nil {
+			return fmt.Errorf("failed to create trace file: %w", err)
+		}
+		defer file.Close()
+		tracer = trace.NewJSONWriter(file)
+		machine.Tracer = tracer
+	}
+	err := machine.ExecuteContext(ctx)
+	if snapshotting {
+		machine.MaxSteps = userMaxSteps
+		if errors.Is(err, vm.ErrStepLimit) && machine.Steps == *snapshotAt {
+			err = machine.SaveSnapshotFile(outputPath(inputPath, ".vmss"))
+		} else if err == nil {
+			err = fmt.Errorf("program halted after %d steps, before -snapshot-at %d", machine.Steps, *snapshotAt)
+		}
+	}
+	if tracer != nil {
+		traceErr := tracer.Flush()
+		if err == nil {
+			err = traceErr
+		}
+	}
+	if *profileReport {
+		reportErr := profile.WriteReport(os.Stderr, machine, machine.Profile, 20)
+		if err == nil {
+			err = reportErr
+		}
+	}
+	if *pprofOutput != "" {
+		pprofErr := profile.WritePprofFile(*pprofOutput, machine, machine.Profile)
 		if err == nil {
-			written++
-		} else {
-			return written, err
+			err = pprofErr
 		}
-		fmt.Println()
 	}
-	return written, nil
+	return err
 }
@@ -0,0 +1,237 @@
+package profile
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+
+	"github.com/johnny-morrice/learn/vmlang/vm"
+)
+
+// Field numbers from the pprof profile.proto message definitions.
+const (
+	profileSampleType        = 1
+	profileSample            = 2
+	profileMapping           = 3
+	profileLocation          = 4
+	profileFunction          = 5
+	profileStringTable       = 6
+	profilePeriodType        = 11
+	profilePeriod            = 12
+	profileDefaultSampleType = 14
+
+	valueTypeType = 1
+	valueTypeUnit = 2
+
+	sampleLocationID = 1
+	sampleValue      = 2
+
+	mappingID              = 1
+	mappingMemoryStart     = 2
+	mappingMemoryLimit     = 3
+	mappingFilename        = 5
+	mappingHasFunctions    = 7
+	mappingHasFilenames    = 8
+	mappingHasLineNumbers  = 9
+	mappingHasInlineFrames = 10
+
+	locationID        = 1
+	locationMappingID = 2
+	locationAddress   = 3
+	locationLine      = 4
+
+	lineFunctionID = 1
+	lineLine       = 2
+
+	functionID         = 1
+	functionName       = 2
+	functionSystemName = 3
+	functionFilename   = 4
+)
+
+// WritePprofFile writes prof to a file that go tool pprof can read.
+func WritePprofFile(filePath string, machine *vm.VirtualMachine, prof *vm.Profile) error {
+	file, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	err = WritePprof(file, machine, prof)
+	closeErr := file.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// WritePprof writes prof as a gzipped pprof profile. Each instruction that
+// ran is a location whose function is the label it falls under, or .start
+// before the first label, with a sample counting its executions.
+func WritePprof(w io.Writer, machine *vm.VirtualMachine, prof *vm.Profile) error {
+	p := pprofBuilder{
+		machine:   machine,
+		strings:   map[string]int64{},
+		functions: map[functionKey]uint64{},
+	}
+	p.str("")
+	count := p.valueType("instructions", "count")
+
+	out := protoBuffer{}
+	out.bytesField(profileSampleType, count)
+	for i, addr := range hotAddresses(prof) {
+		id := uint64(i + 1)
+		p.location(id, addr)
+		sample := protoBuffer{}
+		sample.packedField(sampleLocationID, []uint64{id})
+		sample.packedField(sampleValue, []uint64{prof.AddressCounts[addr]})
+		out.bytesField(profileSample, sample.bytes)
+	}
+
+	mapping := protoBuffer{}
+	mapping.uint64Field(mappingID, 1)
+	mapping.uint64Field(mappingMemoryStart, 0)
+	mapping.uint64Field(mappingMemoryLimit, machine.CodeEnd)
+	mapping.int64Field(mappingFilename, p.str("vmlang"))
+	mapping.boolField(mappingHasFunctions, true)
+	mapping.boolField(mappingHasFilenames, true)
+	mapping.boolField(mappingHasLineNumbers, true)
+	mapping.boolField(mappingHasInlineFrames, true)
+	out.bytesField(profileMapping, mapping.bytes)
+
+	out.bytes = append(out.bytes, p.locations.bytes...)
+	out.bytes = append(out.bytes, p.functionTable.bytes...)
+	out.bytesField(profilePeriodType, count)
+	out.int64Field(profilePeriod, 1)
+	out.int64Field(profileDefaultSampleType, p.str("instructions"))
+	for _, s := range p.stringTable {
+		out.bytesField(profileStringTable, []byte(s))
+	}
+
+	gz := gzip.NewWriter(w)
+	_, err := gz.Write(out.bytes)
+	if err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+type functionKey struct {
+	name string
+	file string
+}
+
+type pprofBuilder struct {
+	machine       *vm.VirtualMachine
+	strings       map[string]int64
+	stringTable   []string
+	functions     map[functionKey]uint64
+	functionTable protoBuffer
+	locations     protoBuffer
+}
+
+// str returns the index of s in the string table, adding it if need be.
+func (p *pprofBuilder) str(s string) int64 {
+	if i, ok := p.strings[s]; ok {
+		return i
+	}
+	i := int64(len(p.stringTable))
+	p.strings[s] = i
+	p.stringTable = append(p.stringTable, s)
+	return i
+}
+
+func (p *pprofBuilder) valueType(typ, unit string) []byte {
+	vt := protoBuffer{}
+	vt.int64Field(valueTypeType, p.str(typ))
+	vt.int64Field(valueTypeUnit, p.str(unit))
+	return vt.bytes
+}
+
+func (p *pprofBuilder) location(id, addr uint64) {
+	key := functionKey{name: ".start"}
+	if label, ok := p.machine.NearestLabel(addr); ok {
+		key.name = label.Name
+	}
+	line := protoBuffer{}
+	if loc, ok := p.machine.SourceLocation(addr); ok {
+		key.file = loc.File
+		line.int64Field(lineLine, int64(loc.Line))
+	}
+	line.uint64Field(lineFunctionID, p.function(key))
+
+	loc := protoBuffer{}
+	loc.uint64Field(locationID, id)
+	loc.uint64Field(locationMappingID, 1)
+	loc.uint64Field(locationAddress, addr)
+	loc.bytesField(locationLine, line.bytes)
+	p.locations.bytesField(profileLocation, loc.bytes)
+}
+
+func (p *pprofBuilder) function(key functionKey) uint64 {
+	if id, ok := p.functions[key]; ok {
+		return id
+	}
+	id := uint64(len(p.functions) + 1)
+	p.functions[key] = id
+	fn := protoBuffer{}
+	fn.uint64Field(functionID, id)
+	fn.int64Field(functionName, p.str(key.name))
+	fn.int64Field(functionSystemName, p.str(key.name))
+	fn.int64Field(functionFilename, p.str(key.file))
+	p.functionTable.bytesField(profileFunction, fn.bytes)
+	return id
+}
+
+// protoBuffer encodes protocol buffer fields. Fields holding zero are left
+// out, as the protobuf encoding allows.
+type protoBuffer struct {
+	bytes []byte
+}
+
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+func (b *protoBuffer) varint(x uint64) {
+	for x >= 0x80 {
+		b.bytes = append(b.bytes, byte(x)|0x80)
+		x >>= 7
+	}
+	b.bytes = append(b.bytes, byte(x))
+}
+
+func (b *protoBuffer) tag(field, wireType int) {
+	b.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+func (b *protoBuffer) uint64Field(field int, x uint64) {
+	if x == 0 {
+		return
+	}
+	b.tag(field, wireVarint)
+	b.varint(x)
+}
+
+func (b *protoBuffer) int64Field(field int, x int64) {
+	b.uint64Field(field, uint64(x))
+}
+
+func (b *protoBuffer) boolField(field int, x bool) {
+	if x {
+		b.uint64Field(field, 1)
+	}
+}
+
+func (b *protoBuffer) bytesField(field int, bs []byte) {
+	b.tag(field, wireBytes)
+	b.varint(uint64(len(bs)))
+	b.bytes = append(b.bytes, bs...)
+}
+
+func (b *protoBuffer) packedField(field int, xs []uint64) {
+	packed := protoBuffer{}
+	for _, x := range xs {
+		packed.varint(x)
+	}
+	b.bytesField(field, packed.bytes)
+}
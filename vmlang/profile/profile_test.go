@@ -0,0 +1,162 @@
+package profile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/johnny-morrice/learn/vmlang/asm"
+	"github.com/johnny-morrice/learn/vmlang/asm/parser"
+	"github.com/johnny-morrice/learn/vmlang/vm"
+)
+
+const loopSource = `push 3
+loop:
+	decr
+	jnz loop
+	pop
+`
+
+func profiledRun(t *testing.T) *vm.VirtualMachine {
+	t.Helper()
+	fileName := filepath.Join(t.TempDir(), "loop.vmsm")
+	err := os.WriteFile(fileName, []byte(loopSource), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := parser.ParseFile(fileName)
+	if err != nil {
+		t.Fatalf("unexpected parse err: %s", err)
+	}
+	machine, err := asm.Assemble(tree)
+	if err != nil {
+		t.Fatalf("unexpected assemble err: %s", err)
+	}
+	machine.Profile = vm.NewProfile()
+	err = machine.Execute()
+	if err != nil {
+		t.Fatalf("unexpected run err: %s", err)
+	}
+	return machine
+}
+
+func TestWriteReport(t *testing.T) {
+	machine := profiledRun(t)
+	buf := &bytes.Buffer{}
+	err := WriteReport(buf, machine, machine.Profile, 2)
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	report := buf.String()
+
+	expected := []string{
+		"instructions executed: 9\n",
+		"max stack depth: 1\n",
+		"3  33.3%        2  loop  decr  ",
+		"loop.vmsm:3:2: decr\n",
+		"3  33.3%        3  loop+1  jnz  ",
+		"loop.vmsm:4:2: jnz loop\n",
+		"1  11.1%  exit\n",
+	}
+	for _, line := range expected {
+		if !strings.Contains(report, line) {
+			t.Errorf("expected report to contain %q:\n%s", line, report)
+		}
+	}
+	if strings.Contains(report, "pop  ") {
+		t.Errorf("expected report to list only the top 2 addresses:\n%s", report)
+	}
+}
+
+func TestWritePprof(t *testing.T) {
+	machine := profiledRun(t)
+	buf := &bytes.Buffer{}
+	err := WritePprof(buf, machine, machine.Profile)
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	gz, err := gzip.NewReader(buf)
+	if err != nil {
+		t.Fatalf("expected gzipped profile: %s", err)
+	}
+	bs, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	strs := []string{}
+	samples := 0
+	total := uint64(0)
+	for _, field := range decodeFields(t, bs) {
+		switch field.num {
+		case profileStringTable:
+			strs = append(strs, string(field.bytes))
+		case profileSample:
+			samples++
+			for _, value := range decodeFields(t, field.bytes) {
+				if value.num == sampleValue {
+					n, _ := decodeVarint(value.bytes)
+					total += n
+				}
+			}
+		}
+	}
+	if samples != 5 || total != 9 {
+		t.Errorf("expected 5 samples counting 9 instructions but was %d counting %d", samples, total)
+	}
+	joined := strings.Join(strs, ",")
+	for _, s := range []string{"instructions", "count", "loop", ".start"} {
+		if !strings.Contains(joined, s) {
+			t.Errorf("expected string table to contain %s: %v", s, strs)
+		}
+	}
+	if strs[0] != "" {
+		t.Errorf("expected string table to start with an empty string: %v", strs)
+	}
+}
+
+type protoField struct {
+	num   int
+	value uint64
+	bytes []byte
+}
+
+// decodeFields reads the varint and length delimited fields of a message.
+func decodeFields(t *testing.T, bs []byte) []protoField {
+	t.Helper()
+	fields := []protoField{}
+	for len(bs) > 0 {
+		tag, n := decodeVarint(bs)
+		bs = bs[n:]
+		field := protoField{num: int(tag >> 3)}
+		switch tag & 7 {
+		case wireVarint:
+			field.value, n = decodeVarint(bs)
+			bs = bs[n:]
+		case wireBytes:
+			length, n := decodeVarint(bs)
+			bs = bs[n:]
+			field.bytes = bs[:length]
+			bs = bs[length:]
+		default:
+			t.Fatalf("unexpected wire type %d", tag&7)
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+func decodeVarint(bs []byte) (uint64, int) {
+	x := uint64(0)
+	for i, b := range bs {
+		x |= uint64(b&0x7f) << (7 * i)
+		if b < 0x80 {
+			return x, i + 1
+		}
+	}
+	return x, len(bs)
+}
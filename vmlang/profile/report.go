@@ -0,0 +1,146 @@
+package profile
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/johnny-morrice/learn/vmlang/vm"
+)
+
+// WriteReport writes a summary of prof followed by the top hottest
+// instructions, each with the label it falls under and, when the machine
+// has a source map, its source line. A top of zero or less lists every
+// instruction that ran.
+func WriteReport(w io.Writer, machine *vm.VirtualMachine, prof *vm.Profile, top int) error {
+	r := reporter{
+		machine: machine,
+		prof:    prof,
+		sources: map[string][]string{},
+	}
+	fmt.Fprintf(w, "instructions executed: %d\n", prof.Steps)
+	fmt.Fprintf(w, "max stack depth: %d\n", prof.MaxStackDepth)
+	fmt.Fprintf(w, "max call depth: %d\n", prof.MaxCallDepth)
+	fmt.Fprintf(w, "memory: %d words at start, %d at peak\n", prof.StartMemory, prof.PeakMemory)
+
+	addrs := hotAddresses(prof)
+	if top > 0 && len(addrs) > top {
+		addrs = addrs[:top]
+	}
+	fmt.Fprintln(w, "\nhot spots:")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "count\t%\taddress\t  instruction")
+	for _, addr := range addrs {
+		count := prof.AddressCounts[addr]
+		fmt.Fprintf(tw, "%d\t%s\t%d\t  %s\n", count, r.percent(count), addr, r.describe(addr))
+	}
+	err := tw.Flush()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w, "\nby op:")
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "count\t%\t  op")
+	for _, op := range hotOps(prof) {
+		count := prof.OpCounts[op]
+		fmt.Fprintf(tw, "%d\t%s\t  %s\n", count, r.percent(count), op)
+	}
+	return tw.Flush()
+}
+
+// hotAddresses lists the addresses that ran, most often first.
+func hotAddresses(prof *vm.Profile) []uint64 {
+	addrs := []uint64{}
+	for addr := range prof.AddressCounts {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		a, b := prof.AddressCounts[addrs[i]], prof.AddressCounts[addrs[j]]
+		if a != b {
+			return a > b
+		}
+		return addrs[i] < addrs[j]
+	})
+	return addrs
+}
+
+func hotOps(prof *vm.Profile) []vm.Bytecode {
+	ops := []vm.Bytecode{}
+	for op := range prof.OpCounts {
+		ops = append(ops, op)
+	}
+	sort.Slice(ops, func(i, j int) bool {
+		a, b := prof.OpCounts[ops[i]], prof.OpCounts[ops[j]]
+		if a != b {
+			return a > b
+		}
+		return ops[i] < ops[j]
+	})
+	return ops
+}
+
+type reporter struct {
+	machine *vm.VirtualMachine
+	prof    *vm.Profile
+	// sources caches the lines of each source file, or nil for a file
+	// that could not be read.
+	sources map[string][]string
+}
+
+func (r *reporter) percent(count uint64) string {
+	if r.prof.Steps == 0 {
+		return "0.0%"
+	}
+	return fmt.Sprintf("%.1f%%", 100*float64(count)/float64(r.prof.Steps))
+}
+
+// describe shows the label an address falls under, its op and its source.
+func (r *reporter) describe(addr uint64) string {
+	parts := []string{}
+	if name := labelName(r.machine, addr); name != "" {
+		parts = append(parts, name)
+	}
+	if addr < uint64(len(r.machine.Memory)) {
+		parts = append(parts, vm.Bytecode(r.machine.Memory[addr]).String())
+	}
+	if loc, ok := r.machine.SourceLocation(addr); ok {
+		source := loc.String()
+		if line := r.sourceLine(loc); line != "" {
+			source += ": " + line
+		}
+		parts = append(parts, source)
+	}
+	return strings.Join(parts, "  ")
+}
+
+func (r *reporter) sourceLine(loc vm.SourceLocation) string {
+	lines, cached := r.sources[loc.File]
+	if !cached {
+		bs, err := os.ReadFile(loc.File)
+		if err == nil {
+			lines = strings.Split(string(bs), "\n")
+		}
+		r.sources[loc.File] = lines
+	}
+	if loc.Line < 1 || loc.Line > len(lines) {
+		return ""
+	}
+	return strings.TrimSpace(lines[loc.Line-1])
+}
+
+// labelName names an address by the label it falls under, as label or
+// label+offset.
+func labelName(machine *vm.VirtualMachine, addr uint64) string {
+	label, ok := machine.NearestLabel(addr)
+	if !ok {
+		return ""
+	}
+	if label.Address == addr {
+		return label.Name
+	}
+	return fmt.Sprintf("%s+%d", label.Name, addr-label.Address)
+}
@@ -0,0 +1,95 @@
+package trace
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+
+	"github.com/johnny-morrice/learn/vmlang/vm"
+)
+
+// Record is the JSON form of one executed instruction.
+type Record struct {
+	Step     uint64   `json:"step"`
+	IP       uint64   `json:"ip"`
+	Op       string   `json:"op"`
+	Operands []uint64 `json:"operands"`
+	// Before and After hold the top of the stack, top first, around the
+	// instruction.
+	Before []uint64 `json:"before"`
+	After  []uint64 `json:"after"`
+	SP     uint64   `json:"sp"`
+	NextIP uint64   `json:"next_ip"`
+	Source string   `json:"source,omitempty"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// JSONWriter is a vm.Tracer that writes a Record per instruction, one JSON
+// object to a line. Call Flush once the machine has stopped.
+type JSONWriter struct {
+	out    *bufio.Writer
+	enc    *json.Encoder
+	before []uint64
+	err    error
+}
+
+func NewJSONWriter(w io.Writer) *JSONWriter {
+	out := bufio.NewWriter(w)
+	return &JSONWriter{
+		out: out,
+		enc: json.NewEncoder(out),
+	}
+}
+
+func (jw *JSONWriter) BeforeStep(machine *vm.VirtualMachine, step vm.TraceStep) {
+	jw.before = step.Stack
+}
+
+func (jw *JSONWriter) AfterStep(machine *vm.VirtualMachine, step vm.TraceStep, stepErr error) {
+	if jw.err != nil {
+		return
+	}
+	rec := Record{
+		Step:     step.Step,
+		IP:       step.IP,
+		Op:       step.Op.String(),
+		Operands: step.Operands,
+		Before:   jw.before,
+		After:    step.Stack,
+		SP:       step.SP,
+		NextIP:   machine.IP,
+	}
+	if loc, ok := machine.SourceLocation(step.IP); ok {
+		rec.Source = loc.String()
+	}
+	if stepErr != nil {
+		rec.Error = stepErr.Error()
+	}
+	jw.err = jw.enc.Encode(rec)
+}
+
+// Flush writes any buffered records, returning the first error met while
+// writing the trace.
+func (jw *JSONWriter) Flush() error {
+	if jw.err != nil {
+		return jw.err
+	}
+	return jw.out.Flush()
+}
+
+// ReadRecords reads a trace written by JSONWriter.
+func ReadRecords(r io.Reader) ([]Record, error) {
+	dec := json.NewDecoder(r)
+	recs := []Record{}
+	for {
+		rec := Record{}
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			return recs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, rec)
+	}
+}
@@ -0,0 +1,115 @@
+package trace
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/johnny-morrice/learn/vmlang/asm"
+	"github.com/johnny-morrice/learn/vmlang/asm/ast"
+	"github.com/johnny-morrice/learn/vmlang/asm/macro"
+	"github.com/johnny-morrice/learn/vmlang/asm/parser"
+	"github.com/johnny-morrice/learn/vmlang/example"
+	"github.com/johnny-morrice/learn/vmlang/vm"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden traces in testdata")
+
+func parseExample(t *testing.T, fileName, src string) ast.AST {
+	t.Helper()
+	tree, err := parser.Parse(parser.ParseContext{FileName: fileName, RemainingInput: src})
+	if err != nil {
+		t.Fatalf("unexpected parse err: %s", err)
+	}
+	tree, err = macro.Expand(tree)
+	if err != nil {
+		t.Fatalf("unexpected expand err: %s", err)
+	}
+	return tree
+}
+
+func traceProgram(t *testing.T, tree ast.AST) []byte {
+	t.Helper()
+	machine, err := asm.Assemble(tree)
+	if err != nil {
+		t.Fatalf("unexpected assemble err: %s", err)
+	}
+	machine.Output = &bytes.Buffer{}
+	buf := &bytes.Buffer{}
+	tracer := NewJSONWriter(buf)
+	machine.Tracer = tracer
+	err = machine.Execute()
+	if err != nil {
+		t.Fatalf("unexpected run err: %s", err)
+	}
+	err = tracer.Flush()
+	if err != nil {
+		t.Fatalf("unexpected trace err: %s", err)
+	}
+	return buf.Bytes()
+}
+
+func TestGoldenTraces(t *testing.T) {
+	testCases := map[string]ast.AST{
+		"fac.jsonl":       example.FactorialAst(),
+		"fac_macro.jsonl": parseExample(t, "fac_macro.vmsm", example.FactorialMacroSourceCode),
+	}
+
+	for name, tree := range testCases {
+		t.Run(name, func(t *testing.T) {
+			actual := traceProgram(t, tree)
+			golden := filepath.Join("testdata", name)
+			if *update {
+				err := os.WriteFile(golden, actual, 0o644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			expected, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("failed to read golden trace: %s", err)
+			}
+			if !bytes.Equal(expected, actual) {
+				t.Errorf("trace differs from %s; run go test ./trace -update if the change is intended\nactual:\n%s", golden, actual)
+			}
+		})
+	}
+}
+
+func TestJSONWriterRecords(t *testing.T) {
+	machine := &vm.VirtualMachine{
+		Memory:     []uint64{uint64(vm.Push), 6, uint64(vm.Push), 0, uint64(vm.Divide), uint64(vm.Exit), 0, 0, 0, 0},
+		CodeEnd:    6,
+		SP:         6,
+		StackStart: 6,
+		StackEnd:   10,
+	}
+	buf := &bytes.Buffer{}
+	tracer := NewJSONWriter(buf)
+	machine.Tracer = tracer
+	runErr := machine.Execute()
+	if !errors.Is(runErr, vm.ErrDivisionByZero) {
+		t.Fatalf("expected division by zero but was: %v", runErr)
+	}
+	err := tracer.Flush()
+	if err != nil {
+		t.Fatalf("unexpected trace err: %s", err)
+	}
+
+	recs, err := ReadRecords(buf)
+	if err != nil {
+		t.Fatalf("unexpected read err: %s", err)
+	}
+	expected := []Record{
+		{Step: 0, IP: 0, Op: "push", Operands: []uint64{6}, Before: []uint64{}, After: []uint64{6}, SP: 7, NextIP: 2},
+		{Step: 1, IP: 2, Op: "push", Operands: []uint64{0}, Before: []uint64{6}, After: []uint64{0, 6}, SP: 8, NextIP: 4},
+		{Step: 2, IP: 4, Op: "div", Operands: []uint64{}, Before: []uint64{0, 6}, After: []uint64{0, 6}, SP: 8, NextIP: 4, Error: runErr.Error()},
+	}
+	if !reflect.DeepEqual(expected, recs) {
+		t.Errorf("expected records: %+v\nactual: %+v", expected, recs)
+	}
+}
@@ -0,0 +1,447 @@
+package verify
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/johnny-morrice/learn/vmlang/vm"
+)
+
+var ErrJumpTarget = errors.New("jump target is not an instruction")
+var ErrStackMismatch = errors.New("inconsistent stack depth")
+var ErrUnreachable = errors.New("unreachable code")
+
+// Problem describes a fault found in a program without running it. Kind is
+// one of the Err sentinels above or vm.ErrStackUnderflow,
+// vm.ErrCallStackUnderflow, vm.ErrLocalOutOfRange, vm.ErrUnknownBytecode or
+// vm.ErrIPOutOfBounds, and is matched by errors.Is.
+type Problem struct {
+	Address uint64
+	Op      vm.Bytecode
+	Kind    error
+	Detail  string
+	// Source is the location of the instruction, when the machine has a source map.
+	Source *vm.SourceLocation
+}
+
+func (p *Problem) Error() string {
+	msg := fmt.Sprintf("%s: %s; address: %v; op: %v", p.Kind, p.Detail, p.Address, p.Op)
+	if p.Source != nil {
+		return fmt.Sprintf("%s: %s", p.Source, msg)
+	}
+	return msg
+}
+
+func (p *Problem) Unwrap() error {
+	return p.Kind
+}
+
+// Problems holds every problem in a program, in address order.
+type Problems []*Problem
+
+func (problems Problems) Error() string {
+	msgs := []string{}
+	for _, p := range problems {
+		msgs = append(msgs, p.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Is matches target against each problem in turn, as errors.Is only looks
+// inside a list of errors from Go 1.20.
+func (problems Problems) Is(target error) bool {
+	for _, p := range problems {
+		if errors.Is(p, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first problem that matches target.
+func (problems Problems) As(target any) bool {
+	for _, p := range problems {
+		if errors.As(p, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Verify checks the code segment of a freshly loaded machine. Jump targets
+// must be instructions, no path from the entry point may pop more values
+// than it has pushed, every path reaching an instruction must agree on the
+// stack depth there, and every instruction must be reachable. Calls are
+// checked against a summary of the stack effect of the subroutine they
+// call, and leave and the locals are checked against the enter that made
+// the frame. It returns Problems, or nil if there are none.
+//
+// The target of gotos or calls is only known when the program runs, so in
+// a program using them every label is taken to be a possible target, with
+// an unknown stack depth.
+func Verify(machine *vm.VirtualMachine) error {
+	v := verifier{
+		machine:  machine,
+		instrs:   map[uint64]instruction{},
+		reached:  map[uint64]bool{},
+		subs:     map[uint64]*summary{},
+		problems: map[problemKey]*Problem{},
+	}
+	if !v.decode() {
+		return v.result()
+	}
+	v.checkJumpTargets()
+	if len(v.order) > 0 {
+		v.analyse(0, known(0), nil)
+	}
+	if v.indirect {
+		v.analyseLabels()
+	}
+	v.checkReachable()
+	return v.result()
+}
+
+type instruction struct {
+	addr    uint64
+	op      vm.Bytecode
+	info    vm.OpInfo
+	operand uint64
+}
+
+func (instr instruction) next() uint64 {
+	return instr.addr + instr.info.Size()
+}
+
+// depth is a stack depth, or unknown after a call whose effect cannot be
+// worked out, such as a recursive one.
+type depth struct {
+	n     int
+	known bool
+	// frame is the stack frame made by the last enter on the path, if known.
+	frame *frame
+}
+
+// frame holds the depths below the locals of a stack frame and just after
+// the enter that made it, so that leave can find where its results go.
+type frame struct {
+	base int
+	top  int
+}
+
+func (f *frame) locals() int {
+	return f.top - f.base - 2
+}
+
+func known(n int) depth {
+	return depth{n: n, known: true}
+}
+
+// summary is the stack effect of a subroutine, relative to the depth at
+// which it was called.
+type summary struct {
+	// done is false while the subroutine is being analysed, so that
+	// recursive calls are treated as having an unknown effect.
+	done bool
+	// needs is the number of values the subroutine pops from its caller.
+	needs int
+	// effect is the change in depth on return, if every return agrees.
+	effect depth
+	// returned is set once a return with a known depth has been seen.
+	returned bool
+}
+
+func (sub *summary) need(n int) {
+	if n > sub.needs {
+		sub.needs = n
+	}
+}
+
+type problemKey struct {
+	addr uint64
+	kind error
+}
+
+type verifier struct {
+	machine  *vm.VirtualMachine
+	instrs   map[uint64]instruction
+	order    []uint64
+	reached  map[uint64]bool
+	subs     map[uint64]*summary
+	problems map[problemKey]*Problem
+	// indirect is set once an indirect jump or call has been reached.
+	indirect bool
+}
+
+// decode reads every instruction in the code segment, stopping at the
+// first unknown bytecode since the boundaries after it cannot be found.
+func (v *verifier) decode() bool {
+	code := v.machine.Memory
+	if v.machine.CodeEnd < uint64(len(code)) {
+		code = code[:v.machine.CodeEnd]
+	}
+	for addr := uint64(0); addr < uint64(len(code)); {
+		op := vm.Bytecode(code[addr])
+		info, ok := op.Info()
+		if !ok {
+			v.report(addr, op, vm.ErrUnknownBytecode, fmt.Sprintf("bytecode %d", code[addr]))
+			return false
+		}
+		instr := instruction{addr: addr, op: op, info: info}
+		if addr+uint64(len(info.Operands)) >= uint64(len(code)) {
+			v.report(addr, op, vm.ErrIPOutOfBounds, "operands run past the end of the code segment")
+			return false
+		}
+		if len(info.Operands) > 0 {
+			instr.operand = code[addr+1]
+		}
+		v.instrs[addr] = instr
+		v.order = append(v.order, addr)
+		addr = instr.next()
+	}
+	return true
+}
+
+func (v *verifier) checkJumpTargets() {
+	for _, addr := range v.order {
+		instr := v.instrs[addr]
+		if !v.jumps(instr) {
+			continue
+		}
+		if _, ok := v.instrs[instr.operand]; !ok {
+			v.report(addr, instr.op, ErrJumpTarget, fmt.Sprintf("target %d", instr.operand))
+		}
+	}
+}
+
+func (v *verifier) jumps(instr instruction) bool {
+	return len(instr.info.Operands) > 0 && instr.info.Operands[0] == vm.CodeOperand
+}
+
+// analyse follows every path from entry, which starts at depth start. With
+// a nil sub, entry is the start of the program; otherwise entry is a
+// subroutine and depths are relative to the depth at which it is called.
+func (v *verifier) analyse(entry uint64, start depth, sub *summary) {
+	depths := map[uint64]depth{entry: start}
+	work := []uint64{entry}
+	visit := func(from instruction, addr uint64, d depth) {
+		if _, ok := v.instrs[addr]; !ok {
+			return
+		}
+		prev, seen := depths[addr]
+		switch {
+		case !seen || (!prev.known && d.known):
+			depths[addr] = d
+			work = append(work, addr)
+		case prev.known && d.known && prev.n != d.n:
+			v.report(addr, v.instrs[addr].op, ErrStackMismatch,
+				fmt.Sprintf("depth %d from %d, but %d on another path", d.n, from.addr, prev.n))
+		}
+	}
+
+	for len(work) > 0 {
+		addr := work[len(work)-1]
+		work = work[:len(work)-1]
+		instr := v.instrs[addr]
+		d := depths[addr]
+		v.reached[addr] = true
+
+		pops, pushes := instr.op.StackEffect([]uint64{instr.operand})
+		if d.known && d.n < pops {
+			if sub == nil {
+				v.report(addr, instr.op, vm.ErrStackUnderflow,
+					fmt.Sprintf("%s needs %d values but the stack holds %d", instr.op, pops, d.n))
+				d = depth{}
+			} else {
+				sub.need(pops - d.n)
+			}
+		}
+		if d.known {
+			d.n += pushes - pops
+		}
+
+		switch instr.op {
+		case vm.Enter:
+			d.frame = nil
+			if d.known {
+				d.frame = &frame{base: d.n - pushes, top: d.n}
+			}
+			visit(instr, instr.next(), d)
+		case vm.Leave:
+			visit(instr, instr.next(), v.analyseLeave(instr, d))
+		case vm.LoadLocal, vm.StoreLocal:
+			if d.frame != nil && instr.operand >= uint64(d.frame.locals()) {
+				v.report(addr, instr.op, vm.ErrLocalOutOfRange,
+					fmt.Sprintf("local %d but the frame holds %d", instr.operand, d.frame.locals()))
+			}
+			visit(instr, instr.next(), d)
+		case vm.Exit:
+		case vm.Return:
+			v.analyseReturn(instr, d, sub)
+		case vm.Goto:
+			visit(instr, instr.operand, d)
+		case vm.JumpNotZero:
+			visit(instr, instr.operand, d)
+			visit(instr, instr.next(), d)
+		case vm.Call:
+			visit(instr, instr.next(), v.analyseCall(instr, d, sub))
+		case vm.GotoIndirect:
+			v.indirect = true
+		case vm.CallIndirect:
+			v.indirect = true
+			visit(instr, instr.next(), depth{})
+		default:
+			visit(instr, instr.next(), d)
+		}
+	}
+}
+
+func (v *verifier) analyseReturn(instr instruction, d depth, sub *summary) {
+	if sub == nil {
+		v.report(instr.addr, instr.op, vm.ErrCallStackUnderflow, "return outside of a call")
+		return
+	}
+	if !d.known {
+		return
+	}
+	if !sub.returned {
+		sub.returned = true
+		sub.effect = d
+		return
+	}
+	if sub.effect.known && sub.effect.n != d.n {
+		v.report(instr.addr, instr.op, ErrStackMismatch,
+			fmt.Sprintf("returns with depth %d, but %d on another path", d.n, sub.effect.n))
+		sub.effect = depth{}
+	}
+}
+
+// analyseLeave returns the depth after leave, which drops the frame but
+// keeps the values pushed since the enter that made it.
+func (v *verifier) analyseLeave(instr instruction, d depth) depth {
+	if !d.known || d.frame == nil {
+		return depth{}
+	}
+	if d.n < d.frame.top {
+		v.report(instr.addr, instr.op, vm.ErrStackUnderflow,
+			fmt.Sprintf("the stack holds %d values but the frame ends at %d", d.n, d.frame.top))
+		return depth{}
+	}
+	return known(d.frame.base + d.n - d.frame.top)
+}
+
+// analyseCall returns the depth after the subroutine called by instr returns.
+func (v *verifier) analyseCall(instr instruction, d depth, sub *summary) depth {
+	target := instr.operand
+	if _, ok := v.instrs[target]; !ok {
+		return depth{}
+	}
+	callee, seen := v.subs[target]
+	if !seen {
+		callee = &summary{}
+		v.subs[target] = callee
+		v.analyse(target, known(0), callee)
+		callee.done = true
+	}
+	if !callee.done || !d.known {
+		return depth{}
+	}
+	if d.n < callee.needs {
+		if sub == nil {
+			v.report(instr.addr, instr.op, vm.ErrStackUnderflow,
+				fmt.Sprintf("subroutine at %d needs %d values but the stack holds %d", target, callee.needs, d.n))
+			return depth{}
+		}
+		sub.need(callee.needs - d.n)
+	}
+	if !callee.effect.known {
+		return depth{}
+	}
+	d.n += callee.effect.n
+	return d
+}
+
+// analyseLabels follows the paths from each label that has not been
+// reached, as it may be the target of an indirect jump or call. Since
+// either could arrive there, a return is allowed and the depth is unknown.
+func (v *verifier) analyseLabels() {
+	for _, sym := range v.machine.Symbols {
+		if sym.Kind != vm.LabelSymbol || v.reached[sym.Address] {
+			continue
+		}
+		if _, ok := v.instrs[sym.Address]; ok {
+			v.analyse(sym.Address, depth{}, &summary{})
+		}
+	}
+}
+
+// checkReachable reports each run of instructions that no path reaches.
+// The exits the assembler adds to the end of every object are left out.
+func (v *verifier) checkReachable() {
+	for i := 0; i < len(v.order); i++ {
+		addr := v.order[i]
+		if v.reached[addr] || v.addedExit(i) {
+			continue
+		}
+		for i+1 < len(v.order) && !v.reached[v.order[i+1]] && !v.addedExit(i+1) {
+			i++
+		}
+		v.report(addr, v.instrs[addr].op, ErrUnreachable,
+			fmt.Sprintf("no path reaches addresses %d to %d", addr, v.order[i]))
+	}
+}
+
+// addedExit reports whether the instruction at index i of the program is
+// an exit the assembler added to the end of an object. The assembler gives
+// these no source location, so in a linked program they are told apart
+// from the exits in the source by the source map; without one, only the
+// exit at the end of the program is known to be added.
+func (v *verifier) addedExit(i int) bool {
+	addr := v.order[i]
+	if v.instrs[addr].op != vm.Exit {
+		return false
+	}
+	if i == len(v.order)-1 {
+		return true
+	}
+	if len(v.machine.SourceMap) == 0 {
+		return false
+	}
+	_, mapped := v.machine.SourceLocation(addr)
+	return !mapped
+}
+
+func (v *verifier) report(addr uint64, op vm.Bytecode, kind error, detail string) {
+	key := problemKey{addr: addr, kind: kind}
+	if _, exists := v.problems[key]; exists {
+		return
+	}
+	p := &Problem{
+		Address: addr,
+		Op:      op,
+		Kind:    kind,
+		Detail:  detail,
+	}
+	if loc, ok := v.machine.SourceLocation(addr); ok {
+		p.Source = &loc
+	}
+	v.problems[key] = p
+}
+
+func (v *verifier) result() error {
+	if len(v.problems) == 0 {
+		return nil
+	}
+	problems := Problems{}
+	for _, p := range v.problems {
+		problems = append(problems, p)
+	}
+	sort.Slice(problems, func(i, j int) bool {
+		if problems[i].Address != problems[j].Address {
+			return problems[i].Address < problems[j].Address
+		}
+		return problems[i].Kind.Error() < problems[j].Kind.Error()
+	})
+	return problems
+}
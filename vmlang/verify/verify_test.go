@@ -0,0 +1,215 @@
+package verify
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/johnny-morrice/learn/vmlang/vm"
+)
+
+type expectedProblem struct {
+	addr uint64
+	kind error
+}
+
+func machine(code ...uint64) *vm.VirtualMachine {
+	return &vm.VirtualMachine{
+		Memory:  code,
+		CodeEnd: uint64(len(code)),
+	}
+}
+
+// labelled adds a label at each address.
+func labelled(machine *vm.VirtualMachine, addrs ...uint64) *vm.VirtualMachine {
+	for _, addr := range addrs {
+		machine.Symbols = append(machine.Symbols, vm.Symbol{Name: fmt.Sprintf("L%d", addr), Kind: vm.LabelSymbol, Address: addr})
+	}
+	return machine
+}
+
+// mapped gives each address a line in the source map.
+func mapped(machine *vm.VirtualMachine, addrs ...uint64) *vm.VirtualMachine {
+	for i, addr := range addrs {
+		loc := vm.SourceLocation{File: "a.vmsm", Line: i + 1, Column: 1}
+		machine.SourceMap = append(machine.SourceMap, vm.SourceMapEntry{Address: addr, Location: loc})
+	}
+	return machine
+}
+
+func TestVerify(t *testing.T) {
+	push, pop, exit := uint64(vm.Push), uint64(vm.Pop), uint64(vm.Exit)
+	testCases := map[string]struct {
+		machine  *vm.VirtualMachine
+		expected []expectedProblem
+	}{
+		"balanced program": {
+			machine: machine(push, 1, push, 2, uint64(vm.Add), uint64(vm.OutputDecimal), pop, exit),
+		},
+		"loop": {
+			// push 3; loop: decr; jnz loop; pop
+			machine: machine(push, 3, uint64(vm.Decrement), uint64(vm.JumpNotZero), 2, pop, exit),
+		},
+		"subroutine": {
+			// push 2; call double; outd; pop; exit; double: dupl; add; rtn
+			machine: machine(push, 2, uint64(vm.Call), 7, uint64(vm.OutputDecimal), pop, exit,
+				uint64(vm.Duplicate), uint64(vm.Add), uint64(vm.Return), exit),
+		},
+		"recursive subroutine": {
+			// push 3; call count; pop; exit; count: decr; jnz more; rtn; more: call count; rtn
+			machine: machine(push, 3, uint64(vm.Call), 6, pop, exit,
+				uint64(vm.Decrement), uint64(vm.JumpNotZero), 10, uint64(vm.Return),
+				uint64(vm.Call), 6, uint64(vm.Return)),
+		},
+		"jump table": {
+			// push 0; rmem; calls; exit; a: rtn; b: rtn
+			machine: labelled(machine(push, 0, uint64(vm.ReadMemory), uint64(vm.CallIndirect), exit,
+				uint64(vm.Return), uint64(vm.Return), exit), 5, 6),
+		},
+		"indirect goto to a label": {
+			// push 4; gotos; pop; a: exit
+			machine:  labelled(machine(push, 4, uint64(vm.GotoIndirect), pop, exit), 4),
+			expected: []expectedProblem{{3, ErrUnreachable}},
+		},
+		"indirect goto with empty stack": {
+			machine:  machine(uint64(vm.GotoIndirect), exit),
+			expected: []expectedProblem{{0, vm.ErrStackUnderflow}},
+		},
+		"stack shuffling": {
+			// push 1; push 2; push 3; rot; over; pick 3; roll 2; swap; dropn 4; pop; exit
+			machine: machine(push, 1, push, 2, push, 3, uint64(vm.Rotate), uint64(vm.Over),
+				uint64(vm.Pick), 3, uint64(vm.Roll), 2, uint64(vm.Swap), uint64(vm.DropN), 4, pop, exit),
+		},
+		"pick below the stack": {
+			machine:  machine(push, 1, uint64(vm.Pick), 1, exit),
+			expected: []expectedProblem{{2, vm.ErrStackUnderflow}},
+		},
+		"dropn more than the stack holds": {
+			machine:  machine(push, 1, uint64(vm.DropN), 2, exit),
+			expected: []expectedProblem{{2, vm.ErrStackUnderflow}},
+		},
+		"stack frame": {
+			// push 1; push 2; call f; outd; pop; exit; f: enter 2; lload 0; lload 1; add; leave; rtn
+			machine: machine(push, 1, push, 2, uint64(vm.Call), 9, uint64(vm.OutputDecimal), pop, exit,
+				uint64(vm.Enter), 2, uint64(vm.LoadLocal), 0, uint64(vm.LoadLocal), 1, uint64(vm.Add),
+				uint64(vm.Leave), uint64(vm.Return)),
+		},
+		"leave after popping the frame": {
+			// push 1; enter 1; pop; leave; exit
+			machine:  machine(push, 1, uint64(vm.Enter), 1, pop, uint64(vm.Leave), exit),
+			expected: []expectedProblem{{5, vm.ErrStackUnderflow}},
+		},
+		"local out of range": {
+			// push 1; enter 1; lload 1; leave; pop; exit
+			machine:  machine(push, 1, uint64(vm.Enter), 1, uint64(vm.LoadLocal), 1, uint64(vm.Leave), pop, exit),
+			expected: []expectedProblem{{4, vm.ErrLocalOutOfRange}},
+		},
+		"pop empty stack": {
+			machine:  machine(pop, exit),
+			expected: []expectedProblem{{0, vm.ErrStackUnderflow}},
+		},
+		"binary op on one value": {
+			machine:  machine(push, 1, uint64(vm.Add), exit),
+			expected: []expectedProblem{{2, vm.ErrStackUnderflow}},
+		},
+		"subroutine pops from empty stack": {
+			// call drop; exit; drop: pop; rtn
+			machine:  machine(uint64(vm.Call), 3, exit, pop, uint64(vm.Return)),
+			expected: []expectedProblem{{0, vm.ErrStackUnderflow}},
+		},
+		"jump into operand": {
+			machine:  machine(uint64(vm.Goto), 3, push, 1, exit),
+			expected: []expectedProblem{{0, ErrJumpTarget}, {2, ErrUnreachable}},
+		},
+		"jump outside code": {
+			machine:  machine(push, 1, uint64(vm.JumpNotZero), 50, exit),
+			expected: []expectedProblem{{2, ErrJumpTarget}},
+		},
+		"inconsistent depth at merge": {
+			// push 1; jnz skip; push 2; skip: exit
+			machine:  machine(push, 1, uint64(vm.JumpNotZero), 6, push, 2, exit),
+			expected: []expectedProblem{{6, ErrStackMismatch}},
+		},
+		"inconsistent depth on return": {
+			// push 1; call f; exit; f: jnz two; rtn; two: push 2; rtn
+			machine: machine(push, 1, uint64(vm.Call), 5, exit,
+				uint64(vm.JumpNotZero), 8, uint64(vm.Return), push, 2, uint64(vm.Return)),
+			expected: []expectedProblem{{10, ErrStackMismatch}},
+		},
+		"return outside call": {
+			machine:  machine(uint64(vm.Return)),
+			expected: []expectedProblem{{0, vm.ErrCallStackUnderflow}},
+		},
+		"code after goto": {
+			// goto end; push 1; pop; end: exit
+			machine:  machine(uint64(vm.Goto), 5, push, 1, pop, exit),
+			expected: []expectedProblem{{2, ErrUnreachable}},
+		},
+		"code after exit": {
+			machine:  machine(exit, push, 1, pop, exit),
+			expected: []expectedProblem{{1, ErrUnreachable}},
+		},
+		"exits added to linked objects": {
+			// call f; exit; [exit]; f: rtn; [exit]
+			machine: mapped(machine(uint64(vm.Call), 4, exit, exit, uint64(vm.Return), exit), 0, 2, 4),
+		},
+		"exit in the source after exit": {
+			machine:  mapped(machine(exit, exit, exit), 0, 1),
+			expected: []expectedProblem{{1, ErrUnreachable}},
+		},
+		"unknown bytecode": {
+			machine:  machine(push, 1, 9999, exit),
+			expected: []expectedProblem{{2, vm.ErrUnknownBytecode}},
+		},
+		"truncated operand": {
+			machine:  machine(push),
+			expected: []expectedProblem{{0, vm.ErrIPOutOfBounds}},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			err := Verify(tc.machine)
+			if len(tc.expected) == 0 {
+				if err != nil {
+					t.Fatalf("unexpected err: %s", err)
+				}
+				return
+			}
+			var problems Problems
+			if !errors.As(err, &problems) {
+				t.Fatalf("expected problems but was: %v", err)
+			}
+			actual := []expectedProblem{}
+			for _, p := range problems {
+				actual = append(actual, expectedProblem{p.Address, p.Kind})
+			}
+			if !reflect.DeepEqual(tc.expected, actual) {
+				t.Errorf("expected problems: %v\nactual: %s", tc.expected, err)
+			}
+			for _, expected := range tc.expected {
+				if !errors.Is(err, expected.kind) {
+					t.Errorf("expected err to match %s", expected.kind)
+				}
+			}
+		})
+	}
+}
+
+func TestProblemReportsSource(t *testing.T) {
+	m := machine(uint64(vm.Pop), uint64(vm.Exit))
+	m.SourceMap = vm.SourceMap{{Address: 0, Location: vm.SourceLocation{File: "a.vmsm", Line: 3, Column: 1}}}
+	err := Verify(m)
+	if err == nil {
+		t.Fatal("expected err")
+	}
+	if !strings.HasPrefix(err.Error(), "a.vmsm:3:1: stack underflow") {
+		t.Errorf("expected err to start with the source location but was: %s", err)
+	}
+	problem := &Problem{}
+	if !errors.As(err, &problem) || problem.Source == nil || problem.Source.Line != 3 {
+		t.Errorf("expected the problem on line 3 but received: %v", problem)
+	}
+}
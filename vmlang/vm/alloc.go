@@ -0,0 +1,207 @@
+package vm
+
+// The allocator behind alloc and free keeps its blocks in memory from
+// AllocStart. The first two words there hold the address of the first free
+// block and the break, the address just past the last block. Each block is
+// a header word holding the size of the block in words, not counting the
+// header, and allocatedBit while it is in use, followed by the block
+// itself. A free block keeps the address of the next free block in its
+// first word, so the free list runs through the blocks in address order and
+// a block can be merged with a free neighbour on either side.
+const (
+	allocatedBit  = uint64(1) << 63
+	freeListWord  = 0
+	breakWord     = 1
+	allocatorSize = 2
+)
+
+// initAllocator returns AllocStart, choosing the end of memory if it is not
+// set, and the break, making sure both allocator words are in memory.
+func (vm *VirtualMachine) initAllocator() (start uint64, brk uint64, err error) {
+	if vm.AllocStart == 0 {
+		vm.AllocStart = uint64(len(vm.Memory))
+	}
+	start = vm.AllocStart
+	err = vm.growMemory(start + breakWord)
+	if err != nil {
+		return 0, 0, err
+	}
+	if vm.Memory[start+breakWord] == 0 {
+		vm.Memory[start+breakWord] = start + allocatorSize
+	}
+	brk = vm.Memory[start+breakWord]
+	if brk < start+allocatorSize || brk > uint64(len(vm.Memory)) {
+		return 0, 0, ErrHeapCorrupted
+	}
+	return start, brk, nil
+}
+
+// alloc returns the address of a zeroed block of n words, taking the first
+// free block that is large enough and splitting off what it does not need,
+// or else moving the break.
+func (vm *VirtualMachine) alloc(n uint64) (uint64, error) {
+	start, brk, err := vm.initAllocator()
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		n = 1
+	}
+
+	prev := uint64(0)
+	for b := vm.Memory[start+freeListWord]; b != 0; b = vm.Memory[b+1] {
+		if !vm.isFreeBlock(start, brk, prev, b) {
+			return 0, ErrHeapCorrupted
+		}
+		size := vm.Memory[b]
+		if size < n {
+			prev = b
+			continue
+		}
+		next := vm.Memory[b+1]
+		if size-n >= 2 {
+			rest := b + 1 + n
+			vm.Memory[rest] = size - n - 1
+			vm.Memory[rest+1] = next
+			next = rest
+			size = n
+		}
+		vm.setNextFree(start, prev, next)
+		vm.Memory[b] = size | allocatedBit
+		for addr := b + 1; addr <= b+size; addr++ {
+			vm.Memory[addr] = 0
+		}
+		return b + 1, nil
+	}
+
+	if n >= allocatedBit || brk+1+n < brk {
+		return 0, ErrMemoryLimit
+	}
+	err = vm.growMemory(brk + n)
+	if err != nil {
+		return 0, err
+	}
+	vm.Memory[brk] = n | allocatedBit
+	vm.Memory[start+breakWord] = brk + 1 + n
+	return brk + 1, nil
+}
+
+// free returns the block at p to the free list, merging it with the free
+// blocks either side.
+func (vm *VirtualMachine) free(p uint64) error {
+	start, brk, err := vm.initAllocator()
+	if err != nil {
+		return err
+	}
+	if p < start+allocatorSize+1 || p >= brk {
+		return ErrInvalidFree
+	}
+	b := p - 1
+	if vm.HeapDebug {
+		block, ok := vm.heapBlock(p)
+		if !ok {
+			return ErrInvalidFree
+		}
+		if vm.Memory[block]&allocatedBit == 0 {
+			return ErrDoubleFree
+		}
+		if block != b {
+			return ErrInvalidFree
+		}
+	}
+	header := vm.Memory[b]
+	if header&allocatedBit == 0 {
+		return ErrDoubleFree
+	}
+	size := header &^ allocatedBit
+	if b+1+size > brk {
+		return ErrHeapCorrupted
+	}
+
+	prev := uint64(0)
+	next := vm.Memory[start+freeListWord]
+	for next != 0 && next < b {
+		if !vm.isFreeBlock(start, brk, prev, next) {
+			return ErrHeapCorrupted
+		}
+		prev, next = next, vm.Memory[next+1]
+	}
+	vm.Memory[b] = size
+	vm.Memory[b+1] = next
+	if next != 0 && b+1+size == next {
+		vm.Memory[b] += 1 + vm.Memory[next]
+		vm.Memory[b+1] = vm.Memory[next+1]
+		vm.Memory[next] = 0
+		vm.Memory[next+1] = 0
+	}
+	if prev != 0 && prev+1+vm.Memory[prev] == b {
+		vm.Memory[prev] += 1 + vm.Memory[b]
+		vm.Memory[prev+1] = vm.Memory[b+1]
+		vm.Memory[b] = 0
+		vm.Memory[b+1] = 0
+		return nil
+	}
+	vm.setNextFree(start, prev, b)
+	return nil
+}
+
+// isFreeBlock reports whether b, reached from the free block at prev or
+// from the start of the free list if prev is zero, can be a free block.
+// The list is in address order, so each block must come after the one
+// before it; the program can write to the list, and this stops a walk from
+// going round a loop.
+func (vm *VirtualMachine) isFreeBlock(start, brk, prev, b uint64) bool {
+	if b < start+allocatorSize || b <= prev || b+1 >= brk {
+		return false
+	}
+	size := vm.Memory[b]
+	return b+1+size <= brk && b+1+size > b
+}
+
+// setNextFree links the free block at prev, or the start of the free list
+// if prev is zero, to next.
+func (vm *VirtualMachine) setNextFree(start, prev, next uint64) {
+	if prev == 0 {
+		vm.Memory[start+freeListWord] = next
+	} else {
+		vm.Memory[prev+1] = next
+	}
+}
+
+// heapBlock finds the header of the block holding addr by walking the
+// blocks from AllocStart, reporting false if addr is not in a block.
+func (vm *VirtualMachine) heapBlock(addr uint64) (uint64, bool) {
+	start := vm.AllocStart
+	memSize := uint64(len(vm.Memory))
+	if start == 0 || start+breakWord >= memSize {
+		return 0, false
+	}
+	brk := vm.Memory[start+breakWord]
+	if brk > memSize {
+		brk = memSize
+	}
+	for b := start + allocatorSize; b < brk; {
+		size := vm.Memory[b] &^ allocatedBit
+		if addr <= b+size {
+			return b, addr >= b
+		}
+		if b+1+size < b {
+			return 0, false
+		}
+		b += 1 + size
+	}
+	return 0, false
+}
+
+// checkHeapAccess reports ErrUseAfterFree when HeapDebug is set and addr is
+// in the allocator's memory but not in a block that is in use.
+func (vm *VirtualMachine) checkHeapAccess(addr uint64) error {
+	if !vm.HeapDebug || vm.AllocStart == 0 || addr < vm.AllocStart {
+		return nil
+	}
+	b, ok := vm.heapBlock(addr)
+	if !ok || addr == b || vm.Memory[b]&allocatedBit == 0 {
+		return ErrUseAfterFree
+	}
+	return nil
+}
@@ -0,0 +1,257 @@
+package vm
+
+import (
+	"errors"
+	"testing"
+)
+
+// allocMachine has 10 words of code and stack, with the allocator after them.
+func allocMachine() *VirtualMachine {
+	return &VirtualMachine{
+		Memory:     make([]uint64, 10),
+		StackEnd:   10,
+		HeapStart:  10,
+		AllocStart: 10,
+	}
+}
+
+func TestAllocator(t *testing.T) {
+	type step struct {
+		alloc    uint64
+		free     uint64
+		expected uint64
+	}
+	// The first block starts after the two allocator words, at 13.
+	testCases := map[string][]step{
+		"moves the break": {
+			{alloc: 2, expected: 13},
+			{alloc: 3, expected: 16},
+			{alloc: 0, expected: 20},
+		},
+		"reuses a freed block": {
+			{alloc: 2, expected: 13},
+			{alloc: 2, expected: 16},
+			{free: 13},
+			{alloc: 2, expected: 13},
+		},
+		"splits a large block": {
+			{alloc: 6, expected: 13},
+			{alloc: 1, expected: 20},
+			{free: 13},
+			{alloc: 2, expected: 13},
+			{alloc: 2, expected: 16},
+			{alloc: 1, expected: 22},
+		},
+		"skips a small block": {
+			{alloc: 1, expected: 13},
+			{alloc: 1, expected: 15},
+			{free: 13},
+			{alloc: 2, expected: 17},
+			{alloc: 1, expected: 13},
+		},
+		"merges with the next block": {
+			{alloc: 2, expected: 13},
+			{alloc: 2, expected: 16},
+			{alloc: 1, expected: 19},
+			{free: 16},
+			{free: 13},
+			{alloc: 5, expected: 13},
+		},
+		"merges with the previous block": {
+			{alloc: 2, expected: 13},
+			{alloc: 2, expected: 16},
+			{alloc: 1, expected: 19},
+			{free: 13},
+			{free: 16},
+			{alloc: 5, expected: 13},
+		},
+		"merges with both neighbours": {
+			{alloc: 1, expected: 13},
+			{alloc: 1, expected: 15},
+			{alloc: 1, expected: 17},
+			{alloc: 1, expected: 19},
+			{free: 13},
+			{free: 17},
+			{free: 15},
+			{alloc: 5, expected: 13},
+		},
+	}
+
+	for name, steps := range testCases {
+		t.Run(name, func(t *testing.T) {
+			for _, debug := range []bool{false, true} {
+				vm := allocMachine()
+				vm.HeapDebug = debug
+				for i, s := range steps {
+					if s.free != 0 {
+						err := vm.free(s.free)
+						if err != nil {
+							t.Fatalf("step %d: unexpected free err: %s", i, err)
+						}
+						continue
+					}
+					p, err := vm.alloc(s.alloc)
+					if err != nil {
+						t.Fatalf("step %d: unexpected alloc err: %s", i, err)
+					}
+					if p != s.expected {
+						t.Fatalf("step %d: expected alloc %d at %d but was: %d", i, s.alloc, s.expected, p)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestAllocZeroes(t *testing.T) {
+	vm := allocMachine()
+	p, _ := vm.alloc(3)
+	vm.Memory[p] = 7
+	vm.Memory[p+2] = 9
+	vm.free(p)
+	q, _ := vm.alloc(3)
+	if q != p {
+		t.Fatalf("expected block %d to be reused but was: %d", p, q)
+	}
+	for addr := q; addr < q+3; addr++ {
+		if vm.Memory[addr] != 0 {
+			t.Errorf("expected zero at %d but was: %d", addr, vm.Memory[addr])
+		}
+	}
+}
+
+func TestAllocErrors(t *testing.T) {
+	testCases := map[string]struct {
+		debug    bool
+		run      func(vm *VirtualMachine) error
+		expected error
+	}{
+		"free outside the heap": {
+			run: func(vm *VirtualMachine) error {
+				return vm.free(5)
+			},
+			expected: ErrInvalidFree,
+		},
+		"free past the break": {
+			run: func(vm *VirtualMachine) error {
+				vm.alloc(1)
+				return vm.free(15)
+			},
+			expected: ErrInvalidFree,
+		},
+		"double free": {
+			run: func(vm *VirtualMachine) error {
+				p, _ := vm.alloc(1)
+				vm.alloc(1)
+				vm.free(p)
+				return vm.free(p)
+			},
+			expected: ErrDoubleFree,
+		},
+		"double free after merging": {
+			debug: true,
+			run: func(vm *VirtualMachine) error {
+				p, _ := vm.alloc(2)
+				q, _ := vm.alloc(2)
+				vm.alloc(1)
+				vm.free(p)
+				vm.free(q)
+				vm.alloc(1)
+				return vm.free(q)
+			},
+			expected: ErrDoubleFree,
+		},
+		"free inside a block": {
+			debug: true,
+			run: func(vm *VirtualMachine) error {
+				p, _ := vm.alloc(4)
+				return vm.free(p + 2)
+			},
+			expected: ErrInvalidFree,
+		},
+		"too large": {
+			run: func(vm *VirtualMachine) error {
+				_, err := vm.alloc(1 << 62)
+				return err
+			},
+			expected: ErrMemoryLimit,
+		},
+		"free list loops": {
+			run: func(vm *VirtualMachine) error {
+				p, _ := vm.alloc(2)
+				vm.alloc(1)
+				vm.free(p)
+				vm.Memory[p] = p - 1
+				_, err := vm.alloc(5)
+				return err
+			},
+			expected: ErrHeapCorrupted,
+		},
+		"free list goes backwards": {
+			run: func(vm *VirtualMachine) error {
+				p, _ := vm.alloc(1)
+				vm.alloc(1)
+				q, _ := vm.alloc(1)
+				r, _ := vm.alloc(1)
+				vm.free(p)
+				vm.free(q)
+				vm.Memory[q] = p - 1
+				return vm.free(r)
+			},
+			expected: ErrHeapCorrupted,
+		},
+		"bad break": {
+			run: func(vm *VirtualMachine) error {
+				vm.alloc(1)
+				vm.Memory[vm.AllocStart+breakWord] = 1 << 40
+				_, err := vm.alloc(1)
+				return err
+			},
+			expected: ErrHeapCorrupted,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			vm := allocMachine()
+			vm.HeapDebug = tc.debug
+			err := tc.run(vm)
+			if !errors.Is(err, tc.expected) {
+				t.Errorf("expected err: %s\nactual: %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestHeapDebugAccess(t *testing.T) {
+	vm := allocMachine()
+	vm.HeapDebug = true
+	p, _ := vm.alloc(2)
+	q, _ := vm.alloc(2)
+	vm.free(p)
+
+	testCases := map[uint64]error{
+		3:      nil,
+		9:      nil,
+		10:     ErrUseAfterFree,
+		p:      ErrUseAfterFree,
+		p + 1:  ErrUseAfterFree,
+		q - 1:  ErrUseAfterFree,
+		q:      nil,
+		q + 1:  nil,
+		q + 2:  ErrUseAfterFree,
+		q + 99: ErrUseAfterFree,
+	}
+	for addr, expected := range testCases {
+		err := vm.checkHeapAccess(addr)
+		if !errors.Is(err, expected) {
+			t.Errorf("expected err for address %d: %v\nactual: %v", addr, expected, err)
+		}
+	}
+
+	vm.HeapDebug = false
+	err := vm.checkHeapAccess(p)
+	if err != nil {
+		t.Errorf("unexpected err without heap debug: %s", err)
+	}
+}
@@ -0,0 +1,327 @@
+package vm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// BytecodeMagic opens every bytecode file.
+const BytecodeMagic = "VMBC"
+
+// BytecodeVersion is the version of the bytecode file format.
+const BytecodeVersion = uint32(3)
+
+// readChunkSize is the number of words read at a time by readWords.
+const readChunkSize = 1 << 12
+
+const maxSymbolName = 1 << 16
+
+var ErrInvalidBytecode = errors.New("invalid bytecode file")
+
+// BytecodeHeader follows the magic and version at the start of a bytecode file.
+// It is followed by CodeSize code words, HeapSize heap words, SymbolCount symbols
+// and the source map section.
+type BytecodeHeader struct {
+	IP          uint64
+	SP          uint64
+	StackStart  uint64
+	StackEnd    uint64
+	HeapStart   uint64
+	CodeSize    uint64
+	HeapSize    uint64
+	SymbolCount uint64
+}
+
+func LoadBytecodeFile(filePath string) (*VirtualMachine, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bytecode file: %w", err)
+	}
+	defer file.Close()
+
+	machine, err := ReadBytecode(bufio.NewReader(file))
+	if err != nil {
+		return nil, err
+	}
+	machine.Output = os.Stdout
+	machine.Input = os.Stdin
+
+	return machine, nil
+}
+
+func ReadBytecode(r io.Reader) (*VirtualMachine, error) {
+	magic := make([]byte, len(BytecodeMagic))
+	_, err := io.ReadFull(r, magic)
+	if err != nil {
+		return nil, readError("magic", err)
+	}
+	if string(magic) != BytecodeMagic {
+		return nil, fmt.Errorf("bad magic %q; %w", magic, ErrInvalidBytecode)
+	}
+
+	var version uint32
+	err = binary.Read(r, binary.LittleEndian, &version)
+	if err != nil {
+		return nil, readError("version", err)
+	}
+	if version != BytecodeVersion {
+		return nil, fmt.Errorf("unsupported version %d; %w", version, ErrInvalidBytecode)
+	}
+
+	header := BytecodeHeader{}
+	err = binary.Read(r, binary.LittleEndian, &header)
+	if err != nil {
+		return nil, readError("header", err)
+	}
+	err = header.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	code, err := readWords(r, header.CodeSize)
+	if err != nil {
+		return nil, readError("code", err)
+	}
+	heap, err := readWords(r, header.HeapSize)
+	if err != nil {
+		return nil, readError("heap", err)
+	}
+	machine := &VirtualMachine{
+		Memory:     make([]uint64, header.HeapStart+header.HeapSize),
+		IP:         header.IP,
+		SP:         header.SP,
+		StackStart: header.StackStart,
+		StackEnd:   header.StackEnd,
+		HeapStart:  header.HeapStart,
+		AllocStart: header.HeapStart + header.HeapSize,
+		CodeEnd:    header.CodeSize,
+	}
+
+	copy(machine.Memory, code)
+	copy(machine.Memory[header.HeapStart:], heap)
+
+	for i := uint64(0); i < header.SymbolCount; i++ {
+		sym, err := ReadSymbol(r)
+		if err != nil {
+			return nil, err
+		}
+		machine.Symbols = append(machine.Symbols, sym)
+	}
+
+	machine.SourceMap, err = ReadSourceMap(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return machine, nil
+}
+
+func (header BytecodeHeader) validate() error {
+	if header.HeapStart > DefaultMaxMemory || header.HeapSize > DefaultMaxMemory-header.HeapStart {
+		return fmt.Errorf("image too large; %w", ErrInvalidBytecode)
+	}
+	if header.CodeSize > header.StackStart || header.StackStart > header.SP || header.SP >= header.StackEnd || header.StackEnd > header.HeapStart {
+		return fmt.Errorf("inconsistent memory layout; %w", ErrInvalidBytecode)
+	}
+	if header.IP >= header.CodeSize {
+		return fmt.Errorf("ip outside code; %w", ErrInvalidBytecode)
+	}
+	return nil
+}
+
+type symbolEntry struct {
+	Kind    SymbolKind
+	Address uint64
+	NameLen uint32
+}
+
+// ReadSymbol reads a symbol table entry written by WriteSymbol.
+func ReadSymbol(r io.Reader) (Symbol, error) {
+	entry := symbolEntry{}
+	err := binary.Read(r, binary.LittleEndian, &entry)
+	if err != nil {
+		return Symbol{}, readError("symbol", err)
+	}
+	if entry.NameLen > maxSymbolName {
+		return Symbol{}, fmt.Errorf("symbol name too long; %w", ErrInvalidBytecode)
+	}
+	name := make([]byte, entry.NameLen)
+	_, err = io.ReadFull(r, name)
+	if err != nil {
+		return Symbol{}, readError("symbol name", err)
+	}
+	return Symbol{
+		Name:    string(name),
+		Kind:    entry.Kind,
+		Address: entry.Address,
+	}, nil
+}
+
+// readWords reads n words a chunk at a time, so that a stream shorter than
+// its header claims fails before all n words are allocated.
+func readWords(r io.Reader, n uint64) ([]uint64, error) {
+	words := []uint64{}
+	for remaining := n; remaining > 0; {
+		size := remaining
+		if size > readChunkSize {
+			size = readChunkSize
+		}
+		chunk := make([]uint64, size)
+		err := binary.Read(r, binary.LittleEndian, chunk)
+		if err != nil {
+			return nil, err
+		}
+		words = append(words, chunk...)
+		remaining -= size
+	}
+	return words, nil
+}
+
+func readError(section string, err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("truncated %s; %w", section, ErrInvalidBytecode)
+	}
+	return fmt.Errorf("failed to read %s: %w", section, err)
+}
+
+// WriteSymbol writes a symbol table entry in the bytecode file format.
+func WriteSymbol(w io.Writer, sym Symbol) error {
+	if len(sym.Name) > maxSymbolName {
+		return fmt.Errorf("symbol name too long: %s", sym.Name)
+	}
+	entry := symbolEntry{
+		Kind:    sym.Kind,
+		Address: sym.Address,
+		NameLen: uint32(len(sym.Name)),
+	}
+	err := binary.Write(w, binary.LittleEndian, entry)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, sym.Name)
+	return err
+}
+
+type sourceMapEntry struct {
+	Address uint64
+	File    uint32
+	Line    uint32
+	Column  uint32
+}
+
+// WriteSourceMap writes the source map section: a count of file names,
+// the names, a count of entries and the entries.
+func WriteSourceMap(w io.Writer, sm SourceMap) error {
+	files := []string{}
+	fileIndex := map[string]uint32{}
+	for _, entry := range sm {
+		file := entry.Location.File
+		if _, exists := fileIndex[file]; !exists {
+			fileIndex[file] = uint32(len(files))
+			files = append(files, file)
+		}
+	}
+
+	err := binary.Write(w, binary.LittleEndian, uint32(len(files)))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		err = writeString(w, file)
+		if err != nil {
+			return err
+		}
+	}
+	err = binary.Write(w, binary.LittleEndian, uint64(len(sm)))
+	if err != nil {
+		return err
+	}
+	for _, entry := range sm {
+		err = binary.Write(w, binary.LittleEndian, sourceMapEntry{
+			Address: entry.Address,
+			File:    fileIndex[entry.Location.File],
+			Line:    uint32(entry.Location.Line),
+			Column:  uint32(entry.Location.Column),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadSourceMap reads a source map section written by WriteSourceMap.
+func ReadSourceMap(r io.Reader) (SourceMap, error) {
+	var fileCount uint32
+	err := binary.Read(r, binary.LittleEndian, &fileCount)
+	if err != nil {
+		return nil, readError("source files", err)
+	}
+	files := []string{}
+	for i := uint32(0); i < fileCount; i++ {
+		file, err := readString(r)
+		if err != nil {
+			return nil, readError("source file", err)
+		}
+		files = append(files, file)
+	}
+
+	var entryCount uint64
+	err = binary.Read(r, binary.LittleEndian, &entryCount)
+	if err != nil {
+		return nil, readError("source map", err)
+	}
+	var sm SourceMap
+	for i := uint64(0); i < entryCount; i++ {
+		entry := sourceMapEntry{}
+		err = binary.Read(r, binary.LittleEndian, &entry)
+		if err != nil {
+			return nil, readError("source map", err)
+		}
+		if entry.File >= uint32(len(files)) {
+			return nil, fmt.Errorf("bad source file index; %w", ErrInvalidBytecode)
+		}
+		sm = append(sm, SourceMapEntry{
+			Address: entry.Address,
+			Location: SourceLocation{
+				File:   files[entry.File],
+				Line:   int(entry.Line),
+				Column: int(entry.Column),
+			},
+		})
+	}
+	return sm, nil
+}
+
+func writeString(w io.Writer, str string) error {
+	if len(str) > maxSymbolName {
+		return fmt.Errorf("string too long: %s", str)
+	}
+	err := binary.Write(w, binary.LittleEndian, uint32(len(str)))
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, str)
+	return err
+}
+
+func readString(r io.Reader) (string, error) {
+	var length uint32
+	err := binary.Read(r, binary.LittleEndian, &length)
+	if err != nil {
+		return "", err
+	}
+	if length > maxSymbolName {
+		return "", fmt.Errorf("string too long; %w", ErrInvalidBytecode)
+	}
+	bs := make([]byte, length)
+	_, err = io.ReadFull(r, bs)
+	if err != nil {
+		return "", err
+	}
+	return string(bs), nil
+}
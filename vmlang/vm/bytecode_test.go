@@ -0,0 +1,86 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"runtime"
+	"testing"
+)
+
+func TestReadBytecodeRejectsBadFiles(t *testing.T) {
+	header := func(h BytecodeHeader) []byte {
+		buf := &bytes.Buffer{}
+		buf.WriteString(BytecodeMagic)
+		binary.Write(buf, binary.LittleEndian, BytecodeVersion)
+		binary.Write(buf, binary.LittleEndian, h)
+		return buf.Bytes()
+	}
+	layout := BytecodeHeader{IP: 0, SP: 10, StackStart: 10, StackEnd: 20, HeapStart: 30, CodeSize: 2}
+
+	testCases := map[string][]byte{
+		"empty":     {},
+		"bad magic": []byte("ELF\x00\x01\x00\x00\x00"),
+		"bad version": func() []byte {
+			buf := &bytes.Buffer{}
+			buf.WriteString(BytecodeMagic)
+			binary.Write(buf, binary.LittleEndian, BytecodeVersion+1)
+			return buf.Bytes()
+		}(),
+		"truncated header": header(layout)[:20],
+		"truncated code":   header(layout),
+		"stack overlaps code": header(BytecodeHeader{
+			SP: 1, StackStart: 1, StackEnd: 20, HeapStart: 30, CodeSize: 2,
+		}),
+		"ip outside code": header(BytecodeHeader{
+			IP: 5, SP: 10, StackStart: 10, StackEnd: 20, HeapStart: 30, CodeSize: 2,
+		}),
+		"sp below stack start": header(BytecodeHeader{
+			SP: 10, StackStart: 12, StackEnd: 20, HeapStart: 30, CodeSize: 2,
+		}),
+		"image too large": header(BytecodeHeader{
+			SP: 10, StackStart: 10, StackEnd: 20, HeapStart: 1 << 30, HeapSize: 1 << 30, CodeSize: 2,
+		}),
+		"heap past the memory limit": header(BytecodeHeader{
+			SP: 10, StackStart: 10, StackEnd: 20, HeapStart: 30, HeapSize: DefaultMaxMemory, CodeSize: 2,
+		}),
+	}
+
+	for name, file := range testCases {
+		t.Run(name, func(t *testing.T) {
+			_, err := ReadBytecode(bytes.NewReader(file))
+			if !errors.Is(err, ErrInvalidBytecode) {
+				t.Errorf("expected err: %s\nactual: %s", ErrInvalidBytecode, err)
+			}
+		})
+	}
+}
+
+func TestReadBytecodeTruncatedLargeImage(t *testing.T) {
+	buf := &bytes.Buffer{}
+	buf.WriteString(BytecodeMagic)
+	binary.Write(buf, binary.LittleEndian, BytecodeVersion)
+	binary.Write(buf, binary.LittleEndian, BytecodeHeader{
+		SP:         1 << 24,
+		StackStart: 1 << 24,
+		StackEnd:   1<<24 + 10,
+		HeapStart:  1<<24 + 20,
+		CodeSize:   1 << 24,
+		HeapSize:   1 << 25,
+	})
+	binary.Write(buf, binary.LittleEndian, []uint64{uint64(Push), 1, uint64(Exit)})
+
+	before := runtime.MemStats{}
+	runtime.ReadMemStats(&before)
+	_, err := ReadBytecode(buf)
+	after := runtime.MemStats{}
+	runtime.ReadMemStats(&after)
+
+	if !errors.Is(err, ErrInvalidBytecode) {
+		t.Errorf("expected err: %s\nactual: %s", ErrInvalidBytecode, err)
+	}
+	allocated := after.TotalAlloc - before.TotalAlloc
+	if allocated > 1<<20 {
+		t.Errorf("expected a truncated file to fail before its image is allocated but %d bytes were allocated", allocated)
+	}
+}
@@ -0,0 +1,63 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrStackOverflow = errors.New("stack overflow")
+var ErrStackUnderflow = errors.New("stack underflow")
+var ErrCallStackOverflow = errors.New("call stack overflow")
+var ErrCallStackUnderflow = errors.New("call stack underflow")
+var ErrIPOutOfBounds = errors.New("instruction pointer out of bounds")
+var ErrWriteToCode = errors.New("write to code segment")
+var ErrMemoryOutOfBounds = errors.New("memory access out of bounds")
+var ErrUnknownBytecode = errors.New("unknown bytecode")
+var ErrDivisionByZero = errors.New("division by zero")
+var ErrInvalidInput = errors.New("invalid input")
+var ErrHalted = errors.New("machine has halted")
+var ErrStepLimit = errors.New("instruction limit exceeded")
+var ErrMemoryLimit = errors.New("memory limit exceeded")
+var ErrNoFrame = errors.New("no stack frame")
+var ErrLocalOutOfRange = errors.New("local variable out of range")
+var ErrInvalidFree = errors.New("free of memory that was not allocated")
+var ErrDoubleFree = errors.New("double free")
+var ErrUseAfterFree = errors.New("use of freed or unallocated memory")
+var ErrHeapCorrupted = errors.New("heap corrupted")
+
+// RuntimeError describes a failed instruction. Kind is one of the Err
+// sentinels above, the error returned by Input or Output, or the error of the
+// context given to ExecuteContext, and is matched by errors.Is.
+type RuntimeError struct {
+	IP   uint64
+	Op   Bytecode
+	SP   uint64
+	Kind error
+	// Source is the location of the failing instruction, when the machine has a source map.
+	Source *SourceLocation
+}
+
+func (err *RuntimeError) Error() string {
+	msg := fmt.Sprintf("%s; ip: %v; op: %v; sp: %v", err.Kind, err.IP, err.Op, err.SP)
+	if err.Source != nil {
+		return fmt.Sprintf("%s: %s", err.Source, msg)
+	}
+	return msg
+}
+
+func (err *RuntimeError) Unwrap() error {
+	return err.Kind
+}
+
+func (vm *VirtualMachine) runtimeError(ip uint64, op Bytecode, kind error) error {
+	runtimeErr := &RuntimeError{
+		IP:   ip,
+		Op:   op,
+		SP:   vm.SP,
+		Kind: kind,
+	}
+	if loc, ok := vm.SourceLocation(ip); ok {
+		runtimeErr.Source = &loc
+	}
+	return runtimeErr
+}
@@ -0,0 +1,203 @@
+package vm
+
+import (
+	"fmt"
+	"math"
+)
+
+type Bytecode uint64
+
+const (
+	Push = Bytecode(iota + 1)
+	Pop
+	Increment
+	Decrement
+	Duplicate
+	ReadMemory
+	WriteMemory
+	OutputByte
+	Goto
+	JumpNotZero
+	Call
+	Return
+	Exit
+	Multiply
+	Add
+	Subtract
+	Divide
+	Modulo
+	And
+	Or
+	Xor
+	Not
+	ShiftLeft
+	ShiftRight
+	Equal
+	LessThan
+	GreaterThan
+	OutputDecimal
+	OutputString
+	InputByte
+	InputDecimal
+	GotoIndirect
+	CallIndirect
+	Swap
+	Over
+	Rotate
+	Pick
+	Roll
+	DropN
+	Enter
+	Leave
+	LoadLocal
+	StoreLocal
+	Alloc
+	Free
+	// Make sure you add new bytecodes to the opcodes table below.
+)
+
+// OperandKind says what an operand word holds.
+type OperandKind uint8
+
+const (
+	// ValueOperand is a number or heap address.
+	ValueOperand OperandKind = iota + 1
+	// CodeOperand is the address of an instruction.
+	CodeOperand
+)
+
+// OpInfo describes a bytecode. Step uses it to check the stack and the
+// operands before executing an op, and to move on to the next instruction
+// afterwards unless the op jumps.
+type OpInfo struct {
+	Mnemonic string
+	Operands []OperandKind
+	// Pops is the number of values the op needs on the stack, and Pushes
+	// the number it leaves in their place.
+	Pops   int
+	Pushes int
+	// Jumps is set if the op sets IP itself.
+	Jumps bool
+}
+
+// Size is the number of words the op takes in memory.
+func (info OpInfo) Size() uint64 {
+	return 1 + uint64(len(info.Operands))
+}
+
+var binaryOpInfo = OpInfo{Pops: 2, Pushes: 1}
+
+var opcodes = map[Bytecode]OpInfo{
+	Push:          {Mnemonic: "push", Operands: []OperandKind{ValueOperand}, Pushes: 1},
+	Pop:           {Mnemonic: "pop", Pops: 1},
+	Increment:     {Mnemonic: "incr", Pops: 1, Pushes: 1},
+	Decrement:     {Mnemonic: "decr", Pops: 1, Pushes: 1},
+	Duplicate:     {Mnemonic: "dupl", Pops: 1, Pushes: 2},
+	ReadMemory:    {Mnemonic: "rmem", Pops: 1, Pushes: 1},
+	WriteMemory:   {Mnemonic: "wmem", Pops: 2, Pushes: 1},
+	OutputByte:    {Mnemonic: "outb", Pops: 1, Pushes: 1},
+	Goto:          {Mnemonic: "goto", Operands: []OperandKind{CodeOperand}, Jumps: true},
+	JumpNotZero:   {Mnemonic: "jnz", Operands: []OperandKind{CodeOperand}, Pops: 1, Pushes: 1, Jumps: true},
+	Call:          {Mnemonic: "call", Operands: []OperandKind{CodeOperand}, Jumps: true},
+	Return:        {Mnemonic: "rtn", Jumps: true},
+	Exit:          {Mnemonic: "exit", Jumps: true},
+	Multiply:      binaryOpInfo.named("mult"),
+	Add:           binaryOpInfo.named("add"),
+	Subtract:      binaryOpInfo.named("sub"),
+	Divide:        binaryOpInfo.named("div"),
+	Modulo:        binaryOpInfo.named("mod"),
+	And:           binaryOpInfo.named("and"),
+	Or:            binaryOpInfo.named("or"),
+	Xor:           binaryOpInfo.named("xor"),
+	Not:           {Mnemonic: "not", Pops: 1, Pushes: 1},
+	ShiftLeft:     binaryOpInfo.named("shl"),
+	ShiftRight:    binaryOpInfo.named("shr"),
+	Equal:         binaryOpInfo.named("eq"),
+	LessThan:      binaryOpInfo.named("lt"),
+	GreaterThan:   binaryOpInfo.named("gt"),
+	OutputDecimal: {Mnemonic: "outd", Pops: 1, Pushes: 1},
+	OutputString:  {Mnemonic: "outs", Pops: 1, Pushes: 1},
+	InputByte:     {Mnemonic: "inb", Pushes: 1},
+	InputDecimal:  {Mnemonic: "ind", Pushes: 1},
+	GotoIndirect:  {Mnemonic: "gotos", Pops: 1, Jumps: true},
+	CallIndirect:  {Mnemonic: "calls", Pops: 1, Jumps: true},
+	Swap:          {Mnemonic: "swap", Pops: 2, Pushes: 2},
+	Over:          {Mnemonic: "over", Pops: 2, Pushes: 3},
+	Rotate:        {Mnemonic: "rot", Pops: 3, Pushes: 3},
+	// The operand of pick, roll and dropn is a count of values, so these
+	// entries give their effect when it is zero. See StackEffect.
+	Pick:  {Mnemonic: "pick", Operands: []OperandKind{ValueOperand}, Pops: 1, Pushes: 2},
+	Roll:  {Mnemonic: "roll", Operands: []OperandKind{ValueOperand}, Pops: 1, Pushes: 1},
+	DropN: {Mnemonic: "dropn", Operands: []OperandKind{ValueOperand}},
+	// enter n takes n values as locals. leave keeps the values pushed since
+	// enter, so its effect depends on the frame rather than on this entry.
+	Enter:      {Mnemonic: "enter", Operands: []OperandKind{ValueOperand}, Pushes: 2},
+	Leave:      {Mnemonic: "leave"},
+	LoadLocal:  {Mnemonic: "lload", Operands: []OperandKind{ValueOperand}, Pushes: 1},
+	StoreLocal: {Mnemonic: "lstore", Operands: []OperandKind{ValueOperand}, Pops: 1},
+	Alloc:      {Mnemonic: "alloc", Pops: 1, Pushes: 1},
+	Free:       {Mnemonic: "free", Pops: 1},
+}
+
+// maxStackOperand caps the count operand in StackEffect, so that the
+// result fits in an int. No stack holds that many values.
+const maxStackOperand = math.MaxInt - 2
+
+// StackEffect returns the number of values the op needs on the stack and
+// the number it leaves in their place, given the operand words that follow
+// it. These are Pops and Pushes, except for pick n and roll n, which reach
+// n values below the top, enter n, which takes n values into its frame,
+// and dropn n, which pops n values.
+func (code Bytecode) StackEffect(operands []uint64) (pops, pushes int) {
+	info, _ := code.Info()
+	if code != Pick && code != Roll && code != DropN && code != Enter {
+		return info.Pops, info.Pushes
+	}
+	n := maxStackOperand
+	if len(operands) > 0 && operands[0] < maxStackOperand {
+		n = int(operands[0])
+	}
+	if code == DropN {
+		return n, 0
+	}
+	return info.Pops + n, info.Pushes + n
+}
+
+func (info OpInfo) named(mnemonic string) OpInfo {
+	info.Mnemonic = mnemonic
+	return info
+}
+
+// Info describes a bytecode, or returns false if it is unknown.
+func (code Bytecode) Info() (OpInfo, bool) {
+	info, ok := opcodes[code]
+	return info, ok
+}
+
+// Bytecodes lists every known bytecode in order.
+func Bytecodes() []Bytecode {
+	bc := []Bytecode{}
+	for i := Push; i.IsValid(); i++ {
+		bc = append(bc, i)
+	}
+	return bc
+}
+
+func (code Bytecode) String() string {
+	info, ok := code.Info()
+	if !ok {
+		return fmt.Sprint(uint64(code))
+	}
+	return info.Mnemonic
+}
+
+func (code Bytecode) IsValid() bool {
+	_, ok := code.Info()
+	return ok
+}
+
+// OperandCount is the number of words following the bytecode in memory.
+func (code Bytecode) OperandCount() int {
+	info, _ := code.Info()
+	return len(info.Operands)
+}
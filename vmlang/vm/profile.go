@@ -0,0 +1,48 @@
+package vm
+
+// Profile counts what a machine does as it runs. Set VirtualMachine.Profile
+// to a new Profile to collect one.
+type Profile struct {
+	// Steps is the number of instructions executed.
+	Steps uint64
+	// AddressCounts counts the executions of the instruction at each address.
+	AddressCounts map[uint64]uint64
+	// OpCounts counts the executions of each op.
+	OpCounts map[Bytecode]uint64
+	// MaxStackDepth is the most values the stack has held.
+	MaxStackDepth uint64
+	// MaxCallDepth is the most subroutine calls that have been active at once.
+	MaxCallDepth uint64
+	// StartMemory is the size of memory, in words, when the first
+	// instruction was profiled, and PeakMemory the largest it has been since.
+	StartMemory uint64
+	PeakMemory  uint64
+}
+
+func NewProfile() *Profile {
+	return &Profile{
+		AddressCounts: map[uint64]uint64{},
+		OpCounts:      map[Bytecode]uint64{},
+	}
+}
+
+// record notes an instruction that has just executed, when memory held
+// memBefore words.
+func (prof *Profile) record(vm *VirtualMachine, addr uint64, op Bytecode, memBefore uint64) {
+	memSize := uint64(len(vm.Memory))
+	if prof.Steps == 0 {
+		prof.StartMemory = memBefore
+	}
+	prof.Steps++
+	prof.AddressCounts[addr]++
+	prof.OpCounts[op]++
+	if vm.SP > vm.StackStart && vm.SP-vm.StackStart > prof.MaxStackDepth {
+		prof.MaxStackDepth = vm.SP - vm.StackStart
+	}
+	if depth := uint64(len(vm.CallStack)); depth > prof.MaxCallDepth {
+		prof.MaxCallDepth = depth
+	}
+	if memSize > prof.PeakMemory {
+		prof.PeakMemory = memSize
+	}
+}
@@ -0,0 +1,322 @@
+package vm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// SnapshotMagic opens every snapshot file.
+const SnapshotMagic = "VMSS"
+
+// SnapshotVersion is the version of the snapshot file format.
+const SnapshotVersion = uint32(3)
+
+// snapshotZeroRun is the number of zero words that ends a memory segment,
+// so that the gaps and the unused stack are not written out.
+const snapshotZeroRun = 8
+
+var ErrInvalidSnapshot = errors.New("invalid snapshot file")
+
+// SnapshotHeader follows the magic and version at the start of a snapshot
+// file. It is followed by CallDepth return addresses, SegmentCount memory
+// segments, SymbolCount symbols and the source map section.
+type SnapshotHeader struct {
+	IP           uint64
+	SP           uint64
+	FP           uint64
+	StackStart   uint64
+	StackEnd     uint64
+	HeapStart    uint64
+	AllocStart   uint64
+	CodeEnd      uint64
+	MemorySize   uint64
+	Steps        uint64
+	MaxSteps     uint64
+	MaxCallDepth uint64
+	MaxMemory    uint64
+	InputOffset  uint64
+	OutputOffset uint64
+	Halted       uint64
+	HeapDebug    uint64
+	CallDepth    uint64
+	SegmentCount uint64
+	SymbolCount  uint64
+}
+
+// segmentHeader is followed by Length words of memory starting at Address.
+type segmentHeader struct {
+	Address uint64
+	Length  uint64
+}
+
+// SaveSnapshotFile writes a snapshot of the machine to a file.
+func (vm *VirtualMachine) SaveSnapshotFile(filePath string) error {
+	file, err := os.Create(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot file: %w", err)
+	}
+	w := bufio.NewWriter(file)
+	err = vm.Snapshot(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	closeErr := file.Close()
+	if err != nil {
+		return fmt.Errorf("failed to write snapshot file: %w", err)
+	}
+	return closeErr
+}
+
+// Snapshot writes the state of the machine, so that Restore can carry on
+// running it later. Input, Output, Profile and Tracer are not saved, but
+// InputOffset and OutputOffset are.
+func (vm *VirtualMachine) Snapshot(w io.Writer) error {
+	segments := vm.memorySegments()
+	header := SnapshotHeader{
+		IP:           vm.IP,
+		SP:           vm.SP,
+		FP:           vm.FP,
+		StackStart:   vm.StackStart,
+		StackEnd:     vm.StackEnd,
+		HeapStart:    vm.HeapStart,
+		AllocStart:   vm.AllocStart,
+		CodeEnd:      vm.CodeEnd,
+		MemorySize:   uint64(len(vm.Memory)),
+		Steps:        vm.Steps,
+		MaxSteps:     vm.MaxSteps,
+		MaxCallDepth: vm.MaxCallDepth,
+		MaxMemory:    vm.MaxMemory,
+		InputOffset:  vm.InputOffset,
+		OutputOffset: vm.OutputOffset,
+		CallDepth:    uint64(len(vm.CallStack)),
+		SegmentCount: uint64(len(segments)),
+		SymbolCount:  uint64(len(vm.Symbols)),
+	}
+	if vm.Halted {
+		header.Halted = 1
+	}
+	if vm.HeapDebug {
+		header.HeapDebug = 1
+	}
+
+	_, err := io.WriteString(w, SnapshotMagic)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(w, binary.LittleEndian, SnapshotVersion)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(w, binary.LittleEndian, header)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(w, binary.LittleEndian, vm.CallStack)
+	if err != nil {
+		return err
+	}
+	for _, seg := range segments {
+		err = binary.Write(w, binary.LittleEndian, seg)
+		if err != nil {
+			return err
+		}
+		err = binary.Write(w, binary.LittleEndian, vm.Memory[seg.Address:seg.Address+seg.Length])
+		if err != nil {
+			return err
+		}
+	}
+	for _, sym := range vm.Symbols {
+		err = WriteSymbol(w, sym)
+		if err != nil {
+			return err
+		}
+	}
+	return WriteSourceMap(w, vm.SourceMap)
+}
+
+// memorySegments finds the runs of memory holding anything but zero.
+func (vm *VirtualMachine) memorySegments() []segmentHeader {
+	segments := []segmentHeader{}
+	memSize := uint64(len(vm.Memory))
+	for addr := uint64(0); addr < memSize; addr++ {
+		if vm.Memory[addr] == 0 {
+			continue
+		}
+		start := addr
+		end := addr + 1
+		for addr = end; addr < memSize && addr-end < snapshotZeroRun; addr++ {
+			if vm.Memory[addr] != 0 {
+				end = addr + 1
+			}
+		}
+		segments = append(segments, segmentHeader{Address: start, Length: end - start})
+		addr = end
+	}
+	return segments
+}
+
+// LoadSnapshotFile restores a machine from a snapshot file, reading from
+// stdin and writing to stdout.
+func LoadSnapshotFile(filePath string) (*VirtualMachine, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open snapshot file: %w", err)
+	}
+	defer file.Close()
+
+	machine, err := Restore(bufio.NewReader(file))
+	if err != nil {
+		return nil, err
+	}
+	machine.Output = os.Stdout
+	machine.Input = os.Stdin
+
+	return machine, nil
+}
+
+// Restore reads a machine written by Snapshot.
+func Restore(r io.Reader) (*VirtualMachine, error) {
+	magic := make([]byte, len(SnapshotMagic))
+	_, err := io.ReadFull(r, magic)
+	if err != nil {
+		return nil, snapshotReadError("magic", err)
+	}
+	if string(magic) != SnapshotMagic {
+		return nil, fmt.Errorf("bad magic %q; %w", magic, ErrInvalidSnapshot)
+	}
+
+	var version uint32
+	err = binary.Read(r, binary.LittleEndian, &version)
+	if err != nil {
+		return nil, snapshotReadError("version", err)
+	}
+	if version != SnapshotVersion {
+		return nil, fmt.Errorf("unsupported version %d; %w", version, ErrInvalidSnapshot)
+	}
+
+	header := SnapshotHeader{}
+	err = binary.Read(r, binary.LittleEndian, &header)
+	if err != nil {
+		return nil, snapshotReadError("header", err)
+	}
+	err = header.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	callStack, err := readWords(r, header.CallDepth)
+	if err != nil {
+		return nil, snapshotReadError("call stack", err)
+	}
+	type segment struct {
+		address uint64
+		words   []uint64
+	}
+	segments := []segment{}
+	for i := uint64(0); i < header.SegmentCount; i++ {
+		seg := segmentHeader{}
+		err = binary.Read(r, binary.LittleEndian, &seg)
+		if err != nil {
+			return nil, snapshotReadError("memory", err)
+		}
+		if seg.Address > header.MemorySize || seg.Length > header.MemorySize-seg.Address {
+			return nil, fmt.Errorf("memory segment outside memory; %w", ErrInvalidSnapshot)
+		}
+		words, err := readWords(r, seg.Length)
+		if err != nil {
+			return nil, snapshotReadError("memory", err)
+		}
+		segments = append(segments, segment{address: seg.Address, words: words})
+	}
+
+	machine := &VirtualMachine{
+		Memory:       make([]uint64, header.MemorySize),
+		IP:           header.IP,
+		SP:           header.SP,
+		FP:           header.FP,
+		StackStart:   header.StackStart,
+		StackEnd:     header.StackEnd,
+		HeapStart:    header.HeapStart,
+		AllocStart:   header.AllocStart,
+		CodeEnd:      header.CodeEnd,
+		Steps:        header.Steps,
+		MaxSteps:     header.MaxSteps,
+		MaxCallDepth: header.MaxCallDepth,
+		MaxMemory:    header.MaxMemory,
+		InputOffset:  header.InputOffset,
+		OutputOffset: header.OutputOffset,
+		Halted:       header.Halted != 0,
+		HeapDebug:    header.HeapDebug != 0,
+	}
+	if header.CallDepth > 0 {
+		machine.CallStack = callStack
+	}
+	for _, seg := range segments {
+		copy(machine.Memory[seg.address:], seg.words)
+	}
+
+	for i := uint64(0); i < header.SymbolCount; i++ {
+		sym, err := ReadSymbol(r)
+		if err != nil {
+			return nil, snapshotError(err)
+		}
+		machine.Symbols = append(machine.Symbols, sym)
+	}
+
+	machine.SourceMap, err = ReadSourceMap(r)
+	if err != nil {
+		return nil, snapshotError(err)
+	}
+
+	return machine, nil
+}
+
+func (header SnapshotHeader) validate() error {
+	memoryLimit := header.MaxMemory
+	if memoryLimit == 0 {
+		memoryLimit = DefaultMaxMemory
+	}
+	if header.MemorySize > memoryLimit {
+		return fmt.Errorf("image too large; %w", ErrInvalidSnapshot)
+	}
+	if header.CodeEnd > header.StackStart || header.StackStart > header.SP || header.SP >= header.StackEnd ||
+		header.StackEnd > header.HeapStart || header.HeapStart > header.MemorySize {
+		return fmt.Errorf("inconsistent memory layout; %w", ErrInvalidSnapshot)
+	}
+	if header.AllocStart != 0 && (header.AllocStart < header.HeapStart || header.AllocStart > header.MemorySize) {
+		return fmt.Errorf("allocator outside the heap; %w", ErrInvalidSnapshot)
+	}
+	if header.FP != 0 && (header.FP <= header.StackStart || header.FP > header.SP) {
+		return fmt.Errorf("frame pointer outside the stack; %w", ErrInvalidSnapshot)
+	}
+	maxDepth := header.MaxCallDepth
+	if maxDepth == 0 {
+		maxDepth = DefaultMaxCallDepth
+	}
+	if header.CallDepth > maxDepth {
+		return fmt.Errorf("call stack too deep; %w", ErrInvalidSnapshot)
+	}
+	return nil
+}
+
+// snapshotError reports a failure in a section shared with the bytecode
+// format as an invalid snapshot.
+func snapshotError(err error) error {
+	if errors.Is(err, ErrInvalidBytecode) {
+		msg := strings.TrimSuffix(err.Error(), "; "+ErrInvalidBytecode.Error())
+		return fmt.Errorf("%s; %w", msg, ErrInvalidSnapshot)
+	}
+	return err
+}
+
+func snapshotReadError(section string, err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("truncated %s; %w", section, ErrInvalidSnapshot)
+	}
+	return fmt.Errorf("failed to read %s: %w", section, err)
+}
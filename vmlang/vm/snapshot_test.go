@@ -0,0 +1,185 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// echoMachine echoes its input, calling a subroutine with a stack frame to
+// write each byte so that snapshots catch a non-empty call stack and FP.
+func echoMachine() *VirtualMachine {
+	// loop: inb; dupl; incr; jnz out; exit; out: pop; call write; goto loop
+	// write: enter 1; lload 0; outb; pop; leave; return
+	code := []uint64{
+		uint64(InputByte), uint64(Duplicate), uint64(Increment), uint64(JumpNotZero), 6, uint64(Exit),
+		uint64(Pop), uint64(Call), 11, uint64(Goto), 0,
+		uint64(Enter), 1, uint64(LoadLocal), 0, uint64(OutputByte), uint64(Pop), uint64(Leave), uint64(Return),
+	}
+	memory := make([]uint64, 40)
+	copy(memory, code)
+	return &VirtualMachine{
+		Memory:     memory,
+		CodeEnd:    uint64(len(code)),
+		SP:         uint64(len(code)),
+		StackStart: uint64(len(code)),
+		StackEnd:   30,
+		HeapStart:  30,
+		AllocStart: 40,
+		HeapDebug:  true,
+		Symbols:    []Symbol{{Name: "loop", Address: 0}, {Name: "write", Address: 11}},
+		SourceMap:  []SourceMapEntry{{Address: 0, Location: SourceLocation{File: "echo.vmsm", Line: 1, Column: 1}}},
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	const input = "snapshot"
+	for _, at := range []uint64{1, 5, 7, 9, 20, 33} {
+		vm := echoMachine()
+		output := &bytes.Buffer{}
+		vm.Output = output
+		vm.Input = strings.NewReader(input)
+		vm.MaxSteps = at
+		err := vm.Execute()
+		if !errors.Is(err, ErrStepLimit) {
+			t.Fatalf("expected step limit after %d steps but was: %v", at, err)
+		}
+		vm.MaxSteps = 0
+
+		buf := &bytes.Buffer{}
+		err = vm.Snapshot(buf)
+		if err != nil {
+			t.Fatalf("unexpected snapshot err: %s", err)
+		}
+		restored, err := Restore(buf)
+		if err != nil {
+			t.Fatalf("unexpected restore err: %s", err)
+		}
+		if restored.IP != vm.IP || restored.SP != vm.SP || restored.FP != vm.FP || restored.Steps != at ||
+			restored.AllocStart != vm.AllocStart || restored.HeapDebug != vm.HeapDebug ||
+			!reflect.DeepEqual(append([]uint64{}, restored.CallStack...), append([]uint64{}, vm.CallStack...)) ||
+			!reflect.DeepEqual(restored.Memory, vm.Memory) ||
+			!reflect.DeepEqual(restored.Symbols, vm.Symbols) ||
+			!reflect.DeepEqual(restored.SourceMap, vm.SourceMap) {
+			t.Fatalf("expected restored machine to match after %d steps:\n%+v\nactual:\n%+v", at, vm, restored)
+		}
+		if restored.OutputOffset != uint64(output.Len()) {
+			t.Errorf("expected output offset %d but was: %d", output.Len(), restored.OutputOffset)
+		}
+
+		restored.Output = output
+		restored.Input = strings.NewReader(input[restored.InputOffset:])
+		err = restored.Execute()
+		if err != nil {
+			t.Fatalf("unexpected err resuming after %d steps: %s", at, err)
+		}
+		if output.String() != input {
+			t.Errorf("expected output %q resuming after %d steps but was: %q", input, at, output.String())
+		}
+	}
+}
+
+func TestRestoreRejectsBadFiles(t *testing.T) {
+	snapshot := &bytes.Buffer{}
+	err := echoMachine().Snapshot(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := snapshot.Bytes()
+	header := func(h SnapshotHeader) []byte {
+		buf := &bytes.Buffer{}
+		buf.WriteString(SnapshotMagic)
+		binary.Write(buf, binary.LittleEndian, SnapshotVersion)
+		binary.Write(buf, binary.LittleEndian, h)
+		return buf.Bytes()
+	}
+
+	testCases := map[string][]byte{
+		"empty":             {},
+		"bad magic":         []byte("VMBC\x01\x00\x00\x00"),
+		"truncated header":  valid[:30],
+		"truncated memory":  valid[:len(valid)/2],
+		"truncated symbols": valid[:len(valid)-20],
+		"bad layout": header(SnapshotHeader{
+			SP: 1, StackStart: 2, StackEnd: 20, HeapStart: 30, MemorySize: 40,
+		}),
+		"frame outside the stack": header(SnapshotHeader{
+			SP: 12, FP: 14, StackStart: 10, StackEnd: 20, HeapStart: 30, MemorySize: 40,
+		}),
+		"allocator outside the heap": header(SnapshotHeader{
+			SP: 10, StackStart: 10, StackEnd: 20, HeapStart: 30, AllocStart: 20, MemorySize: 40,
+		}),
+		"memory past the memory limit": header(SnapshotHeader{
+			SP: 10, StackStart: 10, StackEnd: 20, HeapStart: 30, MemorySize: DefaultMaxMemory + 1,
+		}),
+		"memory past its own limit": header(SnapshotHeader{
+			SP: 10, StackStart: 10, StackEnd: 20, HeapStart: 30, MemorySize: 200, MaxMemory: 100,
+		}),
+		"call stack too deep": header(SnapshotHeader{
+			SP: 10, StackStart: 10, StackEnd: 20, HeapStart: 30, MemorySize: 40, CallDepth: DefaultMaxCallDepth + 1,
+		}),
+		"segment outside memory": append(header(SnapshotHeader{
+			SP: 10, StackStart: 10, StackEnd: 20, HeapStart: 30, MemorySize: 40, SegmentCount: 1,
+		}), 38, 0, 0, 0, 0, 0, 0, 0, 4, 0, 0, 0, 0, 0, 0, 0),
+	}
+
+	for name, file := range testCases {
+		t.Run(name, func(t *testing.T) {
+			_, err := Restore(bytes.NewReader(file))
+			if !errors.Is(err, ErrInvalidSnapshot) {
+				t.Errorf("expected err: %s\nactual: %s", ErrInvalidSnapshot, err)
+			}
+		})
+	}
+}
+
+func TestRestoreTruncatedLargeImage(t *testing.T) {
+	buf := &bytes.Buffer{}
+	buf.WriteString(SnapshotMagic)
+	binary.Write(buf, binary.LittleEndian, SnapshotVersion)
+	binary.Write(buf, binary.LittleEndian, SnapshotHeader{
+		SP:           10,
+		StackStart:   10,
+		StackEnd:     20,
+		HeapStart:    30,
+		MemorySize:   DefaultMaxMemory,
+		SegmentCount: 1,
+	})
+	binary.Write(buf, binary.LittleEndian, segmentHeader{Address: 0, Length: DefaultMaxMemory})
+	binary.Write(buf, binary.LittleEndian, []uint64{uint64(Push), 1, uint64(Exit)})
+
+	before := runtime.MemStats{}
+	runtime.ReadMemStats(&before)
+	_, err := Restore(buf)
+	after := runtime.MemStats{}
+	runtime.ReadMemStats(&after)
+
+	if !errors.Is(err, ErrInvalidSnapshot) {
+		t.Errorf("expected err: %s\nactual: %s", ErrInvalidSnapshot, err)
+	}
+	allocated := after.TotalAlloc - before.TotalAlloc
+	if allocated > 1<<20 {
+		t.Errorf("expected a truncated snapshot to fail before its memory is allocated but %d bytes were allocated", allocated)
+	}
+}
+
+func TestInputOffset(t *testing.T) {
+	vm := &VirtualMachine{
+		Memory:   []uint64{uint64(InputDecimal), uint64(InputByte), uint64(OutputDecimal), uint64(Exit), 0, 0, 0, 0, 0},
+		SP:       4,
+		StackEnd: 9,
+		Input:    strings.NewReader("  42xyz"),
+		Output:   &bytes.Buffer{},
+	}
+	err := vm.Execute()
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	if vm.InputOffset != 5 || vm.OutputOffset != 3 {
+		t.Errorf("expected input offset 5 and output offset 3 but was: %d and %d", vm.InputOffset, vm.OutputOffset)
+	}
+}
@@ -0,0 +1,61 @@
+package vm
+
+import (
+	"fmt"
+	"sort"
+)
+
+// SourceLocation is a position in an assembly source file.
+type SourceLocation struct {
+	File   string
+	Line   int
+	Column int
+}
+
+func (loc SourceLocation) String() string {
+	if loc.File == "" {
+		return fmt.Sprintf("%d:%d", loc.Line, loc.Column)
+	}
+	return fmt.Sprintf("%s:%d:%d", loc.File, loc.Line, loc.Column)
+}
+
+// SourceMapEntry records the source of the instruction starting at Address.
+type SourceMapEntry struct {
+	Address  uint64
+	Location SourceLocation
+}
+
+// SourceMap is sorted by address.
+type SourceMap []SourceMapEntry
+
+// Lookup finds the source of the instruction in code containing addr, which
+// may be an operand address. An address past the operands of the last
+// instruction with an entry, such as the exit the assembler adds to the end
+// of a program, has no source.
+func (sm SourceMap) Lookup(code []uint64, addr uint64) (SourceLocation, bool) {
+	i := sort.Search(len(sm), func(i int) bool {
+		return sm[i].Address > addr
+	})
+	if i == 0 {
+		return SourceLocation{}, false
+	}
+	entry := sm[i-1]
+	size := uint64(1)
+	if entry.Address < uint64(len(code)) {
+		if info, ok := Bytecode(code[entry.Address]).Info(); ok {
+			size = info.Size()
+		}
+	}
+	if addr-entry.Address >= size {
+		return SourceLocation{}, false
+	}
+	return entry.Location, true
+}
+
+// SourceLocation finds the source of the instruction at addr in the code segment.
+func (vm *VirtualMachine) SourceLocation(addr uint64) (SourceLocation, bool) {
+	if vm.CodeEnd != 0 && addr >= vm.CodeEnd {
+		return SourceLocation{}, false
+	}
+	return vm.SourceMap.Lookup(vm.Memory, addr)
+}
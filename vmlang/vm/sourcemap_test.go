@@ -0,0 +1,72 @@
+package vm
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestSourceMapLookup(t *testing.T) {
+	code := []uint64{uint64(Push), 1, uint64(Pop), uint64(Push), 2, uint64(Exit)}
+	sm := SourceMap{
+		{Address: 0, Location: SourceLocation{File: "a.vmsm", Line: 2, Column: 1}},
+		{Address: 2, Location: SourceLocation{File: "a.vmsm", Line: 3, Column: 5}},
+		{Address: 3, Location: SourceLocation{File: "a.vmsm", Line: 7, Column: 1}},
+	}
+
+	testCases := map[uint64]string{
+		0: "a.vmsm:2:1",
+		1: "a.vmsm:2:1",
+		2: "a.vmsm:3:5",
+		3: "a.vmsm:7:1",
+		4: "a.vmsm:7:1",
+	}
+	for addr, expected := range testCases {
+		loc, ok := sm.Lookup(code, addr)
+		if !ok {
+			t.Errorf("expected location for address %v", addr)
+			continue
+		}
+		if loc.String() != expected {
+			t.Errorf("expected location %v for address %v but was: %v", expected, addr, loc)
+		}
+	}
+
+	for _, addr := range []uint64{5, 9} {
+		loc, ok := sm.Lookup(code, addr)
+		if ok {
+			t.Errorf("expected no location past the last mapped instruction for address %v but was: %v", addr, loc)
+		}
+	}
+
+	_, ok := SourceMap{{Address: 4}}.Lookup(code, 3)
+	if ok {
+		t.Errorf("expected no location before the first entry")
+	}
+}
+
+func TestRuntimeErrorReportsSource(t *testing.T) {
+	vm := &VirtualMachine{
+		Memory:     []uint64{uint64(Push), 1, uint64(Pop), uint64(Pop), uint64(Exit), 0, 0, 0},
+		CodeEnd:    5,
+		SP:         5,
+		StackStart: 5,
+		StackEnd:   8,
+		Output:     &bytes.Buffer{},
+		SourceMap: SourceMap{
+			{Address: 0, Location: SourceLocation{File: "pop.vmsm", Line: 1, Column: 1}},
+			{Address: 2, Location: SourceLocation{File: "pop.vmsm", Line: 2, Column: 1}},
+			{Address: 3, Location: SourceLocation{File: "pop.vmsm", Line: 3, Column: 3}},
+		},
+	}
+
+	err := vm.Execute()
+	runtimeErr := &RuntimeError{}
+	if !errors.As(err, &runtimeErr) {
+		t.Fatalf("expected RuntimeError but received: %v", err)
+	}
+	expected := "pop.vmsm:3:3: stack underflow; ip: 3; op: pop; sp: 5"
+	if runtimeErr.Error() != expected {
+		t.Errorf("expected error: %q but was: %q", expected, runtimeErr.Error())
+	}
+}
@@ -0,0 +1,58 @@
+package vm
+
+import "fmt"
+
+type SymbolKind uint8
+
+const (
+	LabelSymbol = SymbolKind(iota + 1)
+	VarSymbol
+	DataSymbol
+)
+
+func (kind SymbolKind) String() string {
+	switch kind {
+	case LabelSymbol:
+		return "label"
+	case VarSymbol:
+		return "var"
+	case DataSymbol:
+		return "data"
+	default:
+		return fmt.Sprint(uint8(kind))
+	}
+}
+
+// Symbol names an address in the program, as declared in the assembly source.
+type Symbol struct {
+	Name    string
+	Kind    SymbolKind
+	Address uint64
+}
+
+// LookupSymbol finds a symbol by name.
+func (vm *VirtualMachine) LookupSymbol(name string) (Symbol, bool) {
+	for _, sym := range vm.Symbols {
+		if sym.Name == name {
+			return sym, true
+		}
+	}
+	return Symbol{}, false
+}
+
+// NearestLabel finds the closest label at or before addr, so that an
+// address can be shown as an offset from a label.
+func (vm *VirtualMachine) NearestLabel(addr uint64) (Symbol, bool) {
+	nearest := Symbol{}
+	found := false
+	for _, sym := range vm.Symbols {
+		if sym.Kind != LabelSymbol || sym.Address > addr {
+			continue
+		}
+		if !found || sym.Address > nearest.Address {
+			nearest = sym
+			found = true
+		}
+	}
+	return nearest, found
+}
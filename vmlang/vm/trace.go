@@ -0,0 +1,49 @@
+package vm
+
+// TraceStackDepth is the number of values from the top of the stack given
+// to a Tracer.
+const TraceStackDepth = 4
+
+// Tracer observes a machine as it runs. BeforeStep is called with the
+// instruction at IP before it executes. AfterStep is called once it has
+// executed, with the stack as it was left and the error, if any, that Step
+// returns; by then IP holds the address of the next instruction.
+type Tracer interface {
+	BeforeStep(vm *VirtualMachine, step TraceStep)
+	AfterStep(vm *VirtualMachine, step TraceStep, err error)
+}
+
+// TraceStep describes an instruction and the state of the stack around it.
+type TraceStep struct {
+	// Step is the number of instructions executed before this one.
+	Step     uint64
+	IP       uint64
+	Op       Bytecode
+	Operands []uint64
+	// Stack holds up to TraceStackDepth values from the top of the stack,
+	// top first.
+	Stack []uint64
+	SP    uint64
+}
+
+func (vm *VirtualMachine) traceStep(ip uint64, op Bytecode, info OpInfo) TraceStep {
+	operands := make([]uint64, len(info.Operands))
+	copy(operands, vm.Memory[ip+1:])
+	return TraceStep{
+		Step:     vm.Steps,
+		IP:       ip,
+		Op:       op,
+		Operands: operands,
+		Stack:    vm.stackTop(),
+		SP:       vm.SP,
+	}
+}
+
+// stackTop copies up to TraceStackDepth values from the top of the stack.
+func (vm *VirtualMachine) stackTop() []uint64 {
+	top := []uint64{}
+	for sp := vm.SP; sp > vm.StackStart && len(top) < TraceStackDepth; sp-- {
+		top = append(top, vm.Memory[sp])
+	}
+	return top
+}
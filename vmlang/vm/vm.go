@@ -1,190 +1,705 @@
 package vm
 
 import (
-	"errors"
+	"bufio"
+	"context"
 	"fmt"
 	"io"
+	"strconv"
 )
 
+// DefaultMaxCallDepth is the call stack limit used when MaxCallDepth is zero.
+const DefaultMaxCallDepth = 10_000
+
+// DefaultMaxMemory is the memory limit, in words, used when MaxMemory is zero.
+const DefaultMaxMemory = 1 << 26
+
+// contextCheckInterval is the number of instructions ExecuteContext runs
+// between checks for cancellation.
+const contextCheckInterval = 1024
+
+// InputEOF is pushed by inb and ind when the input is exhausted.
+const InputEOF = ^uint64(0)
+
 type VirtualMachine struct {
-	Memory    []uint64
-	Output    io.Writer
-	SP        uint64
-	StackEnd  uint64
-	HeapStart uint64
+	Memory []uint64
+	Output io.Writer
+	Input  io.Reader
+	SP     uint64
+	// FP is the address of the stack frame made by the last enter, or zero
+	// outside of one.
+	FP uint64
+	// StackStart is the empty stack position; the first value pushed lives at StackStart+1.
+	StackStart uint64
+	StackEnd   uint64
+	HeapStart  uint64
+	// AllocStart is the address of the memory managed by alloc and free,
+	// after the variables and data in the heap. The end of memory is used
+	// when it is zero.
+	AllocStart uint64
+	// HeapDebug makes free check that it is given a block in use, and rmem
+	// and wmem check that memory from AllocStart is in such a block.
+	HeapDebug bool
 	IP        uint64
+	// CodeEnd is the address one past the last instruction of the program.
+	CodeEnd uint64
+	// CallStack holds the return addresses of active subroutine calls.
+	CallStack    []uint64
+	MaxCallDepth uint64
+	// MaxSteps limits the number of instructions executed. Zero means no limit.
+	MaxSteps uint64
+	// Steps counts the instructions executed so far.
+	Steps uint64
+	// MaxMemory limits the number of words of memory, which grows as the
+	// heap is used. DefaultMaxMemory is used when it is zero.
+	MaxMemory uint64
+	// Profile, if set, is updated after every instruction.
+	Profile *Profile
+	// Tracer, if set, is called before and after every instruction.
+	Tracer    Tracer
+	Symbols   []Symbol
+	SourceMap SourceMap
+	// Halted is set once the program executes exit.
+	Halted bool
+	// InputOffset counts the bytes consumed from Input and OutputOffset
+	// the bytes written to Output, so that a restored machine can carry on
+	// from the same place in both.
+	InputOffset  uint64
+	OutputOffset uint64
+
+	// input buffers Input so ind can look ahead one byte.
+	input       *bufio.Reader
+	inputSource io.Reader
 }
 
 func (vm *VirtualMachine) Execute() error {
-	const debug = false
-	for {
-		op := Bytecode(vm.Memory[vm.IP])
-		if debug {
-			fmt.Printf("vm debug; op: %v; sp: %v; ip: %v\n", op, vm.SP, vm.IP)
-		}
-		switch op {
-		case Push:
-			err := vm.incrementSP()
-			if err != nil {
-				return err
-			}
-			x := vm.Memory[vm.IP+1]
-			vm.Memory[vm.SP] = x
-			vm.IP += 2
-		case Pop:
-			vm.Memory[vm.SP] = 0
-			vm.SP--
-			vm.IP++
-		case Increment:
-			vm.Memory[vm.SP]++
-			vm.IP++
-		case Decrement:
-			vm.Memory[vm.SP]--
-			vm.IP++
-		case Duplicate:
-			x := vm.Memory[vm.SP]
-			err := vm.incrementSP()
-			if err != nil {
-				return err
-			}
-			vm.Memory[vm.SP] = x
-			vm.IP++
-		case ReadMemory:
-			i := vm.Memory[vm.SP]
-			vm.growMemory(i)
-			x := vm.Memory[i]
-			vm.Memory[vm.SP] = x
-			vm.IP++
-		case WriteMemory:
-			i := vm.Memory[vm.SP]
-			vm.growMemory(i)
-			x := vm.Memory[vm.SP-1]
-			vm.Memory[i] = x
-			vm.Memory[vm.SP] = 0
-			vm.SP--
-			vm.IP++
-		case OutputByte:
-			x := vm.Memory[vm.SP]
-			bs := []byte{byte(x)}
-			_, err := vm.Output.Write(bs)
+	return vm.ExecuteContext(context.Background())
+}
+
+// ExecuteContext runs the machine until it halts, fails or ctx is done. The
+// error for a done ctx matches ctx.Err() with errors.Is.
+func (vm *VirtualMachine) ExecuteContext(ctx context.Context) error {
+	for i := 0; !vm.Halted; i++ {
+		if i%contextCheckInterval == 0 {
+			err := ctx.Err()
 			if err != nil {
-				return err
+				return vm.runtimeError(vm.IP, vm.currentOp(), err)
 			}
-			vm.IP++
-		case Goto:
-			x := vm.Memory[vm.IP+1]
-			vm.IP = x
-		case JumpNotZero:
-			x := vm.Memory[vm.SP]
-			if x == 0 {
-				vm.IP++
-				continue
-			}
-			y := vm.Memory[vm.IP+1]
-			vm.IP = y
-		case Call:
-		case Return:
-		case Exit:
-			return nil
-		case Multiply:
-			first, second := vm.Memory[vm.SP], vm.Memory[vm.SP-1]
-			x := first * second
-			vm.Memory[vm.SP] = 0
-			vm.SP--
-			vm.Memory[vm.SP] = x
-			vm.IP++
-		default:
-			return fmt.Errorf("unknown bytecode: %v", op)
+		}
+		err := vm.Step()
+		if err != nil {
+			return err
 		}
 	}
+	return nil
 }
 
-func (vm *VirtualMachine) incrementSP() error {
-	vm.SP++
-	if vm.SP >= vm.StackEnd {
-		return errors.New("stack overflow")
+// Step executes the instruction at IP. Once exit has been executed the
+// machine is halted and Step returns ErrHalted.
+func (vm *VirtualMachine) Step() error {
+	if vm.Halted {
+		return ErrHalted
+	}
+	ip := vm.IP
+	if vm.MaxSteps != 0 && vm.Steps >= vm.MaxSteps {
+		return vm.runtimeError(ip, vm.currentOp(), ErrStepLimit)
+	}
+	memBefore := uint64(len(vm.Memory))
+	op, info, err := vm.fetch()
+	if err != nil {
+		return vm.runtimeError(ip, op, err)
+	}
+	var step TraceStep
+	if vm.Tracer != nil {
+		step = vm.traceStep(ip, op, info)
+		vm.Tracer.BeforeStep(vm, step)
 	}
+	err = vm.perform(op, info)
+	if err != nil {
+		err = vm.runtimeError(ip, op, err)
+	} else {
+		vm.finishStep(ip, op, memBefore)
+	}
+	if vm.Tracer != nil {
+		step.Stack = vm.stackTop()
+		step.SP = vm.SP
+		vm.Tracer.AfterStep(vm, step, err)
+	}
+	return err
+}
 
+// perform executes op, then moves IP past it unless op jumped.
+func (vm *VirtualMachine) perform(op Bytecode, info OpInfo) error {
+	if op == Exit {
+		vm.Halted = true
+		return nil
+	}
+	err := vm.execute(op)
+	if err != nil {
+		return err
+	}
+	if !info.Jumps {
+		vm.IP += info.Size()
+	}
 	return nil
 }
 
-func (vm *VirtualMachine) growMemory(i uint64) {
-	memSize := uint64(len(vm.Memory))
-	if memSize-1 < i {
-		expand := (i - memSize) + 1
-		if expand < memSize {
-			expand = memSize
-		}
-		extra := make([]uint64, expand)
-		vm.Memory = append(vm.Memory, extra...)
+func (vm *VirtualMachine) finishStep(ip uint64, op Bytecode, memBefore uint64) {
+	vm.Steps++
+	if vm.Profile != nil {
+		vm.Profile.record(vm, ip, op, memBefore)
 	}
 }
 
-func LoadBytecodeFile(filePath string) (*VirtualMachine, error) {
-	panic("not implemented")
-
+// currentOp is the op at IP, or zero if IP is outside the code segment.
+func (vm *VirtualMachine) currentOp() Bytecode {
+	if !vm.isCodeAddress(vm.IP) {
+		return 0
+	}
+	return Bytecode(vm.Memory[vm.IP])
 }
 
-type Bytecode uint64
-
-const (
-	Push = Bytecode(iota + 1)
-	Pop
-	Increment
-	Decrement
-	Duplicate
-	ReadMemory
-	WriteMemory
-	OutputByte
-	Goto
-	JumpNotZero
-	Call
-	Return
-	Exit
-	Multiply
-	// Make sure you update the Bytecodes array below.
-)
-
-func Bytecodes() []Bytecode {
-	const max = Multiply
-	bc := []Bytecode{}
-	for i := Push; i <= max; i++ {
-		bc = append(bc, i)
+// fetch reads the op at IP, checking that its operands are in the code
+// segment and that the stack holds the values it needs.
+func (vm *VirtualMachine) fetch() (Bytecode, OpInfo, error) {
+	if !vm.isCodeAddress(vm.IP) {
+		return 0, OpInfo{}, ErrIPOutOfBounds
+	}
+	op := Bytecode(vm.Memory[vm.IP])
+	info, ok := op.Info()
+	if !ok {
+		return op, info, ErrUnknownBytecode
+	}
+	operandEnd := vm.IP + uint64(len(info.Operands))
+	if !vm.isCodeAddress(operandEnd) {
+		return op, info, ErrIPOutOfBounds
 	}
-	return bc
+	pops, _ := op.StackEffect(vm.Memory[vm.IP+1 : operandEnd+1])
+	return op, info, vm.requireStack(uint64(pops))
 }
 
-func (code Bytecode) String() string {
-	switch code {
+func (vm *VirtualMachine) execute(op Bytecode) error {
+	var err error
+	switch op {
 	case Push:
-		return "push"
+		x, err := vm.operand()
+		if err != nil {
+			return err
+		}
+		err = vm.incrementSP()
+		if err != nil {
+			return err
+		}
+		vm.Memory[vm.SP] = x
 	case Pop:
-		return "pop"
+		vm.Memory[vm.SP] = 0
+		vm.SP--
 	case Increment:
-		return "incr"
+		vm.Memory[vm.SP]++
 	case Decrement:
-		return "decr"
+		vm.Memory[vm.SP]--
 	case Duplicate:
-		return "dupl"
+		x := vm.Memory[vm.SP]
+		err = vm.incrementSP()
+		if err != nil {
+			return err
+		}
+		vm.Memory[vm.SP] = x
 	case ReadMemory:
-		return "rmem"
+		i := vm.Memory[vm.SP]
+		err = vm.checkHeapAccess(i)
+		if err != nil {
+			return err
+		}
+		err = vm.growMemory(i)
+		if err != nil {
+			return err
+		}
+		x := vm.Memory[i]
+		vm.Memory[vm.SP] = x
 	case WriteMemory:
-		return "wmem"
+		i := vm.Memory[vm.SP]
+		if i < vm.CodeEnd {
+			return ErrWriteToCode
+		}
+		err = vm.checkHeapAccess(i)
+		if err != nil {
+			return err
+		}
+		err = vm.growMemory(i)
+		if err != nil {
+			return err
+		}
+		x := vm.Memory[vm.SP-1]
+		vm.Memory[i] = x
+		vm.Memory[vm.SP] = 0
+		vm.SP--
 	case OutputByte:
-		return "outb"
+		x := vm.Memory[vm.SP]
+		err = vm.write([]byte{byte(x)})
+		if err != nil {
+			return err
+		}
+	case OutputDecimal:
+		x := vm.Memory[vm.SP]
+		err = vm.write([]byte(strconv.FormatUint(x, 10)))
+		if err != nil {
+			return err
+		}
+	case OutputString:
+		bs, err := vm.readString(vm.Memory[vm.SP])
+		if err != nil {
+			return err
+		}
+		err = vm.write(bs)
+		if err != nil {
+			return err
+		}
+	case InputByte:
+		x, err := vm.readByte()
+		if err != nil {
+			return err
+		}
+		err = vm.incrementSP()
+		if err != nil {
+			return err
+		}
+		vm.Memory[vm.SP] = x
+	case InputDecimal:
+		x, err := vm.readDecimal()
+		if err != nil {
+			return err
+		}
+		err = vm.incrementSP()
+		if err != nil {
+			return err
+		}
+		vm.Memory[vm.SP] = x
 	case Goto:
-		return "goto"
+		x, err := vm.operand()
+		if err != nil {
+			return err
+		}
+		vm.IP = x
 	case JumpNotZero:
-		return "jnz"
+		y, err := vm.operand()
+		if err != nil {
+			return err
+		}
+		x := vm.Memory[vm.SP]
+		if x == 0 {
+			vm.IP += 2
+			return nil
+		}
+		vm.IP = y
 	case Call:
-		return "call"
+		x, err := vm.operand()
+		if err != nil {
+			return err
+		}
+		err = vm.pushReturnAddress(vm.IP + 2)
+		if err != nil {
+			return err
+		}
+		vm.IP = x
+	case Swap:
+		vm.Memory[vm.SP-1], vm.Memory[vm.SP] = vm.Memory[vm.SP], vm.Memory[vm.SP-1]
+	case Over:
+		x := vm.Memory[vm.SP-1]
+		err = vm.incrementSP()
+		if err != nil {
+			return err
+		}
+		vm.Memory[vm.SP] = x
+	case Rotate:
+		a, b, c := vm.Memory[vm.SP-2], vm.Memory[vm.SP-1], vm.Memory[vm.SP]
+		vm.Memory[vm.SP-2], vm.Memory[vm.SP-1], vm.Memory[vm.SP] = b, c, a
+	case Pick:
+		n, err := vm.operand()
+		if err != nil {
+			return err
+		}
+		x := vm.Memory[vm.SP-n]
+		err = vm.incrementSP()
+		if err != nil {
+			return err
+		}
+		vm.Memory[vm.SP] = x
+	case Roll:
+		n, err := vm.operand()
+		if err != nil {
+			return err
+		}
+		x := vm.Memory[vm.SP-n]
+		copy(vm.Memory[vm.SP-n:vm.SP], vm.Memory[vm.SP-n+1:vm.SP+1])
+		vm.Memory[vm.SP] = x
+	case DropN:
+		n, err := vm.operand()
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < n; i++ {
+			vm.Memory[vm.SP] = 0
+			vm.SP--
+		}
+	case Enter:
+		n, err := vm.operand()
+		if err != nil {
+			return err
+		}
+		for _, x := range []uint64{n, vm.FP} {
+			err = vm.incrementSP()
+			if err != nil {
+				return err
+			}
+			vm.Memory[vm.SP] = x
+		}
+		vm.FP = vm.SP
+	case Leave:
+		base, _, err := vm.frame()
+		if err != nil {
+			return err
+		}
+		saved := vm.Memory[vm.FP]
+		results := vm.SP - vm.FP
+		copy(vm.Memory[base+1:], vm.Memory[vm.FP+1:vm.SP+1])
+		for addr := base + results + 1; addr <= vm.SP; addr++ {
+			vm.Memory[addr] = 0
+		}
+		vm.SP = base + results
+		vm.FP = saved
+	case LoadLocal:
+		addr, err := vm.localAddress()
+		if err != nil {
+			return err
+		}
+		err = vm.incrementSP()
+		if err != nil {
+			return err
+		}
+		vm.Memory[vm.SP] = vm.Memory[addr]
+	case StoreLocal:
+		addr, err := vm.localAddress()
+		if err != nil {
+			return err
+		}
+		if vm.SP <= vm.FP {
+			return ErrStackUnderflow
+		}
+		vm.Memory[addr] = vm.Memory[vm.SP]
+		vm.Memory[vm.SP] = 0
+		vm.SP--
+	case Alloc:
+		p, err := vm.alloc(vm.Memory[vm.SP])
+		if err != nil {
+			return err
+		}
+		vm.Memory[vm.SP] = p
+	case Free:
+		err = vm.free(vm.Memory[vm.SP])
+		if err != nil {
+			return err
+		}
+		vm.Memory[vm.SP] = 0
+		vm.SP--
+	case GotoIndirect:
+		vm.IP = vm.popTarget()
+	case CallIndirect:
+		x := vm.popTarget()
+		err = vm.pushReturnAddress(vm.IP + 1)
+		if err != nil {
+			return err
+		}
+		vm.IP = x
 	case Return:
-		return "rtn"
-	case Exit:
-		return "exit"
-	case Multiply:
-		return "mult"
+		x, err := vm.popReturnAddress()
+		if err != nil {
+			return err
+		}
+		vm.IP = x
+	case Not:
+		vm.Memory[vm.SP] = ^vm.Memory[vm.SP]
+	case Multiply, Add, Subtract, Divide, Modulo, And, Or, Xor, ShiftLeft, ShiftRight, Equal, LessThan, GreaterThan:
+		return vm.binaryOp(op)
 	default:
-		return fmt.Sprint(uint64(code))
+		return ErrUnknownBytecode
+	}
+	return nil
+}
+
+// frame checks the current stack frame and returns the address below its
+// first local and the number of locals. enter n leaves the n locals, then
+// n, then the FP of the caller, with FP pointing at the last of these.
+func (vm *VirtualMachine) frame() (base uint64, n uint64, err error) {
+	if vm.FP == 0 {
+		return 0, 0, ErrNoFrame
+	}
+	if vm.FP > vm.SP || vm.FP < vm.StackStart+2 {
+		return 0, 0, ErrStackUnderflow
+	}
+	n = vm.Memory[vm.FP-1]
+	if n > vm.FP-2-vm.StackStart {
+		return 0, 0, ErrStackUnderflow
+	}
+	return vm.FP - 2 - n, n, nil
+}
+
+// localAddress returns the address of the local named by the operand.
+func (vm *VirtualMachine) localAddress() (uint64, error) {
+	i, err := vm.operand()
+	if err != nil {
+		return 0, err
+	}
+	base, n, err := vm.frame()
+	if err != nil {
+		return 0, err
+	}
+	if i >= n {
+		return 0, ErrLocalOutOfRange
+	}
+	return base + 1 + i, nil
+}
+
+// popTarget pops the address an indirect jump or call goes to. A bad
+// address is reported when the next instruction is fetched.
+func (vm *VirtualMachine) popTarget() uint64 {
+	x := vm.Memory[vm.SP]
+	vm.Memory[vm.SP] = 0
+	vm.SP--
+	return x
+}
+
+// binaryOp pops the top two stack values and pushes the result of op.
+func (vm *VirtualMachine) binaryOp(op Bytecode) error {
+	a, b := vm.Memory[vm.SP-1], vm.Memory[vm.SP]
+	x, err := BinaryResult(op, a, b)
+	if err != nil {
+		return err
+	}
+	vm.Memory[vm.SP] = 0
+	vm.SP--
+	vm.Memory[vm.SP] = x
+	return nil
+}
+
+// BinaryResult is the value a binary op leaves on the stack when b is on
+// top of a, so "push a; push b; sub" leaves a - b.
+func BinaryResult(op Bytecode, a, b uint64) (uint64, error) {
+	switch op {
+	case Multiply:
+		return a * b, nil
+	case Add:
+		return a + b, nil
+	case Subtract:
+		return a - b, nil
+	case Divide:
+		if b == 0 {
+			return 0, ErrDivisionByZero
+		}
+		return a / b, nil
+	case Modulo:
+		if b == 0 {
+			return 0, ErrDivisionByZero
+		}
+		return a % b, nil
+	case And:
+		return a & b, nil
+	case Or:
+		return a | b, nil
+	case Xor:
+		return a ^ b, nil
+	case ShiftLeft:
+		return a << b, nil
+	case ShiftRight:
+		return a >> b, nil
+	case Equal:
+		return boolWord(a == b), nil
+	case LessThan:
+		return boolWord(a < b), nil
+	case GreaterThan:
+		return boolWord(a > b), nil
+	}
+	return 0, ErrUnknownBytecode
+}
+
+func boolWord(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// readString reads a string stored as a length word followed by one byte per word.
+func (vm *VirtualMachine) readString(addr uint64) ([]byte, error) {
+	memSize := uint64(len(vm.Memory))
+	if addr >= memSize {
+		return nil, ErrMemoryOutOfBounds
+	}
+	length := vm.Memory[addr]
+	if length > memSize-addr-1 {
+		return nil, ErrMemoryOutOfBounds
+	}
+	bs := make([]byte, length)
+	for i := range bs {
+		bs[i] = byte(vm.Memory[addr+1+uint64(i)])
+	}
+	return bs, nil
+}
+
+// write sends bs to Output, counting the bytes written.
+func (vm *VirtualMachine) write(bs []byte) error {
+	n, err := vm.Output.Write(bs)
+	vm.OutputOffset += uint64(n)
+	return err
+}
+
+func (vm *VirtualMachine) inputReader() *bufio.Reader {
+	if vm.Input == nil {
+		return nil
+	}
+	if vm.input == nil || vm.inputSource != vm.Input {
+		vm.input = bufio.NewReader(vm.Input)
+		vm.inputSource = vm.Input
+	}
+	return vm.input
+}
+
+func (vm *VirtualMachine) readByte() (uint64, error) {
+	r := vm.inputReader()
+	if r == nil {
+		return InputEOF, nil
+	}
+	b, err := r.ReadByte()
+	if err == io.EOF {
+		return InputEOF, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	vm.InputOffset++
+	return uint64(b), nil
+}
+
+// readDecimal skips leading whitespace and parses an unsigned decimal integer.
+func (vm *VirtualMachine) readDecimal() (uint64, error) {
+	r := vm.inputReader()
+	if r == nil {
+		return InputEOF, nil
+	}
+	digits := []byte{}
+	for {
+		b, err := r.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		vm.InputOffset++
+		if b >= '0' && b <= '9' {
+			digits = append(digits, b)
+			continue
+		}
+		if len(digits) > 0 {
+			err = r.UnreadByte()
+			if err != nil {
+				return 0, err
+			}
+			vm.InputOffset--
+			break
+		}
+		if b != ' ' && b != '\t' && b != '\r' && b != '\n' {
+			return 0, fmt.Errorf("%w: unexpected %q", ErrInvalidInput, b)
+		}
+	}
+	if len(digits) == 0 {
+		return InputEOF, nil
+	}
+	x, err := strconv.ParseUint(string(digits), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", ErrInvalidInput, err)
+	}
+	return x, nil
+}
+
+// operand reads the word following the current instruction.
+func (vm *VirtualMachine) operand() (uint64, error) {
+	addr := vm.IP + 1
+	if !vm.isCodeAddress(addr) {
+		return 0, ErrIPOutOfBounds
+	}
+	return vm.Memory[addr], nil
+}
+
+func (vm *VirtualMachine) isCodeAddress(addr uint64) bool {
+	if vm.CodeEnd != 0 && addr >= vm.CodeEnd {
+		return false
+	}
+	return addr < uint64(len(vm.Memory))
+}
+
+// requireStack checks that at least n values are above the stack start.
+func (vm *VirtualMachine) requireStack(n uint64) error {
+	if vm.SP < vm.StackStart || vm.SP-vm.StackStart < n {
+		return ErrStackUnderflow
+	}
+	return nil
+}
+
+func (vm *VirtualMachine) incrementSP() error {
+	if vm.SP+1 >= vm.StackEnd {
+		return ErrStackOverflow
+	}
+	vm.SP++
+
+	return nil
+}
+
+func (vm *VirtualMachine) pushReturnAddress(addr uint64) error {
+	maxDepth := vm.MaxCallDepth
+	if maxDepth == 0 {
+		maxDepth = DefaultMaxCallDepth
+	}
+	if uint64(len(vm.CallStack)) >= maxDepth {
+		return ErrCallStackOverflow
+	}
+	vm.CallStack = append(vm.CallStack, addr)
+
+	return nil
+}
+
+func (vm *VirtualMachine) popReturnAddress() (uint64, error) {
+	depth := len(vm.CallStack)
+	if depth == 0 {
+		return 0, ErrCallStackUnderflow
+	}
+	addr := vm.CallStack[depth-1]
+	vm.CallStack = vm.CallStack[:depth-1]
+
+	return addr, nil
+}
+
+// growMemory makes address i usable, at least doubling the memory each
+// time it grows but never past the memory limit.
+func (vm *VirtualMachine) growMemory(i uint64) error {
+	memSize := uint64(len(vm.Memory))
+	if i < memSize {
+		return nil
+	}
+	limit := vm.MaxMemory
+	if limit == 0 {
+		limit = DefaultMaxMemory
+	}
+	if i >= limit {
+		return ErrMemoryLimit
 	}
+	size := memSize * 2
+	if size < i+1 {
+		size = i + 1
+	}
+	if size > limit {
+		size = limit
+	}
+	vm.Memory = append(vm.Memory, make([]uint64, size-memSize)...)
+	return nil
 }
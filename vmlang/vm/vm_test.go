@@ -2,9 +2,12 @@ package vm
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func factorialMemory() []uint64 {
@@ -39,9 +42,25 @@ func factorialMemory() []uint64 {
 	return facM
 }
 
+// recursiveFactorialMemory computes 5! with a subroutine that keeps its
+// argument in a stack frame.
+func recursiveFactorialMemory() []uint64 {
+	code := []uint64{
+		uint64(Push), 5, uint64(Call), 6, uint64(OutputDecimal), uint64(Exit),
+		// fact: enter 1; lload 0; jnz recurse; pop; push 1; leave; rtn
+		uint64(Enter), 1, uint64(LoadLocal), 0, uint64(JumpNotZero), 17, uint64(Pop), uint64(Push), 1, uint64(Leave), uint64(Return),
+		// recurse: decr; call fact; lload 0; mult; leave; rtn
+		uint64(Decrement), uint64(Call), 6, uint64(LoadLocal), 0, uint64(Multiply), uint64(Leave), uint64(Return),
+	}
+	memory := make([]uint64, 100)
+	copy(memory, code)
+	return memory
+}
+
 func TestVM(t *testing.T) {
 	testCases := map[string]struct {
 		vm            *VirtualMachine
+		input         string
 		expected      []byte
 		expectedError error
 	}{
@@ -117,11 +136,214 @@ func TestVM(t *testing.T) {
 				StackEnd: 100,
 			},
 		},
+		"output decimal": {
+			expected: []byte("18446744073709551615"),
+			vm: &VirtualMachine{
+				Memory:   []uint64{uint64(Push), ^uint64(0), uint64(OutputDecimal), uint64(Exit), 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+				IP:       0,
+				SP:       5,
+				StackEnd: 10,
+			},
+		},
+		"output string": {
+			expected: []byte("hi!"),
+			vm: &VirtualMachine{
+				Memory:   []uint64{uint64(Push), 10, uint64(OutputString), uint64(Exit), 0, 0, 0, 0, 0, 0, 3, 'h', 'i', '!'},
+				IP:       0,
+				SP:       4,
+				StackEnd: 8,
+			},
+		},
+		"echo input": {
+			input:    "cat",
+			expected: []byte("cat"),
+			vm: &VirtualMachine{
+				// loop: inb; dupl; incr; jnz out; exit; out: pop; outb; pop; goto loop
+				Memory:   []uint64{uint64(InputByte), uint64(Duplicate), uint64(Increment), uint64(JumpNotZero), 7, uint64(Exit), 0, uint64(Pop), uint64(OutputByte), uint64(Pop), uint64(Goto), 0, 0, 0, 0, 0, 0, 0, 0},
+				IP:       0,
+				SP:       13,
+				StackEnd: 18,
+			},
+		},
+		"input decimals": {
+			input:    "  300\n\t12\n",
+			expected: []byte("312"),
+			vm: &VirtualMachine{
+				Memory:   []uint64{uint64(InputDecimal), uint64(InputDecimal), uint64(Add), uint64(OutputDecimal), uint64(Exit), 0, 0, 0, 0, 0, 0, 0},
+				IP:       0,
+				SP:       6,
+				StackEnd: 12,
+			},
+		},
+		"input decimal at eof": {
+			input:    " \n",
+			expected: []byte("18446744073709551615"),
+			vm: &VirtualMachine{
+				Memory:   []uint64{uint64(InputDecimal), uint64(OutputDecimal), uint64(Exit), 0, 0, 0, 0, 0},
+				IP:       0,
+				SP:       4,
+				StackEnd: 8,
+			},
+		},
+		"input not a decimal": {
+			input:         "12 x",
+			expectedError: ErrInvalidInput,
+			vm: &VirtualMachine{
+				Memory:   []uint64{uint64(InputDecimal), uint64(InputDecimal), uint64(Exit), 0, 0, 0, 0, 0},
+				IP:       0,
+				SP:       4,
+				StackEnd: 8,
+			},
+		},
+		"call and return": {
+			expected: []byte{7, 8},
+			vm: &VirtualMachine{
+				Memory:   []uint64{uint64(Push), 7, uint64(Call), 7, uint64(Increment), uint64(OutputByte), uint64(Exit), uint64(OutputByte), uint64(Return), 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+				IP:       0,
+				SP:       10,
+				StackEnd: 100,
+			},
+		},
+		"nested call": {
+			expected: []byte{3},
+			vm: &VirtualMachine{
+				Memory:   []uint64{uint64(Push), 1, uint64(Call), 6, uint64(OutputByte), uint64(Exit), uint64(Increment), uint64(Call), 10, uint64(Return), uint64(Increment), uint64(Return), 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+				IP:       0,
+				SP:       13,
+				StackEnd: 100,
+			},
+		},
+		"indirect goto": {
+			expected: []byte("y"),
+			vm: &VirtualMachine{
+				Memory:   []uint64{uint64(Push), 7, uint64(GotoIndirect), uint64(Push), 'n', uint64(OutputByte), uint64(Exit), uint64(Push), 'y', uint64(OutputByte), uint64(Exit), 0, 0, 0, 0, 0, 0, 0, 0},
+				IP:       0,
+				SP:       12,
+				StackEnd: 18,
+			},
+		},
+		"indirect call": {
+			expected: []byte("ab"),
+			vm: &VirtualMachine{
+				Memory:   []uint64{uint64(Push), 'a', uint64(Push), 8, uint64(CallIndirect), uint64(Increment), uint64(OutputByte), uint64(Exit), uint64(OutputByte), uint64(Return), 0, 0, 0, 0, 0, 0, 0, 0},
+				IP:       0,
+				SP:       11,
+				StackEnd: 17,
+			},
+		},
+		"swap": {
+			expected: []byte("ab"),
+			vm: &VirtualMachine{
+				Memory:   []uint64{uint64(Push), 'a', uint64(Push), 'b', uint64(Swap), uint64(OutputByte), uint64(Pop), uint64(OutputByte), uint64(Exit), 0, 0, 0, 0, 0, 0},
+				SP:       9,
+				StackEnd: 15,
+			},
+		},
+		"over": {
+			expected: []byte("aba"),
+			vm: &VirtualMachine{
+				Memory:   []uint64{uint64(Push), 'a', uint64(Push), 'b', uint64(Over), uint64(OutputByte), uint64(Pop), uint64(OutputByte), uint64(Pop), uint64(OutputByte), uint64(Exit), 0, 0, 0, 0, 0, 0},
+				SP:       11,
+				StackEnd: 17,
+			},
+		},
+		"rot": {
+			expected: []byte("acb"),
+			vm: &VirtualMachine{
+				Memory:   []uint64{uint64(Push), 'a', uint64(Push), 'b', uint64(Push), 'c', uint64(Rotate), uint64(OutputByte), uint64(Pop), uint64(OutputByte), uint64(Pop), uint64(OutputByte), uint64(Exit), 0, 0, 0, 0, 0, 0},
+				SP:       13,
+				StackEnd: 19,
+			},
+		},
+		"pick": {
+			expected: []byte("ac"),
+			vm: &VirtualMachine{
+				Memory:   []uint64{uint64(Push), 'a', uint64(Push), 'b', uint64(Push), 'c', uint64(Pick), 2, uint64(OutputByte), uint64(Pop), uint64(OutputByte), uint64(Exit), 0, 0, 0, 0, 0, 0, 0},
+				SP:       12,
+				StackEnd: 19,
+			},
+		},
+		"roll": {
+			expected: []byte("acb"),
+			vm: &VirtualMachine{
+				Memory:   []uint64{uint64(Push), 'a', uint64(Push), 'b', uint64(Push), 'c', uint64(Roll), 2, uint64(OutputByte), uint64(Pop), uint64(OutputByte), uint64(Pop), uint64(OutputByte), uint64(Exit), 0, 0, 0, 0, 0, 0},
+				SP:       14,
+				StackEnd: 20,
+			},
+		},
+		"dropn": {
+			expected: []byte("a"),
+			vm: &VirtualMachine{
+				Memory:   []uint64{uint64(Push), 'a', uint64(Push), 'b', uint64(Push), 'c', uint64(DropN), 2, uint64(OutputByte), uint64(Exit), 0, 0, 0, 0, 0, 0},
+				SP:       10,
+				StackEnd: 16,
+			},
+		},
+		"recursive factorial": {
+			expected: []byte("120"),
+			vm: &VirtualMachine{
+				Memory:     recursiveFactorialMemory(),
+				SP:         25,
+				StackStart: 25,
+				StackEnd:   100,
+			},
+		},
+		"leave keeps results": {
+			expected: []byte("ba"),
+			vm: &VirtualMachine{
+				Memory: []uint64{uint64(Push), 'a', uint64(Push), 'b', uint64(Enter), 2, uint64(LoadLocal), 0, uint64(LoadLocal), 1,
+					uint64(Leave), uint64(OutputByte), uint64(Pop), uint64(OutputByte), uint64(Exit), 0, 0, 0, 0, 0, 0, 0, 0, 0},
+				SP:         15,
+				StackStart: 15,
+				StackEnd:   24,
+			},
+		},
+		"lstore": {
+			expected: []byte("c"),
+			vm: &VirtualMachine{
+				Memory: []uint64{uint64(Push), 'a', uint64(Enter), 1, uint64(Push), 'c', uint64(StoreLocal), 0,
+					uint64(LoadLocal), 0, uint64(Leave), uint64(OutputByte), uint64(Exit), 0, 0, 0, 0, 0, 0, 0},
+				SP:         13,
+				StackStart: 13,
+				StackEnd:   20,
+			},
+		},
+		"alloc and free": {
+			expected: []byte("k"),
+			vm: &VirtualMachine{
+				Memory: []uint64{uint64(Push), 1, uint64(Alloc), uint64(Push), 'k', uint64(Over), uint64(WriteMemory), uint64(Pop),
+					uint64(Duplicate), uint64(ReadMemory), uint64(OutputByte), uint64(Pop), uint64(Free), uint64(Exit), 0, 0, 0, 0, 0, 0},
+				SP:         13,
+				StackStart: 13,
+				StackEnd:   20,
+				HeapDebug:  true,
+			},
+		},
+		"call stack overflow": {
+			expectedError: ErrCallStackOverflow,
+			vm: &VirtualMachine{
+				Memory:       []uint64{uint64(Call), 0, uint64(Exit), 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+				IP:           0,
+				SP:           5,
+				StackEnd:     100,
+				MaxCallDepth: 16,
+			},
+		},
+		"call stack underflow": {
+			expectedError: ErrCallStackUnderflow,
+			vm: &VirtualMachine{
+				Memory:   []uint64{uint64(Return), uint64(Exit), 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+				IP:       0,
+				SP:       5,
+				StackEnd: 100,
+			},
+		},
 	}
 	for name, testCase := range testCases {
 		t.Run(name, func(t *testing.T) {
 			output := &bytes.Buffer{}
 			testCase.vm.Output = output
+			testCase.vm.Input = strings.NewReader(testCase.input)
 			err := testCase.vm.Execute()
 			if !errors.Is(err, testCase.expectedError) {
 				t.Fatalf("expected error: %s but received: %s", testCase.expectedError, err)
@@ -147,3 +369,495 @@ func TestBytecodeRepresentation(t *testing.T) {
 		}
 	}
 }
+
+func TestOpcodeTable(t *testing.T) {
+	mnemonics := map[string]Bytecode{}
+	for _, op := range Bytecodes() {
+		info, ok := op.Info()
+		if !ok {
+			t.Fatalf("expected info for bytecode %d", op)
+		}
+		if other, exists := mnemonics[info.Mnemonic]; exists {
+			t.Errorf("bytecodes %d and %d share mnemonic %s", other, op, info.Mnemonic)
+		}
+		mnemonics[info.Mnemonic] = op
+		if op.String() != info.Mnemonic {
+			t.Errorf("expected %d to print as %s but was: %s", op, info.Mnemonic, op)
+		}
+		if info.Size() != uint64(1+op.OperandCount()) {
+			t.Errorf("expected %s to have size %d but was: %d", op, 1+op.OperandCount(), info.Size())
+		}
+	}
+	if _, ok := Bytecode(0).Info(); ok {
+		t.Error("expected no info for bytecode 0")
+	}
+}
+
+func TestArithmetic(t *testing.T) {
+	type testCase struct {
+		op            Bytecode
+		a, b          uint64
+		expected      uint64
+		expectedError error
+	}
+
+	testCases := map[string]testCase{
+		"add":             {op: Add, a: 300, b: 12, expected: 312},
+		"add overflow":    {op: Add, a: ^uint64(0), b: 2, expected: 1},
+		"sub":             {op: Subtract, a: 300, b: 12, expected: 288},
+		"sub underflow":   {op: Subtract, a: 1, b: 2, expected: ^uint64(0)},
+		"mult":            {op: Multiply, a: 300, b: 12, expected: 3600},
+		"div":             {op: Divide, a: 300, b: 12, expected: 25},
+		"div truncates":   {op: Divide, a: 7, b: 2, expected: 3},
+		"div by zero":     {op: Divide, a: 7, b: 0, expectedError: ErrDivisionByZero},
+		"mod":             {op: Modulo, a: 7, b: 3, expected: 1},
+		"mod by zero":     {op: Modulo, a: 7, b: 0, expectedError: ErrDivisionByZero},
+		"and":             {op: And, a: 0b1100, b: 0b1010, expected: 0b1000},
+		"or":              {op: Or, a: 0b1100, b: 0b1010, expected: 0b1110},
+		"xor":             {op: Xor, a: 0b1100, b: 0b1010, expected: 0b0110},
+		"shl":             {op: ShiftLeft, a: 3, b: 4, expected: 48},
+		"shr":             {op: ShiftRight, a: 48, b: 4, expected: 3},
+		"shr past width":  {op: ShiftRight, a: 48, b: 64, expected: 0},
+		"eq when equal":   {op: Equal, a: 5, b: 5, expected: 1},
+		"eq when unequal": {op: Equal, a: 5, b: 6, expected: 0},
+		"lt when less":    {op: LessThan, a: 5, b: 6, expected: 1},
+		"lt when greater": {op: LessThan, a: 6, b: 5, expected: 0},
+		"gt when greater": {op: GreaterThan, a: 6, b: 5, expected: 1},
+		"gt when equal":   {op: GreaterThan, a: 5, b: 5, expected: 0},
+		"not":             {op: Not, a: 5, b: 0b1010, expected: ^uint64(0b1010)},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			vm := &VirtualMachine{
+				Memory:   []uint64{uint64(Push), tc.a, uint64(Push), tc.b, uint64(tc.op), uint64(Exit), 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+				IP:       0,
+				SP:       8,
+				StackEnd: 16,
+			}
+			err := vm.Execute()
+			if !errors.Is(err, tc.expectedError) {
+				t.Fatalf("expected error: %s but received: %s", tc.expectedError, err)
+			}
+			if tc.expectedError != nil {
+				return
+			}
+			actual := vm.Memory[vm.SP]
+			if tc.expected != actual {
+				t.Errorf("expected top of stack: %v but was: %v", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestRuntimeErrors(t *testing.T) {
+	type testCase struct {
+		vm            *VirtualMachine
+		expectedError error
+		expectedIP    uint64
+		expectedOp    Bytecode
+	}
+
+	testCases := map[string]testCase{
+		"pop empty stack": {
+			vm: &VirtualMachine{
+				Memory:     []uint64{uint64(Pop), uint64(Exit), 0, 0, 0, 0, 0},
+				SP:         3,
+				StackStart: 3,
+				StackEnd:   6,
+			},
+			expectedError: ErrStackUnderflow,
+			expectedIP:    0,
+			expectedOp:    Pop,
+		},
+		"mult with one value": {
+			vm: &VirtualMachine{
+				Memory:     []uint64{uint64(Push), 3, uint64(Multiply), uint64(Exit), 0, 0, 0, 0, 0},
+				SP:         5,
+				StackStart: 5,
+				StackEnd:   8,
+			},
+			expectedError: ErrStackUnderflow,
+			expectedIP:    2,
+			expectedOp:    Multiply,
+		},
+		"wmem with address only": {
+			vm: &VirtualMachine{
+				Memory:     []uint64{uint64(Push), 20, uint64(WriteMemory), uint64(Exit), 0, 0, 0, 0, 0},
+				SP:         5,
+				StackStart: 5,
+				StackEnd:   8,
+			},
+			expectedError: ErrStackUnderflow,
+			expectedIP:    2,
+			expectedOp:    WriteMemory,
+		},
+		"push overflow": {
+			vm: &VirtualMachine{
+				Memory:     []uint64{uint64(Push), 1, uint64(Goto), 0, 0, 0, 0, 0},
+				CodeEnd:    4,
+				SP:         4,
+				StackStart: 4,
+				StackEnd:   7,
+			},
+			expectedError: ErrStackOverflow,
+			expectedIP:    0,
+			expectedOp:    Push,
+		},
+		"write to code": {
+			vm: &VirtualMachine{
+				Memory:     []uint64{uint64(Push), 9, uint64(Push), 1, uint64(WriteMemory), uint64(Exit), 0, 0, 0, 0},
+				CodeEnd:    6,
+				SP:         6,
+				StackStart: 6,
+				StackEnd:   10,
+			},
+			expectedError: ErrWriteToCode,
+			expectedIP:    4,
+			expectedOp:    WriteMemory,
+		},
+		"goto outside code": {
+			vm: &VirtualMachine{
+				Memory:     []uint64{uint64(Goto), 7, uint64(Exit), 0, 0, 0, 0, 0},
+				CodeEnd:    3,
+				SP:         3,
+				StackStart: 3,
+				StackEnd:   6,
+			},
+			expectedError: ErrIPOutOfBounds,
+			expectedIP:    7,
+		},
+		"indirect goto outside code": {
+			vm: &VirtualMachine{
+				Memory:     []uint64{uint64(Push), 9, uint64(GotoIndirect), uint64(Exit), 0, 0, 0, 0},
+				CodeEnd:    4,
+				SP:         4,
+				StackStart: 4,
+				StackEnd:   7,
+			},
+			expectedError: ErrIPOutOfBounds,
+			expectedIP:    9,
+		},
+		"indirect call with empty stack": {
+			vm: &VirtualMachine{
+				Memory:     []uint64{uint64(CallIndirect), uint64(Exit), 0, 0, 0},
+				CodeEnd:    2,
+				SP:         2,
+				StackStart: 2,
+				StackEnd:   5,
+			},
+			expectedError: ErrStackUnderflow,
+			expectedIP:    0,
+			expectedOp:    CallIndirect,
+		},
+		"pick below the stack": {
+			vm: &VirtualMachine{
+				Memory:     []uint64{uint64(Push), 1, uint64(Pick), 1, uint64(Exit), 0, 0, 0},
+				SP:         5,
+				StackStart: 5,
+				StackEnd:   8,
+			},
+			expectedError: ErrStackUnderflow,
+			expectedIP:    2,
+			expectedOp:    Pick,
+		},
+		"dropn more than the stack holds": {
+			vm: &VirtualMachine{
+				Memory:     []uint64{uint64(Push), 1, uint64(DropN), 2, uint64(Exit), 0, 0, 0},
+				SP:         5,
+				StackStart: 5,
+				StackEnd:   8,
+			},
+			expectedError: ErrStackUnderflow,
+			expectedIP:    2,
+			expectedOp:    DropN,
+		},
+		"roll with a huge count": {
+			vm: &VirtualMachine{
+				Memory:     []uint64{uint64(Push), 1, uint64(Roll), 1 << 63, uint64(Exit), 0, 0, 0},
+				SP:         5,
+				StackStart: 5,
+				StackEnd:   8,
+			},
+			expectedError: ErrStackUnderflow,
+			expectedIP:    2,
+			expectedOp:    Roll,
+		},
+		"lload without a frame": {
+			vm: &VirtualMachine{
+				Memory:     []uint64{uint64(LoadLocal), 0, uint64(Exit), 0, 0, 0},
+				SP:         3,
+				StackStart: 3,
+				StackEnd:   6,
+			},
+			expectedError: ErrNoFrame,
+			expectedIP:    0,
+			expectedOp:    LoadLocal,
+		},
+		"lload past the locals": {
+			vm: &VirtualMachine{
+				Memory:     []uint64{uint64(Push), 1, uint64(Enter), 1, uint64(LoadLocal), 1, uint64(Exit), 0, 0, 0, 0, 0},
+				SP:         7,
+				StackStart: 7,
+				StackEnd:   12,
+			},
+			expectedError: ErrLocalOutOfRange,
+			expectedIP:    4,
+			expectedOp:    LoadLocal,
+		},
+		"lstore into the frame": {
+			vm: &VirtualMachine{
+				Memory:     []uint64{uint64(Push), 1, uint64(Enter), 1, uint64(StoreLocal), 0, uint64(Exit), 0, 0, 0, 0, 0},
+				SP:         7,
+				StackStart: 7,
+				StackEnd:   12,
+			},
+			expectedError: ErrStackUnderflow,
+			expectedIP:    4,
+			expectedOp:    StoreLocal,
+		},
+		"leave after popping the frame": {
+			vm: &VirtualMachine{
+				Memory:     []uint64{uint64(Enter), 0, uint64(Pop), uint64(Leave), uint64(Exit), 0, 0, 0, 0, 0},
+				SP:         5,
+				StackStart: 5,
+				StackEnd:   10,
+			},
+			expectedError: ErrStackUnderflow,
+			expectedIP:    3,
+			expectedOp:    Leave,
+		},
+		"enter with too few values": {
+			vm: &VirtualMachine{
+				Memory:     []uint64{uint64(Enter), 1, uint64(Exit), 0, 0, 0, 0},
+				SP:         3,
+				StackStart: 3,
+				StackEnd:   7,
+			},
+			expectedError: ErrStackUnderflow,
+			expectedIP:    0,
+			expectedOp:    Enter,
+		},
+		"use after free": {
+			vm: &VirtualMachine{
+				Memory:     []uint64{uint64(Push), 1, uint64(Alloc), uint64(Duplicate), uint64(Free), uint64(ReadMemory), uint64(Exit), 0, 0, 0},
+				SP:         6,
+				StackStart: 6,
+				StackEnd:   10,
+				HeapDebug:  true,
+			},
+			expectedError: ErrUseAfterFree,
+			expectedIP:    5,
+			expectedOp:    ReadMemory,
+		},
+		"free with empty stack": {
+			vm: &VirtualMachine{
+				Memory:     []uint64{uint64(Free), uint64(Exit), 0, 0},
+				SP:         2,
+				StackStart: 2,
+				StackEnd:   4,
+			},
+			expectedError: ErrStackUnderflow,
+			expectedIP:    0,
+			expectedOp:    Free,
+		},
+		"operand past code": {
+			vm: &VirtualMachine{
+				Memory:     []uint64{uint64(Push), 0, 0, 0},
+				CodeEnd:    1,
+				SP:         2,
+				StackStart: 2,
+				StackEnd:   4,
+			},
+			expectedError: ErrIPOutOfBounds,
+			expectedIP:    0,
+			expectedOp:    Push,
+		},
+		"ip past memory": {
+			vm: &VirtualMachine{
+				Memory:   []uint64{uint64(Goto), 100},
+				SP:       1,
+				StackEnd: 2,
+			},
+			expectedError: ErrIPOutOfBounds,
+			expectedIP:    100,
+		},
+		"string past memory": {
+			vm: &VirtualMachine{
+				Memory:     []uint64{uint64(Push), 7, uint64(OutputString), uint64(Exit), 0, 0, 0, 4, 'a', 'b'},
+				CodeEnd:    4,
+				SP:         4,
+				StackStart: 4,
+				StackEnd:   7,
+			},
+			expectedError: ErrMemoryOutOfBounds,
+			expectedIP:    2,
+			expectedOp:    OutputString,
+		},
+		"instruction limit": {
+			vm: &VirtualMachine{
+				Memory:     []uint64{uint64(Increment), uint64(Goto), 0, uint64(Exit), 0, 0, 0},
+				CodeEnd:    4,
+				SP:         5,
+				StackStart: 4,
+				StackEnd:   7,
+				MaxSteps:   5,
+			},
+			expectedError: ErrStepLimit,
+			expectedIP:    1,
+			expectedOp:    Goto,
+		},
+		"memory limit": {
+			vm: &VirtualMachine{
+				Memory:     []uint64{uint64(Push), 64, uint64(ReadMemory), uint64(Exit), 0, 0, 0, 0},
+				CodeEnd:    4,
+				SP:         4,
+				StackStart: 4,
+				StackEnd:   7,
+				MaxMemory:  32,
+			},
+			expectedError: ErrMemoryLimit,
+			expectedIP:    2,
+			expectedOp:    ReadMemory,
+		},
+		"unknown bytecode": {
+			vm: &VirtualMachine{
+				Memory:     []uint64{999, uint64(Exit), 0, 0, 0},
+				CodeEnd:    2,
+				SP:         2,
+				StackStart: 2,
+				StackEnd:   5,
+			},
+			expectedError: ErrUnknownBytecode,
+			expectedIP:    0,
+			expectedOp:    999,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			tc.vm.Output = &bytes.Buffer{}
+			err := tc.vm.Execute()
+			if !errors.Is(err, tc.expectedError) {
+				t.Fatalf("expected error: %s but received: %s", tc.expectedError, err)
+			}
+			runtimeErr := &RuntimeError{}
+			if !errors.As(err, &runtimeErr) {
+				t.Fatalf("expected RuntimeError but received: %T", err)
+			}
+			if runtimeErr.IP != tc.expectedIP || runtimeErr.Op != tc.expectedOp {
+				t.Errorf("expected ip: %v op: %v but received ip: %v op: %v", tc.expectedIP, tc.expectedOp, runtimeErr.IP, runtimeErr.Op)
+			}
+		})
+	}
+}
+
+func TestMemoryGrowsToLimit(t *testing.T) {
+	vm := &VirtualMachine{
+		Memory:     []uint64{uint64(Push), 7, uint64(Push), 30, uint64(WriteMemory), uint64(Exit), 0, 0, 0, 0},
+		CodeEnd:    6,
+		SP:         6,
+		StackStart: 6,
+		StackEnd:   9,
+		MaxMemory:  31,
+	}
+	err := vm.Execute()
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	if len(vm.Memory) != 31 || vm.Memory[30] != 7 {
+		t.Errorf("expected 31 words with 7 at the end but was: %v", vm.Memory)
+	}
+}
+
+func TestExecuteContext(t *testing.T) {
+	loop := func() *VirtualMachine {
+		return &VirtualMachine{
+			Memory:     []uint64{uint64(Goto), 0, uint64(Exit), 0, 0},
+			CodeEnd:    3,
+			SP:         3,
+			StackStart: 3,
+			StackEnd:   5,
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := loop().ExecuteContext(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected cancelled err but was: %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	vm := loop()
+	err = vm.ExecuteContext(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline err but was: %v", err)
+	}
+	if vm.Steps == 0 {
+		t.Errorf("expected the machine to have run before the deadline")
+	}
+}
+
+func TestStep(t *testing.T) {
+	vm := &VirtualMachine{
+		Memory:   []uint64{uint64(Push), 6, uint64(Increment), uint64(Exit), 0, 0, 0, 0},
+		SP:       4,
+		StackEnd: 8,
+	}
+
+	expectedIPs := []uint64{2, 3, 3}
+	for i, expectedIP := range expectedIPs {
+		err := vm.Step()
+		if err != nil {
+			t.Fatalf("unexpected error at step %v: %s", i, err)
+		}
+		if expectedIP != vm.IP {
+			t.Errorf("expected ip: %v after step %v but was: %v", expectedIP, i, vm.IP)
+		}
+	}
+	if !vm.Halted {
+		t.Errorf("expected machine to halt at exit")
+	}
+	if vm.Memory[vm.SP] != 7 {
+		t.Errorf("expected top of stack: 7 but was: %v", vm.Memory[vm.SP])
+	}
+	err := vm.Step()
+	if !errors.Is(err, ErrHalted) {
+		t.Errorf("expected error: %s but received: %s", ErrHalted, err)
+	}
+}
+
+func TestProfile(t *testing.T) {
+	vm := &VirtualMachine{
+		Memory:     []uint64{uint64(Push), 2, uint64(Decrement), uint64(JumpNotZero), 2, uint64(Push), 20, uint64(ReadMemory), uint64(Exit), 0, 0, 0, 0},
+		CodeEnd:    9,
+		SP:         9,
+		StackStart: 9,
+		StackEnd:   12,
+		Profile:    NewProfile(),
+	}
+	err := vm.Execute()
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	prof := vm.Profile
+	expectedAddresses := map[uint64]uint64{0: 1, 2: 2, 3: 2, 5: 1, 7: 1, 8: 1}
+	if !reflect.DeepEqual(expectedAddresses, prof.AddressCounts) {
+		t.Errorf("expected address counts: %v\nactual: %v", expectedAddresses, prof.AddressCounts)
+	}
+	expectedOps := map[Bytecode]uint64{Push: 2, Decrement: 2, JumpNotZero: 2, ReadMemory: 1, Exit: 1}
+	if !reflect.DeepEqual(expectedOps, prof.OpCounts) {
+		t.Errorf("expected op counts: %v\nactual: %v", expectedOps, prof.OpCounts)
+	}
+	if prof.Steps != 8 || vm.Steps != 8 {
+		t.Errorf("expected 8 steps but profile had %d and machine %d", prof.Steps, vm.Steps)
+	}
+	if prof.MaxStackDepth != 2 {
+		t.Errorf("expected max stack depth 2 but was: %d", prof.MaxStackDepth)
+	}
+	if prof.StartMemory != 13 || prof.PeakMemory != 26 {
+		t.Errorf("expected memory to grow from 13 to 26 words but was: %d to %d", prof.StartMemory, prof.PeakMemory)
+	}
+}